@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// loadHtpasswd reads users from an htpasswd file. Only SHA1 entries, as
+// written by `htpasswd -s`, are supported since bcrypt is not available.
+func loadHtpasswd(p string) (map[string]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("malformed htpasswd line in %s", p)
+		}
+		if !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("unsupported password hash for %s in %s, use htpasswd -s", user, p)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+func htpasswdSHA(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// basicAuth requires HTTP basic credentials of one of users. With
+// anonymousPull, GET and HEAD requests are served without credentials so that
+// pulls are public while pushes stay authenticated.
+func basicAuth(next http.Handler, users map[string]string, anonymousPull bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if anonymousPull && (r.Method == "GET" || r.Method == "HEAD") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := authenticate(r, users); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		writeOciError("UNAUTHORIZED", "authentication required", w, 401)
+	})
+}
+
+// authenticate returns the user whose basic credentials a request carries,
+// and false unless they are valid.
+func authenticate(r *http.Request, users map[string]string) (string, bool) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	want, known := users[user]
+	got := htpasswdSHA(password)
+	return user, known && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// requireAdmin serves next only to the users of users that are also listed
+// in admins. Other valid users are refused with 403.
+func requireAdmin(next http.Handler, users map[string]string, admins []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := authenticate(r, users)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			writeOciError("UNAUTHORIZED", "authentication required", w, 401)
+			return
+		}
+		for _, admin := range admins {
+			if user == admin {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		writeOciError("DENIED", "admin access required", w, 403)
+	})
+}
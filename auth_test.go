@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func testUsers(t *testing.T) map[string]string {
+	t.Helper()
+	p := path.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(p, []byte("# users\nalice:"+htpasswdSHA("secret")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := loadHtpasswd(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return users
+}
+
+func TestAnonymousPull(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	putTestManifest(t, reg, "test/image", "v1", []byte(testManifest))
+	h := basicAuth(reg, testUsers(t), true)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/manifests/v1", nil))
+	if w.Code != 200 {
+		t.Errorf("anonymous GET: want 200, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/test/image/manifests/v2", bytes.NewReader([]byte(testManifest))))
+	if w.Code != 401 {
+		t.Errorf("anonymous PUT: want 401, got %d", w.Code)
+	}
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("want a WWW-Authenticate challenge")
+	}
+
+	for password, want := range map[string]int{"wrong": 401, "secret": 201} {
+		req := httptest.NewRequest("PUT", "/v2/test/image/manifests/v2", bytes.NewReader([]byte(testManifest)))
+		req.SetBasicAuth("alice", password)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("PUT with password %q: want %d, got %d", password, want, w.Code)
+		}
+	}
+}
+
+func TestAuthenticatedPull(t *testing.T) {
+	h := basicAuth(&registry{rootDir: t.TempDir()}, testUsers(t), false)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v2/", nil))
+	if w.Code != 401 {
+		t.Errorf("anonymous GET without -anonymous-pull: want 401, got %d", w.Code)
+	}
+}
+
+func TestHtpasswdUnsupportedHash(t *testing.T) {
+	p := path.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(p, []byte("bob:$2y$05$abcdefghijklmnopqrstuv\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadHtpasswd(p); err == nil {
+		t.Error("want an error for a bcrypt entry")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// blobStatCacheSize bounds the number of blobs the stat cache remembers.
+const blobStatCacheSize = 10000
+
+// statFile returns information about a stored file. Tests replace it to count
+// how often storage is consulted.
+var statFile = os.Stat
+
+// storageGeneration is bumped whenever content is removed, moved or imported
+// in bulk, such as by garbage collection, so that caches of what is stored
+// start over.
+var storageGeneration atomic.Int64
+
+// blobStat is whether a blob is stored and, if so, its size.
+type blobStat struct {
+	exists bool
+	size   int64
+}
+
+type blobStatEntry struct {
+	blobStat
+	expires time.Time
+}
+
+// blobStatCache remembers for -blob-stat-cache-ttl whether blobs exist, so
+// that clients HEADing every layer before a push do not each cost a stat.
+// Blobs written or deleted through the API are forgotten right away; bulk
+// changes clear the whole cache through storageGeneration.
+type blobStatCache struct {
+	ttl time.Duration
+	max int
+
+	mu         sync.Mutex
+	generation int64
+	entries    map[string]blobStatEntry
+}
+
+func newBlobStatCache(ttl time.Duration) *blobStatCache {
+	return &blobStatCache{ttl: ttl, max: blobStatCacheSize, entries: make(map[string]blobStatEntry)}
+}
+
+// stat reports whether a blob is stored and its size, from the cache when
+// it is fresh. It is safe on a nil cache, which always consults storage.
+// The empty JSON blob is always present.
+func (c *blobStatCache) stat(rootDir string, layout *pathTemplate, name string, digest string) (blobStat, error) {
+	if digest == emptyJSONDigest {
+		return blobStat{exists: true, size: int64(len(emptyJSON))}, nil
+	}
+	key := name + "@" + digest
+	if c != nil {
+		c.mu.Lock()
+		c.sync()
+		e, ok := c.entries[key]
+		c.mu.Unlock()
+		if ok && time.Now().Before(e.expires) {
+			return e.blobStat, nil
+		}
+	}
+	var st blobStat
+	fi, err := statFile(blobPath(rootDir, layout, name, digest))
+	if err == nil {
+		st = blobStat{exists: true, size: fi.Size()}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return st, err
+	}
+	if c != nil {
+		c.mu.Lock()
+		c.sync()
+		if len(c.entries) >= c.max {
+			c.evict()
+		}
+		c.entries[key] = blobStatEntry{blobStat: st, expires: time.Now().Add(c.ttl)}
+		c.mu.Unlock()
+	}
+	return st, nil
+}
+
+// forget drops what is known about a blob once it is written or deleted. It
+// is a no-op on a nil cache.
+func (c *blobStatCache) forget(name string, digest string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, name+"@"+digest)
+}
+
+// sync clears the cache after a bulk change to storage. The caller holds mu.
+func (c *blobStatCache) sync() {
+	if g := storageGeneration.Load(); g != c.generation {
+		c.entries = make(map[string]blobStatEntry)
+		c.generation = g
+	}
+}
+
+// evict makes room for an entry by dropping the expired ones, or else an
+// arbitrary one. The caller holds mu.
+func (c *blobStatCache) evict() {
+	now := time.Now()
+	for key, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.max {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBlobStatCache(t *testing.T) {
+	stats := 0
+	defer func(orig func(string) (os.FileInfo, error)) { statFile = orig }(statFile)
+	statFile = func(p string) (os.FileInfo, error) {
+		stats++
+		return os.Stat(p)
+	}
+	head := func(reg *registry, digest string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("HEAD", "/v2/test/image/blobs/"+digest, nil))
+		return w
+	}
+
+	reg := &registry{rootDir: t.TempDir(), blobStats: newBlobStatCache(time.Minute)}
+	layer := []byte("layer")
+	digest := getDigest(layer)
+	for i := 0; i < 3; i++ {
+		if w := head(reg, digest); w.Code != 404 {
+			t.Fatalf("before the push: want 404, got %d", w.Code)
+		}
+	}
+	if stats != 1 {
+		t.Errorf("want repeated HEADs served from the cache, got %d stats", stats)
+	}
+
+	// A push replaces the cached answer right away.
+	putTestBlobRequest(reg, "test/image", layer)
+	for i := 0; i < 3; i++ {
+		w := head(reg, digest)
+		if w.Code != 200 || w.Header().Get("Content-Length") != "5" {
+			t.Fatalf("after the push: want 200 with the size, got %d %q", w.Code, w.Header().Get("Content-Length"))
+		}
+	}
+	if stats != 2 {
+		t.Errorf("want one more stat after the push, got %d", stats)
+	}
+
+	// So does a bulk removal.
+	if err := removeRepo(reg.rootDir, "test/image"); err != nil {
+		t.Fatal(err)
+	}
+	if w := head(reg, digest); w.Code != 404 {
+		t.Errorf("after removing the repository: want 404, got %d", w.Code)
+	}
+
+	// The cache stays within its bound.
+	reg.blobStats.max = 2
+	for _, content := range []string{"a", "b", "c"} {
+		head(reg, getDigest([]byte(content)))
+	}
+	if n := len(reg.blobStats.entries); n > 2 {
+		t.Errorf("want at most 2 cached blobs, got %d", n)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// storageBreaker stops serving requests for a cool-down period once storage
+// has failed a number of times in a row, so that clients fail fast with a 503
+// instead of each waiting on a struggling backend. Once the cool-down is over
+// a single request is let through as a probe, and its outcome closes or
+// reopens the breaker.
+type storageBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	opened   time.Time
+	probing  bool
+}
+
+// allow reports whether a request may go ahead.
+func (b *storageBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.opened.IsZero() {
+		return true
+	}
+	if b.probing || time.Since(b.opened) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record counts the outcome of a request that was allowed.
+func (b *storageBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.failures = 0
+		b.opened = time.Time{}
+		b.probing = false
+		return
+	}
+	b.failures++
+	if b.probing || b.failures >= b.threshold {
+		b.opened = time.Now()
+		b.probing = false
+	}
+}
+
+// state returns whether the breaker is open and the number of consecutive
+// storage failures.
+func (b *storageBreaker) state() (bool, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.opened.IsZero(), b.failures
+}
+
+// breakOnStorageFailures guards next with a breaker. Storage errors surface
+// as 500 responses from writeServerError, so those are what it counts.
+func breakOnStorageFailures(next http.Handler, b *storageBreaker) http.Handler {
+	if b == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !b.allow() {
+			w.Header().Set("Retry-After", fmt.Sprint(int(b.cooldown.Seconds()+1)))
+			writeOciError("UNAVAILABLE", "storage unavailable", w, 503)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w, status: 200}
+		// Recorded even when next panics, which counts as a failure, so a
+		// probe can never leave the breaker open for good.
+		completed := false
+		defer func() { b.record(!completed || sw.status == 500) }()
+		next.ServeHTTP(sw, r)
+		completed = true
+	})
+}
+
+// statusWriter remembers the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps streaming responses, such as upload events, working.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
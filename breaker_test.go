@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStorageBreaker(t *testing.T) {
+	failing, calls := true, 0
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if failing {
+			writeInternalError(errors.New("input/output error"), w, false)
+			return
+		}
+		w.WriteHeader(200)
+	})
+	b := &storageBreaker{threshold: 3, cooldown: 50 * time.Millisecond}
+	h := breakOnStorageFailures(backend, b)
+	get := func() int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/tags/list", nil))
+		return w.Code
+	}
+	metrics := &metricsCache{rootDir: t.TempDir(), breaker: b}
+
+	for i := 0; i < 3; i++ {
+		if code := get(); code != 500 {
+			t.Fatalf("failure %d: want 500, got %d", i, code)
+		}
+	}
+	if code := get(); code != 503 || calls != 3 {
+		t.Fatalf("want the open breaker to answer 503 without touching storage, got %d after %d calls", code, calls)
+	}
+	if out := scrapeTestMetrics(t, metrics); !strings.Contains(out, "registry_storage_breaker_open 1\n") {
+		t.Errorf("want the breaker reported open, got:\n%s", out)
+	}
+
+	// A failing probe after the cool-down opens the breaker again.
+	time.Sleep(60 * time.Millisecond)
+	if code := get(); code != 500 {
+		t.Fatalf("want the probe let through, got %d", code)
+	}
+	if code := get(); code != 503 {
+		t.Fatalf("want the breaker reopened by the failed probe, got %d", code)
+	}
+
+	failing = false
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if code := get(); code != 200 {
+			t.Fatalf("want storage served again once it recovers, got %d", code)
+		}
+	}
+	if out := scrapeTestMetrics(t, metrics); !strings.Contains(out, "registry_storage_breaker_open 0\n") {
+		t.Errorf("want the breaker reported closed, got:\n%s", out)
+	}
+}
+
+func TestStorageBreakerPanickingProbe(t *testing.T) {
+	panicking := true
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if panicking {
+			panic("storage driver bug")
+		}
+		w.WriteHeader(200)
+	})
+	b := &storageBreaker{threshold: 1, cooldown: 10 * time.Millisecond}
+	h := recoverPanics(breakOnStorageFailures(backend, b))
+	get := func() int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/tags/list", nil))
+		return w.Code
+	}
+
+	if code := get(); code != 500 {
+		t.Fatalf("want 500 for the panic, got %d", code)
+	}
+	if code := get(); code != 503 {
+		t.Fatalf("want the breaker opened by the panic, got %d", code)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if code := get(); code != 500 {
+		t.Fatalf("want the probe let through, got %d", code)
+	}
+	panicking = false
+	time.Sleep(20 * time.Millisecond)
+	if code := get(); code != 200 {
+		t.Errorf("want a later probe let through after a panicking one, got %d", code)
+	}
+}
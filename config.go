@@ -0,0 +1,548 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Config holds the effective server settings. Defaults are overridden by an
+// optional JSON config file, which is in turn overridden by command line flags.
+type Config struct {
+	Root         string   `json:"root"`
+	NoCreateRoot bool     `json:"noCreateRoot"`
+	Fsync        bool     `json:"fsync"`
+	BlobLayout   string   `json:"blobLayout"`
+	DirMode      string   `json:"dirMode"`
+	FileMode     string   `json:"fileMode"`
+	UploadExpiry Duration `json:"uploadExpiry"`
+	MaxChunkSize int64    `json:"maxChunkSize"`
+	Addr         string   `json:"addr"`
+	TLSCert      string   `json:"tlsCert"`
+	TLSKey       string   `json:"tlsKey"`
+
+	MaxConnections int        `json:"maxConnections"`
+	IdleTimeout    Duration   `json:"idleTimeout"`
+	NoKeepAlive    bool       `json:"noKeepAlive"`
+	TrustForwarded bool       `json:"trustForwarded"`
+	TrustedProxies stringList `json:"trustedProxies"`
+
+	AuthHtpasswd  string     `json:"authHtpasswd"`
+	AnonymousPull bool       `json:"anonymousPull"`
+	AdminUsers    stringList `json:"adminUsers"`
+
+	MaxRepos        int    `json:"maxRepos"`
+	RepoEviction    string `json:"repoEviction"`
+	NameCase        string `json:"validateNameCase"`
+	MaxTotalStorage int64  `json:"maxTotalStorage"`
+
+	MaxInFlightBytes int64 `json:"maxInFlightBytes"`
+
+	StrictManifests      bool       `json:"strictManifests"`
+	AllowedManifestTypes stringList `json:"allowedManifestTypes"`
+	DefaultManifestType  string     `json:"defaultManifestMediaType"`
+	MaxIndexDepth        int        `json:"maxIndexDepth"`
+	MaxIndexManifests    int        `json:"maxIndexManifests"`
+	AllowMove            bool       `json:"allowMove"`
+	AllowManifestDelete  bool       `json:"allowManifestDelete"`
+	AllowBlobDelete      bool       `json:"allowBlobDelete"`
+	AutoLatest           bool       `json:"autoLatest"`
+	KeepLastN            int        `json:"keepLastN"`
+	KeepMaxAge           Duration   `json:"keepMaxAge"`
+	WarnAnnotation       string     `json:"warnAnnotation"`
+	VerifyManifests      bool       `json:"verifyManifests"`
+
+	AllowShortDigests bool `json:"allowShortDigests"`
+
+	// Version prints the build and exits; it is a flag only.
+	Version bool `json:"-"`
+
+	GC               bool     `json:"gc"`
+	GCDeleteUntagged bool     `json:"gcDeleteUntagged"`
+	SoftDeleteWindow Duration `json:"softDeleteWindow"`
+	ScrubInterval    Duration `json:"scrubInterval"`
+	DigestCacheTTL   Duration `json:"digestCacheTTL"`
+	BlobStatCacheTTL Duration `json:"blobStatCacheTTL"`
+	IdempotencyTTL   Duration `json:"idempotencyTTL"`
+	MirrorPushTo     string   `json:"mirrorPushTo"`
+
+	Webhooks       stringList `json:"webhooks"`
+	WebhookFormat  string     `json:"webhookFormat"`
+	WebhookTimeout Duration   `json:"webhookTimeout"`
+
+	ServiceName    string   `json:"serviceName"`
+	UI             bool     `json:"ui"`
+	Metrics        bool     `json:"metrics"`
+	MetricsRefresh Duration `json:"metricsRefresh"`
+
+	RequestTimeout Duration `json:"requestTimeout"`
+	VerboseErrors  bool     `json:"verboseErrors"`
+	ShutdownGrace  Duration `json:"shutdownGrace"`
+
+	BreakerThreshold int      `json:"breakerThreshold"`
+	BreakerCooldown  Duration `json:"breakerCooldown"`
+
+	StorageReadOnlyFallback bool `json:"storageReadOnlyFallback"`
+
+	DenyUserAgents   stringList `json:"denyUserAgents"`
+	RequireUserAgent bool       `json:"requireUserAgent"`
+
+	AllowCIDRs stringList `json:"allowCIDRs"`
+	DenyCIDRs  stringList `json:"denyCIDRs"`
+
+	CORSOrigins       stringList `json:"corsOrigins"`
+	CORSExposeHeaders stringList `json:"corsExposeHeaders"`
+	CORSMaxAge        Duration   `json:"corsMaxAge"`
+
+	// blobLayout is BlobLayout, parsed once by parseConfig.
+	blobLayout *pathTemplate
+	// fileModes are DirMode and FileMode, parsed once by parseConfig.
+	fileModes fileModes
+	// trustedProxies are the TrustedProxies, parsed once by parseConfig.
+	trustedProxies []*net.IPNet
+}
+
+// Duration is a time.Duration that is written as a string such as "30s" in
+// both flags and the config file.
+type Duration time.Duration
+
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// stringList is a list setting, given as a comma separated flag or a JSON array.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		Root:              "data",
+		BlobLayout:        defaultBlobLayout,
+		blobLayout:        defaultLayout,
+		fileModes:         defaultModes,
+		DirMode:           "0755",
+		FileMode:          "0644",
+		Addr:              ":8080",
+		UploadExpiry:      Duration(24 * time.Hour),
+		RepoEviction:      "reject",
+		NameCase:          "strict",
+		MaxIndexDepth:     4,
+		MaxIndexManifests: 10000,
+		AllowedManifestTypes: stringList{
+			v1.MediaTypeImageManifest,
+			v1.MediaTypeImageIndex,
+			mediaTypeDockerManifest,
+			mediaTypeDockerManifestList,
+			mediaTypeArtifactManifest,
+		},
+		DefaultManifestType: "oci",
+		WebhookFormat:       "simple",
+		WebhookTimeout:      Duration(10 * time.Second),
+		ServiceName:         "image-registry-go",
+		MetricsRefresh:      Duration(time.Minute),
+		ShutdownGrace:       Duration(30 * time.Second),
+		BreakerCooldown:     Duration(30 * time.Second),
+		CORSExposeHeaders:   stringList{"Docker-Content-Digest", "Location", "Range", "Content-Length"},
+		CORSMaxAge:          Duration(10 * time.Minute),
+	}
+}
+
+// newFlagSet binds every setting to a flag, using the current values in cfg as
+// the defaults so that unset flags leave them untouched.
+func newFlagSet(cfg *Config) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("registry", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to a JSON config file")
+	fs.StringVar(&cfg.Root, "root", cfg.Root, "storage root directory")
+	fs.BoolVar(&cfg.Fsync, "fsync", cfg.Fsync, "flush blobs and manifests to disk before acknowledging a push, trading throughput for durability")
+	fs.Int64Var(&cfg.MaxChunkSize, "max-chunk-size", cfg.MaxChunkSize, "maximum bytes in one PATCH of a chunked upload, advertised as OCI-Chunk-Max-Length; 0 for no limit")
+	fs.Var(&cfg.UploadExpiry, "upload-expiry", "how long an idle upload session is kept across restarts; 0 keeps them forever")
+	fs.StringVar(&cfg.BlobLayout, "blob-layout", cfg.BlobLayout, "path of each blob within the _blobs directory of its repository, built from {alg}, {hex} and {h2}, the first two hex characters")
+	fs.StringVar(&cfg.DirMode, "dir-mode", cfg.DirMode, "octal permissions of the directories created in the storage root")
+	fs.StringVar(&cfg.FileMode, "file-mode", cfg.FileMode, "octal permissions of the blobs, manifests and other files created in the storage root")
+	fs.BoolVar(&cfg.NoCreateRoot, "no-create-root", cfg.NoCreateRoot, "fail at startup if the storage root does not exist instead of creating it")
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "address to listen on")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "TLS certificate file")
+	fs.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "TLS private key file")
+	fs.IntVar(&cfg.MaxConnections, "max-connections", cfg.MaxConnections, "maximum number of open client connections, 0 for no limit; further connections are refused with 503")
+	fs.Var(&cfg.IdleTimeout, "idle-timeout", "how long an idle keep-alive connection is kept open; 0 for no limit")
+	fs.BoolVar(&cfg.NoKeepAlive, "no-keep-alive", cfg.NoKeepAlive, "close every connection after one request")
+	fs.BoolVar(&cfg.TrustForwarded, "trust-forwarded", cfg.TrustForwarded, "deprecated: believe the X-Forwarded-* headers of whichever peer connects, which any client can spoof; use -trusted-proxies")
+	fs.Var(&cfg.TrustedProxies, "trusted-proxies", "comma separated IPs or CIDRs of reverse proxies whose X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host headers are used for the client address and for URLs; ignored from other peers")
+	fs.StringVar(&cfg.AuthHtpasswd, "auth-htpasswd", cfg.AuthHtpasswd, "htpasswd file of users allowed to use the registry; no authentication when empty")
+	fs.BoolVar(&cfg.AnonymousPull, "anonymous-pull", cfg.AnonymousPull, "with -auth-htpasswd, allow pulls without credentials and only authenticate pushes")
+	fs.Var(&cfg.AdminUsers, "admin-users", "comma separated users of -auth-htpasswd allowed to use the /admin endpoints, which are not served when empty")
+	fs.IntVar(&cfg.MaxRepos, "max-repos", cfg.MaxRepos, "maximum number of repositories, 0 for no limit")
+	fs.StringVar(&cfg.RepoEviction, "repo-eviction", cfg.RepoEviction, "what to do when -max-repos is reached: reject or lru")
+	fs.Int64Var(&cfg.MaxTotalStorage, "max-total-storage", cfg.MaxTotalStorage, "bytes of blobs and manifests across all repositories after which pushes are refused with 507; 0 for no limit")
+	fs.Int64Var(&cfg.MaxInFlightBytes, "max-in-flight-bytes", cfg.MaxInFlightBytes, "bytes of blob uploads and downloads in flight after which further transfers are refused with 503; 0 for no limit")
+	fs.StringVar(&cfg.NameCase, "validate-name-case", cfg.NameCase, "how to treat repository names with uppercase letters: strict rejects them, lower stores them lowercased")
+	fs.BoolVar(&cfg.StrictManifests, "strict-manifests", cfg.StrictManifests, "reject manifests that reference blobs missing from the repository")
+	fs.Var(&cfg.AllowedManifestTypes, "allowed-manifest-types", "comma separated media types manifests may be pushed as; any type is accepted when empty")
+	fs.StringVar(&cfg.DefaultManifestType, "default-manifest-media-type", cfg.DefaultManifestType, "media types to serve manifests with when they were stored without one and declare none: oci, or docker for Docker manifests and manifest lists")
+	fs.IntVar(&cfg.MaxIndexDepth, "max-index-depth", cfg.MaxIndexDepth, "maximum number of nested image indexes in a manifest, 0 for no limit")
+	fs.IntVar(&cfg.MaxIndexManifests, "max-index-manifests", cfg.MaxIndexManifests, "maximum number of manifests one image index may list, 0 for no limit")
+	fs.BoolVar(&cfg.AutoLatest, "auto-latest", cfg.AutoLatest, "tag a manifest pushed by digest as latest when the repository has no latest tag yet")
+	fs.IntVar(&cfg.KeepLastN, "keep-last-n", cfg.KeepLastN, "on every tag push, delete all but the n most recently pushed tags of the repository, except those of pinned manifests; 0 keeps every tag")
+	fs.Var(&cfg.KeepMaxAge, "keep-max-age", "on every tag push, delete the tags of the repository not pushed within this long, except those of pinned manifests or kept by -keep-last-n; 0 keeps every tag")
+	fs.BoolVar(&cfg.VerifyManifests, "verify-manifests", cfg.VerifyManifests, "read every pushed manifest back and fail the push unless it was stored byte for byte, so its digest can never change")
+	fs.StringVar(&cfg.WarnAnnotation, "warn-annotation", cfg.WarnAnnotation, "manifest annotation, such as org.example.deprecated, that adds a Warning header to pulls of manifests where it is \"true\"; none when empty")
+	fs.BoolVar(&cfg.AllowManifestDelete, "allow-manifest-delete", cfg.AllowManifestDelete, "serve DELETE for tags and manifests; refused with 405 otherwise")
+	fs.BoolVar(&cfg.AllowBlobDelete, "allow-blob-delete", cfg.AllowBlobDelete, "serve DELETE for blobs; refused with 405 otherwise, leaving their removal to garbage collection")
+	fs.BoolVar(&cfg.AllowMove, "allow-move", cfg.AllowMove, "enable the non-standard POST /v2/<name>/_move?to=<new-name> extension")
+	fs.StringVar(&cfg.MirrorPushTo, "mirror-push-to", cfg.MirrorPushTo, "base URL of a registry to replicate every push to, e.g. https://dr.example.com")
+	fs.Var(&cfg.Webhooks, "webhooks", "comma separated URLs that a JSON event is posted to whenever a manifest or blob is pushed or pulled")
+	fs.StringVar(&cfg.WebhookFormat, "webhook-format", cfg.WebhookFormat, "format of webhook events: simple, or docker for the Docker Registry notification envelope")
+	fs.Var(&cfg.WebhookTimeout, "webhook-timeout", "how long to wait for a webhook to answer before retrying the delivery")
+	fs.BoolVar(&cfg.AllowShortDigests, "allow-short-digests", cfg.AllowShortDigests, "let blobs and manifests be pulled by a unique digest prefix such as sha256:abc123")
+	fs.BoolVar(&cfg.Version, "version", cfg.Version, "print the version, commit and build date, then exit")
+	fs.BoolVar(&cfg.GC, "gc", cfg.GC, "delete blobs that no manifest refers to, then exit; run it while the registry is stopped")
+	fs.Var(&cfg.SoftDeleteWindow, "soft-delete-window", "keep deleted manifests and tags as tombstones for this long, during which POST /admin/restore brings them back and garbage collection keeps their blobs; 0 deletes them at once")
+	fs.BoolVar(&cfg.GCDeleteUntagged, "gc-delete-untagged", cfg.GCDeleteUntagged, "with -gc, also delete manifests that no tag points at, except referrers of kept manifests")
+	fs.Var(&cfg.ScrubInterval, "scrub-interval", "how often to re-hash a batch of stored blobs to detect corruption; 0 disables scrubbing")
+	fs.Var(&cfg.DigestCacheTTL, "digest-cache-ttl", "how long the scrubber trusts a blob it verified, as long as its size and modification time are unchanged; 0 hashes every blob on every pass")
+	fs.Var(&cfg.BlobStatCacheTTL, "blob-stat-cache-ttl", "how long whether a blob exists is remembered for HEAD requests; 0 checks storage every time")
+	fs.Var(&cfg.IdempotencyTTL, "idempotency-ttl", "how long a push completed with an Idempotency-Key header is remembered, so that a retry with the same key and digest gets the original 201 without writing again; 0, the default, ignores the header")
+	fs.StringVar(&cfg.ServiceName, "service-name", cfg.ServiceName, "name of the service reported by GET / when -ui is off")
+	fs.BoolVar(&cfg.UI, "ui", cfg.UI, "serve a web UI at / for browsing repositories, tags and manifests")
+	fs.BoolVar(&cfg.Metrics, "metrics", cfg.Metrics, "serve per-repository storage metrics in the Prometheus format at /metrics")
+	fs.Var(&cfg.MetricsRefresh, "metrics-refresh", "how long storage metrics are cached before the storage root is walked again")
+	fs.Var(&cfg.RequestTimeout, "request-timeout", "maximum time to serve a request, excluding blob transfers; 0 for no limit")
+	fs.BoolVar(&cfg.VerboseErrors, "verbose-errors", cfg.VerboseErrors, "include the underlying error, which may reveal storage paths, in 500 responses; otherwise only an ID that is logged with it")
+	fs.Var(&cfg.ShutdownGrace, "shutdown-grace", "how long requests in flight, including blob transfers, may run after SIGINT or SIGTERM before they are terminated")
+	fs.IntVar(&cfg.BreakerThreshold, "breaker-threshold", cfg.BreakerThreshold, "consecutive storage failures after which requests are refused with 503 for -breaker-cooldown; 0 disables the breaker")
+	fs.Var(&cfg.BreakerCooldown, "breaker-cooldown", "how long requests are refused once storage keeps failing, before one is let through to probe it")
+	fs.BoolVar(&cfg.StorageReadOnlyFallback, "storage-readonly-fallback", cfg.StorageReadOnlyFallback, "once a write fails because storage is read-only, keep serving pulls and refuse pushes with 503 until restarted, instead of failing each with a 500")
+	fs.Var(&cfg.DenyUserAgents, "deny-user-agents", "comma separated regular expressions; requests whose User-Agent matches any are refused")
+	fs.BoolVar(&cfg.RequireUserAgent, "require-user-agent", cfg.RequireUserAgent, "refuse requests without a User-Agent header")
+	fs.Var(&cfg.AllowCIDRs, "allow-cidr", "comma separated IPs or CIDRs of the only clients allowed to use the registry; any client when empty")
+	fs.Var(&cfg.DenyCIDRs, "deny-cidr", "comma separated IPs or CIDRs of clients refused with 403, even when -allow-cidr lists them")
+	fs.Var(&cfg.CORSOrigins, "cors-origin", "comma separated origins allowed to make CORS requests, or * for any; CORS is off when empty")
+	fs.Var(&cfg.CORSExposeHeaders, "cors-expose-headers", "comma separated response headers exposed to CORS clients")
+	fs.Var(&cfg.CORSMaxAge, "cors-max-age", "how long browsers may cache a CORS preflight response")
+	return fs, configFile
+}
+
+func parseConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+	fs, configFile := newFlagSet(&cfg)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if *configFile != "" {
+		cfg = defaultConfig()
+		if err := loadConfigFile(*configFile, &cfg); err != nil {
+			return cfg, err
+		}
+		// Parse again on top of the file values so flags take precedence.
+		fs, _ = newFlagSet(&cfg)
+		if err := fs.Parse(args); err != nil {
+			return cfg, err
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return cfg, err
+	}
+	cfg.blobLayout, _ = parseBlobLayout(cfg.BlobLayout)
+	cfg.fileModes = cfg.modes()
+	if len(cfg.TrustedProxies) > 0 {
+		cfg.trustedProxies, _ = parseCIDRs("trusted-proxies", cfg.TrustedProxies)
+	}
+	return cfg, nil
+}
+
+// layout returns where blobs are kept within the _blobs directory of their
+// repository, as set with -blob-layout.
+func (c Config) layout() *pathTemplate {
+	if c.blobLayout != nil {
+		return c.blobLayout
+	}
+	if l, err := parseBlobLayout(c.BlobLayout); err == nil {
+		return l
+	}
+	return defaultLayout
+}
+
+// modes returns the permissions of the directories and files created in the
+// storage root, as set with -dir-mode and -file-mode.
+func (c Config) modes() fileModes {
+	if c.fileModes != (fileModes{}) {
+		return c.fileModes
+	}
+	m := defaultModes
+	if d, err := parseMode("dir-mode", c.DirMode, 0700); err == nil {
+		m.dir = d
+	}
+	if f, err := parseMode("file-mode", c.FileMode, 0600); err == nil {
+		m.file = f
+	}
+	return m
+}
+
+// manifestTypeDefaults maps the OCI media types assumed for a manifest that
+// declares none to the ones it is served with, as chosen with
+// -default-manifest-media-type. It is empty for oci.
+func (c Config) manifestTypeDefaults() map[string]string {
+	if c.DefaultManifestType == "docker" {
+		return dockerManifestTypes
+	}
+	return nil
+}
+
+// userAgentPatterns compiles the -deny-user-agents expressions.
+func (c Config) userAgentPatterns() ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, 0, len(c.DenyUserAgents))
+	for _, expr := range c.DenyUserAgents {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny-user-agents pattern %q: %w", expr, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// parseCIDRs parses the networks of the -allow-cidr or -deny-cidr flag. A
+// bare IP stands for that single address.
+func parseCIDRs(flag string, cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", flag, cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parseMode parses the octal permissions of the -dir-mode or -file-mode
+// flag, which must at least include those in need so that the registry can
+// still use what it creates.
+func parseMode(flag string, mode string, need os.FileMode) (os.FileMode, error) {
+	v, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || v > 0777 {
+		return 0, fmt.Errorf("invalid %s %q, want octal permissions such as 0644", flag, mode)
+	}
+	if m := os.FileMode(v); m&need == need {
+		return m, nil
+	}
+	return 0, fmt.Errorf("%s %q must grant the owner at least %#o", flag, mode, need)
+}
+
+// proxyTrust returns the reverse proxies whose X-Forwarded-* headers are
+// honoured.
+func (c Config) proxyTrust() proxyTrust {
+	nets := c.trustedProxies
+	if nets == nil && len(c.TrustedProxies) > 0 {
+		nets, _ = parseCIDRs("trusted-proxies", c.TrustedProxies)
+	}
+	return proxyTrust{nets: nets, any: c.TrustForwarded}
+}
+
+// allowsManifestType reports whether manifests may be pushed as mediaType.
+func (c Config) allowsManifestType(mediaType string) bool {
+	if len(c.AllowedManifestTypes) == 0 {
+		return true
+	}
+	for _, t := range c.AllowedManifestTypes {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+func loadConfigFile(p string, cfg *Config) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", p, err)
+	}
+	return nil
+}
+
+func (c Config) validate() error {
+	if c.Root == "" {
+		return errors.New("storage root must not be empty")
+	}
+	if c.Addr == "" {
+		return errors.New("listen address must not be empty")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be set together")
+	}
+	if _, err := parseBlobLayout(c.BlobLayout); err != nil {
+		return err
+	}
+	if _, err := parseMode("dir-mode", c.DirMode, 0700); err != nil {
+		return err
+	}
+	if _, err := parseMode("file-mode", c.FileMode, 0600); err != nil {
+		return err
+	}
+	if c.MaxChunkSize < 0 {
+		return errors.New("max-chunk-size must not be negative")
+	}
+	if c.UploadExpiry < 0 {
+		return errors.New("upload-expiry must not be negative")
+	}
+	if c.MaxConnections < 0 {
+		return errors.New("max-connections must not be negative")
+	}
+	if c.IdleTimeout < 0 {
+		return errors.New("idle-timeout must not be negative")
+	}
+	if c.AnonymousPull && c.AuthHtpasswd == "" {
+		return errors.New("anonymous-pull requires auth-htpasswd")
+	}
+	if len(c.AdminUsers) > 0 && c.AuthHtpasswd == "" {
+		return errors.New("admin-users requires auth-htpasswd")
+	}
+	if c.MaxRepos < 0 {
+		return errors.New("max-repos must not be negative")
+	}
+	if c.MaxTotalStorage < 0 {
+		return errors.New("max-total-storage must not be negative")
+	}
+	if c.MaxInFlightBytes < 0 {
+		return errors.New("max-in-flight-bytes must not be negative")
+	}
+	if c.RepoEviction != "reject" && c.RepoEviction != "lru" {
+		return fmt.Errorf("unknown repo-eviction policy %q, want reject or lru", c.RepoEviction)
+	}
+	if c.NameCase != "strict" && c.NameCase != "lower" {
+		return fmt.Errorf("unknown validate-name-case mode %q, want strict or lower", c.NameCase)
+	}
+	if c.DefaultManifestType != "oci" && c.DefaultManifestType != "docker" {
+		return fmt.Errorf("unknown default-manifest-media-type %q, want oci or docker", c.DefaultManifestType)
+	}
+	if c.MaxIndexDepth < 0 {
+		return errors.New("max-index-depth must not be negative")
+	}
+	if c.KeepLastN < 0 {
+		return errors.New("keep-last-n must not be negative")
+	}
+	if c.KeepMaxAge < 0 {
+		return errors.New("keep-max-age must not be negative")
+	}
+	if c.MaxIndexManifests < 0 {
+		return errors.New("max-index-manifests must not be negative")
+	}
+	if c.MirrorPushTo != "" {
+		u, err := url.Parse(c.MirrorPushTo)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("mirror-push-to must be an http or https URL, got %q", c.MirrorPushTo)
+		}
+	}
+	for _, hook := range c.Webhooks {
+		u, err := url.Parse(hook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhooks must be http or https URLs, got %q", hook)
+		}
+	}
+	if c.WebhookFormat != "simple" && c.WebhookFormat != "docker" {
+		return fmt.Errorf("unknown webhook-format %q, want simple or docker", c.WebhookFormat)
+	}
+	if c.WebhookTimeout < 0 {
+		return errors.New("webhook-timeout must not be negative")
+	}
+	if c.SoftDeleteWindow < 0 {
+		return errors.New("soft-delete-window must not be negative")
+	}
+	if c.ScrubInterval < 0 {
+		return errors.New("scrub-interval must not be negative")
+	}
+	if c.DigestCacheTTL < 0 {
+		return errors.New("digest-cache-ttl must not be negative")
+	}
+	if c.BlobStatCacheTTL < 0 {
+		return errors.New("blob-stat-cache-ttl must not be negative")
+	}
+	if c.IdempotencyTTL < 0 {
+		return errors.New("idempotency-ttl must not be negative")
+	}
+	if c.MetricsRefresh < 0 {
+		return errors.New("metrics-refresh must not be negative")
+	}
+	if c.RequestTimeout < 0 {
+		return errors.New("request-timeout must not be negative")
+	}
+	if c.ShutdownGrace < 0 {
+		return errors.New("shutdown-grace must not be negative")
+	}
+	if c.BreakerThreshold < 0 {
+		return errors.New("breaker-threshold must not be negative")
+	}
+	if c.BreakerCooldown < 0 {
+		return errors.New("breaker-cooldown must not be negative")
+	}
+	if _, err := c.userAgentPatterns(); err != nil {
+		return err
+	}
+	if _, err := parseCIDRs("allow-cidr", c.AllowCIDRs); err != nil {
+		return err
+	}
+	if _, err := parseCIDRs("deny-cidr", c.DenyCIDRs); err != nil {
+		return err
+	}
+	if _, err := parseCIDRs("trusted-proxies", c.TrustedProxies); err != nil {
+		return err
+	}
+	if c.CORSMaxAge < 0 {
+		return errors.New("cors-max-age must not be negative")
+	}
+	return nil
+}
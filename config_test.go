@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	p := path.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestParseConfigFile(t *testing.T) {
+	p := writeTestConfig(t, `{"root": "/srv/registry", "addr": ":5000", "tlsCert": "cert.pem", "tlsKey": "key.pem", "requestTimeout": "30s"}`)
+	config, err := parseConfig([]string{"-config", p, "-addr", ":6000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Root != "/srv/registry" {
+		t.Errorf("want root from file, got %s", config.Root)
+	}
+	if config.Addr != ":6000" {
+		t.Errorf("want flag to override file addr, got %s", config.Addr)
+	}
+	if config.TLSCert != "cert.pem" || config.TLSKey != "key.pem" {
+		t.Errorf("want TLS paths from file, got %s %s", config.TLSCert, config.TLSKey)
+	}
+	if time.Duration(config.RequestTimeout) != 30*time.Second {
+		t.Errorf("want 30s request timeout, got %s", &config.RequestTimeout)
+	}
+}
+
+func TestParseConfigDefaults(t *testing.T) {
+	config, err := parseConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, defaultConfig()) {
+		t.Errorf("want defaults, got %+v", config)
+	}
+}
+
+func TestParseConfigUnknownKey(t *testing.T) {
+	p := writeTestConfig(t, `{"root": "data", "rooot": "typo"}`)
+	if _, err := parseConfig([]string{"-config", p}); err == nil {
+		t.Error("want error for unknown config key")
+	}
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	p := writeTestConfig(t, `{"tlsCert": "cert.pem"}`)
+	if _, err := parseConfig([]string{"-config", p}); err == nil {
+		t.Error("want error for tls-cert without tls-key")
+	}
+}
+
+func TestInvalidUserAgentPattern(t *testing.T) {
+	if _, err := parseConfig([]string{"-deny-user-agents", "("}); err == nil {
+		t.Error("want an error for an invalid pattern")
+	}
+}
+
+func TestInvalidCIDR(t *testing.T) {
+	for _, flag := range []string{"-allow-cidr", "-trusted-proxies"} {
+		if _, err := parseConfig([]string{flag, "10.0.0.0/8,not-a-network"}); err == nil {
+			t.Errorf("%s: want an error for an invalid CIDR", flag)
+		}
+	}
+}
+
+func TestTrustedProxiesParsedOnce(t *testing.T) {
+	cfg, err := parseConfig([]string{"-trusted-proxies", "10.0.0.0/8,192.0.2.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.trustedProxies) != 2 {
+		t.Fatalf("want both proxies parsed, got %v", cfg.trustedProxies)
+	}
+	if trust := cfg.proxyTrust(); !trust.contains(net.ParseIP("10.1.2.3")) || trust.contains(net.ParseIP("192.0.2.8")) {
+		t.Errorf("want only the configured proxies trusted, got %v", trust.nets)
+	}
+}
+
+func TestInvalidStorageModes(t *testing.T) {
+	for _, args := range [][]string{
+		{"-file-mode", "rw-r--r--"},
+		{"-file-mode", "1644"},
+		{"-file-mode", "0444"},
+		{"-dir-mode", "0644"},
+	} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v: want an error", args)
+		}
+	}
+	if _, err := parseConfig([]string{"-dir-mode", "0775", "-file-mode", "0664"}); err != nil {
+		t.Errorf("want group writable modes accepted, got %s", err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// deleteManifest deletes a tag, or a manifest by digest along with every tag
+// pointing at it, so that it no longer resolves. It returns the digest of
+// what was deleted, or "" when the reference is not known. Blobs are left to
+// garbage collection. With -soft-delete-window, what is deleted is kept
+// under a tombstone until the window has passed.
+func (reg *registry) deleteManifest(name string, ref string) (string, error) {
+	if !matches(digestRegex, ref) {
+		return reg.deleteTag(name, ref, "")
+	}
+	unlock := reg.manifests.lock(name + ":" + ref)
+	p := digestManifestPath(reg.rootDir, name, ref)
+	found, err := fileExists(p)
+	if err == nil && found && reg.config.SoftDeleteWindow > 0 {
+		err = buryManifest(reg.rootDir, name, ref, p, "", reg.config.modes())
+	}
+	if err == nil && found {
+		err = os.RemoveAll(path.Dir(p))
+	}
+	unlock()
+	if err != nil {
+		return "", err
+	}
+	tags, err := getTags(path.Join(reg.rootDir, name))
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range tags {
+		d, err := reg.deleteTag(name, tag, ref)
+		if err != nil {
+			return "", err
+		}
+		found = found || d != ""
+	}
+	if !found {
+		return "", nil
+	}
+	return ref, nil
+}
+
+// deleteTag deletes a tag, when digest is empty or the tag points at it. It
+// returns the digest of the deleted manifest, or "" when nothing was deleted.
+func (reg *registry) deleteTag(name string, tag string, digest string) (string, error) {
+	unlock := reg.manifests.lock(name + ":" + tag)
+	defer unlock()
+	p := tagManifestPath(reg.rootDir, name, tag)
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if digest == "" {
+		digest = getDigest(b)
+	} else if digestAs(digest, b) != digest {
+		return "", nil
+	}
+	if reg.config.SoftDeleteWindow > 0 {
+		if err := buryManifest(reg.rootDir, name, digest, p, tag, reg.config.modes()); err != nil {
+			return "", err
+		}
+	}
+	if err := os.RemoveAll(path.Dir(p)); err != nil {
+		return "", err
+	}
+	return digest, unindexTag(reg.rootDir, name, tag, reg.config.modes())
+}
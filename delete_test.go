@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func deleteTestRequest(reg *registry, p string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("DELETE", p, nil))
+	return w
+}
+
+func TestDeleteDisabled(t *testing.T) {
+	layer := []byte("layer")
+	for _, c := range []struct {
+		config  Config
+		allowed string
+	}{
+		{Config{}, ""},
+		{Config{AllowManifestDelete: true}, "manifests"},
+		{Config{AllowBlobDelete: true}, "blobs"},
+	} {
+		reg := &registry{rootDir: t.TempDir(), config: c.config}
+		putTestBlobRequest(reg, "test/image", layer)
+		putTestManifest(t, reg, "test/image", "v1", imageManifest(emptyJSONDigest, getDigest(layer)))
+		for kind, p := range map[string]string{
+			"manifests": "/v2/test/image/manifests/v1",
+			"blobs":     "/v2/test/image/blobs/" + getDigest(layer),
+		} {
+			w := deleteTestRequest(reg, p)
+			if kind == c.allowed {
+				if w.Code != 202 {
+					t.Errorf("%+v: want %s deleted with 202, got %d: %s", c.config, kind, w.Code, w.Body.String())
+				}
+			} else if w.Code != 405 || !strings.Contains(w.Body.String(), `"UNSUPPORTED"`) {
+				t.Errorf("%+v: want %s deletion refused with 405, got %d: %s", c.config, kind, w.Code, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestDeleteManifest(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{AllowManifestDelete: true}}
+	first := imageManifest(emptyJSONDigest)
+	second := imageManifest(emptyJSONDigest, getDigest([]byte("layer")))
+	putTestManifest(t, reg, "test/image", "v1", first)
+	putTestManifest(t, reg, "test/image", "also-v1", first)
+	putTestManifest(t, reg, "test/image", getDigest(first), first)
+	putTestManifest(t, reg, "test/image", "v2", second)
+
+	if w := deleteTestRequest(reg, "/v2/test/image/manifests/v2"); w.Code != 202 {
+		t.Fatalf("tag: want 202, got %d", w.Code)
+	}
+	if w := getTestManifest(reg, "test/image", "v2"); w.Code != 404 {
+		t.Errorf("deleted tag: want 404, got %d", w.Code)
+	}
+
+	// Deleting by digest removes every tag pointing at the manifest.
+	if w := deleteTestRequest(reg, "/v2/test/image/manifests/"+getDigest(first)); w.Code != 202 {
+		t.Fatalf("digest: want 202, got %d", w.Code)
+	}
+	for _, ref := range []string{"v1", "also-v1", getDigest(first)} {
+		if w := getTestManifest(reg, "test/image", ref); w.Code != 404 {
+			t.Errorf("%s: want 404 once deleted by digest, got %d", ref, w.Code)
+		}
+	}
+	if w := deleteTestRequest(reg, "/v2/test/image/manifests/v1"); w.Code != 404 || !strings.Contains(w.Body.String(), `"MANIFEST_UNKNOWN"`) {
+		t.Errorf("unknown tag: want 404 MANIFEST_UNKNOWN, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDeleteBlob(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{AllowBlobDelete: true}}
+	layer := []byte("layer")
+	putTestBlobRequest(reg, "test/image", layer)
+	if w := deleteTestRequest(reg, "/v2/test/image/blobs/"+getDigest(layer)); w.Code != 202 {
+		t.Fatalf("want 202, got %d", w.Code)
+	}
+	if ok, _ := blobExists(reg.rootDir, reg.config.layout(), "test/image", getDigest(layer)); ok {
+		t.Error("blob still stored after deletion")
+	}
+	if w := deleteTestRequest(reg, "/v2/test/image/blobs/"+getDigest(layer)); w.Code != 404 || !strings.Contains(w.Body.String(), `"BLOB_UNKNOWN"`) {
+		t.Errorf("deleted blob: want 404 BLOB_UNKNOWN, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// digestAlgorithm returns the algorithm part of a digest, such as "sha256".
+func digestAlgorithm(digest string) string {
+	alg, _, _ := strings.Cut(digest, ":")
+	return alg
+}
+
+// algorithmFor returns a new hash for the algorithm of digest, or nil when the
+// algorithm is not supported. Digests matching digestRegex are supported.
+func algorithmFor(digest string) hash.Hash {
+	switch digestAlgorithm(digest) {
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// sumDigest formats the sum of h as a digest with the algorithm of like.
+func sumDigest(h hash.Hash, like string) string {
+	return fmt.Sprintf("%s:%x", digestAlgorithm(like), h.Sum(nil))
+}
+
+// digestAs returns the digest of b computed with the algorithm of like, so
+// content can be compared with a digest of any supported algorithm.
+func digestAs(like string, b []byte) string {
+	h := algorithmFor(like)
+	h.Write(b)
+	return sumDigest(h, like)
+}
+
+// requestContentDigest returns the digest a client asserted for the request
+// body with the OCI-Content-Digest or Content-Digest header, converted to the
+// OCI "<alg>:<hex>" form. It returns an empty string when neither header is
+// present or no supported algorithm is listed.
+func requestContentDigest(r *http.Request) (string, error) {
+	v := r.Header.Get("OCI-Content-Digest")
+	if v == "" {
+		v = r.Header.Get("Content-Digest")
+	}
+	if v == "" || matches(digestRegex, v) {
+		return v, nil
+	}
+	// RFC 9530 dictionary, e.g. sha-256=:<base64>:
+	for _, member := range strings.Split(v, ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || alg != "sha-256" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.Trim(value, ":"))
+		if err != nil || len(b) != sha256.Size {
+			return "", fmt.Errorf("malformed Content-Digest header: %s", v)
+		}
+		return fmt.Sprintf("sha256:%x", b), nil
+	}
+	return "", nil
+}
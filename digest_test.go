@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestPutBlobContentDigestMismatch(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	content := []byte("layer")
+	digest := getDigest(content)
+	req := httptest.NewRequest("PUT", "/v2/test/image/blobs/uploads/some-id?digest="+digest, bytes.NewReader(content))
+	req.Header.Set("Content-Digest", getDigest([]byte("corrupted")))
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Fatalf("want 400, got %d", w.Code)
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte("DIGEST_INVALID")) {
+		t.Errorf("want DIGEST_INVALID, got %q", w.Body.String())
+	}
+	if _, err := os.Stat(blobPath(reg.rootDir, reg.config.layout(), "test/image", digest)); !os.IsNotExist(err) {
+		t.Errorf("rejected blob must not be stored")
+	}
+}
+
+func TestPostBlobContentDigest(t *testing.T) {
+	content := []byte("layer")
+	digest := getDigest(content)
+	sum := sha512.Sum512(content)
+	for _, c := range []struct {
+		contentDigest string
+		code          int
+	}{
+		{getDigest([]byte("corrupted")), 400},
+		{fmt.Sprintf("sha512:%x", sha512.Sum512([]byte("corrupted"))), 400},
+		{fmt.Sprintf("sha512:%x", sum), 201},
+	} {
+		reg := &registry{rootDir: t.TempDir()}
+		req := httptest.NewRequest("POST", "/v2/test/image/blobs/uploads/?digest="+digest, bytes.NewReader(content))
+		req.Header.Set("Content-Digest", c.contentDigest)
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Fatalf("%s: want %d, got %d: %s", c.contentDigest, c.code, w.Code, w.Body.String())
+		}
+		_, err := os.Stat(blobPath(reg.rootDir, reg.config.layout(), "test/image", digest))
+		if c.code == 400 && !os.IsNotExist(err) {
+			t.Errorf("%s: rejected blob must not be stored", c.contentDigest)
+		}
+	}
+}
+
+func TestPutManifestContentDigestMismatch(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	req := httptest.NewRequest("PUT", "/v2/test/image/manifests/v1", bytes.NewReader([]byte(testManifest)))
+	req.Header.Set("OCI-Content-Digest", getDigest([]byte("corrupted")))
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Fatalf("want 400, got %d", w.Code)
+	}
+	if w := getTestManifest(reg, "test/image", "v1"); w.Code != 404 {
+		t.Errorf("rejected manifest must not be stored, got %d", w.Code)
+	}
+}
+
+func TestPutManifestContentDigestRFC9530(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	sum := sha256.Sum256([]byte(testManifest))
+	req := httptest.NewRequest("PUT", "/v2/test/image/manifests/v1", bytes.NewReader([]byte(testManifest)))
+	req.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Fatalf("want 201, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPutManifestContentDigestSha512(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	sum := sha512.Sum512([]byte(testManifest))
+	req := httptest.NewRequest("PUT", "/v2/test/image/manifests/v1", bytes.NewReader([]byte(testManifest)))
+	req.Header.Set("Content-Digest", fmt.Sprintf("sha512:%x", sum))
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Fatalf("want 201, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDigestAs(t *testing.T) {
+	content := []byte("layer")
+	if got := digestAs(getDigest(content), content); got != getDigest(content) {
+		t.Errorf("want %s, got %s", getDigest(content), got)
+	}
+	sum := sha512.Sum512(content)
+	want := fmt.Sprintf("sha512:%x", sum)
+	if got := digestAs(want, content); got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+	if algorithmFor("md5:abc") != nil {
+		t.Error("want no hash for an unsupported algorithm")
+	}
+}
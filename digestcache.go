@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// digestCache remembers blobs that were verified against their digest, so an
+// unchanged blob is not hashed again. An entry is trusted only while the file
+// keeps its size and modification time, and for no longer than maxAge, after
+// which the blob is hashed again to catch corruption that left both intact.
+type digestCache struct {
+	rootDir string
+	maxAge  time.Duration
+	modes   fileModes
+
+	mu      sync.Mutex
+	entries map[string]digestCacheEntry
+}
+
+type digestCacheEntry struct {
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	Verified time.Time `json:"verified"`
+}
+
+func digestCachePath(rootDir string) string {
+	return path.Join(rootDir, "_digests.json")
+}
+
+// loadDigestCache reads the cache persisted in rootDir. A missing or
+// unreadable cache starts out empty.
+func loadDigestCache(rootDir string, maxAge time.Duration, modes fileModes) *digestCache {
+	c := &digestCache{rootDir: rootDir, maxAge: maxAge, modes: modes, entries: make(map[string]digestCacheEntry)}
+	if b, err := os.ReadFile(digestCachePath(rootDir)); err == nil {
+		if err := json.Unmarshal(b, &c.entries); err != nil {
+			c.entries = make(map[string]digestCacheEntry)
+		}
+	}
+	return c
+}
+
+func (c *digestCache) key(p string) string {
+	return strings.TrimPrefix(p, c.rootDir+"/")
+}
+
+// verified reports whether the blob at p, as described by fi, was already
+// found to match digest. A nil cache knows nothing.
+func (c *digestCache) verified(p string, digest string, fi fs.FileInfo) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[c.key(p)]
+	return ok && e.Digest == digest && e.Size == fi.Size() && e.ModTime.Equal(fi.ModTime()) &&
+		(c.maxAge <= 0 || time.Since(e.Verified) < c.maxAge)
+}
+
+// add records that the blob at p, as described by fi, matches digest.
+func (c *digestCache) add(p string, digest string, fi fs.FileInfo) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[c.key(p)] = digestCacheEntry{Digest: digest, Size: fi.Size(), ModTime: fi.ModTime(), Verified: time.Now()}
+}
+
+// save persists the cache, keeping only the entries for the given paths so
+// that blobs which are gone are forgotten.
+func (c *digestCache) save(paths []string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kept := make(map[string]digestCacheEntry, len(paths))
+	for _, p := range paths {
+		if e, ok := c.entries[c.key(p)]; ok {
+			kept[c.key(p)] = e
+		}
+	}
+	c.entries = kept
+	b, err := json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(digestCachePath(c.rootDir), b, c.modes, false)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDigestCacheSkipsUnchangedBlobs(t *testing.T) {
+	rootDir := t.TempDir()
+	digest := putTestBlob(t, rootDir, "test/image", []byte("original"))
+	p := blobPath(rootDir, defaultLayout, "test/image", digest)
+	s := &scrubber{rootDir: rootDir, layout: defaultLayout, cache: loadDigestCache(rootDir, time.Hour, defaultModes)}
+	if quarantined, err := s.scrubOnce(); err != nil || len(quarantined) != 0 {
+		t.Fatalf("want the intact blob verified, got %v (%v)", quarantined, err)
+	}
+
+	// Swap the content for some of the same size and modification time. The
+	// blob is only found out if it is hashed again.
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	s = &scrubber{rootDir: rootDir, layout: defaultLayout, cache: loadDigestCache(rootDir, time.Hour, defaultModes)}
+	if quarantined, err := s.scrubOnce(); err != nil || len(quarantined) != 0 {
+		t.Fatalf("want the cached blob not hashed again, got %v (%v)", quarantined, err)
+	}
+
+	// A new modification time invalidates the entry.
+	if err := os.Chtimes(p, time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if quarantined, err := s.scrubOnce(); err != nil || len(quarantined) != 1 {
+		t.Errorf("want the changed blob hashed and quarantined, got %v (%v)", quarantined, err)
+	}
+}
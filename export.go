@@ -0,0 +1,332 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// exportRepo writes every manifest and blob of a repository to w as a tar
+// archive in the OCI image layout, suitable for `skopeo copy oci-archive:`.
+// Tags are recorded in index.json with the ref.name annotation.
+func exportRepo(rootDir string, layout *pathTemplate, name string, w io.Writer) error {
+	index := v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: make([]v1.Descriptor, 0),
+	}
+	manifests := make(map[string][]byte)
+
+	tags, err := getTags(path.Join(rootDir, name))
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		b, err := os.ReadFile(tagManifestPath(rootDir, name, tag))
+		if err != nil {
+			return err
+		}
+		d := getDigest(b)
+		manifests[d] = b
+		index.Manifests = append(index.Manifests, v1.Descriptor{
+			MediaType:   manifestMediaType(b),
+			Digest:      digest.Digest(d),
+			Size:        int64(len(b)),
+			Annotations: map[string]string{v1.AnnotationRefName: tag},
+		})
+	}
+	untagged, err := listDigestManifests(rootDir, name)
+	if err != nil {
+		return err
+	}
+	for _, d := range untagged {
+		if _, ok := manifests[d]; ok {
+			continue
+		}
+		b, err := os.ReadFile(digestManifestPath(rootDir, name, d))
+		if err != nil {
+			return err
+		}
+		manifests[d] = b
+		index.Manifests = append(index.Manifests, v1.Descriptor{
+			MediaType: manifestMediaType(b),
+			Digest:    digest.Digest(d),
+			Size:      int64(len(b)),
+		})
+	}
+
+	tw := tar.NewWriter(w)
+	ociLayout, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, v1.ImageLayoutFile, ociLayout); err != nil {
+		return err
+	}
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "index.json", indexJSON); err != nil {
+		return err
+	}
+
+	digests := make([]string, 0, len(manifests))
+	for d := range manifests {
+		digests = append(digests, d)
+	}
+	sort.Strings(digests)
+	for _, d := range digests {
+		if err := writeTarFile(tw, layoutBlobPath(d), manifests[d]); err != nil {
+			return err
+		}
+	}
+	blobs, err := listBlobs(rootDir, layout, name)
+	if err != nil {
+		return err
+	}
+	hasEmptyJSON := false
+	for _, d := range blobs {
+		hasEmptyJSON = hasEmptyJSON || d == emptyJSONDigest
+		if err := writeTarBlob(tw, layoutBlobPath(d), blobPath(rootDir, layout, name, d)); err != nil {
+			return err
+		}
+	}
+	if !hasEmptyJSON && referencesEmptyJSON(manifests) {
+		if err := writeTarFile(tw, layoutBlobPath(emptyJSONDigest), emptyJSON); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// layoutBlobPath returns the path of a blob inside an OCI image layout.
+func layoutBlobPath(d string) string {
+	alg, hex, _ := strings.Cut(d, ":")
+	return path.Join("blobs", alg, hex)
+}
+
+// referencesEmptyJSON reports whether the config or a layer of any of the
+// manifests is the empty JSON blob.
+func referencesEmptyJSON(manifests map[string][]byte) bool {
+	for _, b := range manifests {
+		var m v1.Manifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			continue
+		}
+		if m.Config.Digest == emptyJSONDigest {
+			return true
+		}
+		for _, l := range m.Layers {
+			if l.Digest == emptyJSONDigest {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeTarFile(tw *tar.Writer, name string, content []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
+
+func writeTarBlob(tw *tar.Writer, name string, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// importRepo reads an OCI image layout tar archive, as produced by
+// exportRepo, into a repository. Every blob is verified against its digest
+// before anything is stored. Manifests listed in index.json are tagged from
+// their ref.name annotation, or stored by digest when they have none.
+// Indexes may nest at most maxDepth levels deep and list at most
+// maxManifests manifests each, without limit when 0. Problems with the
+// archive itself are returned as an *ociError.
+func importRepo(rootDir string, layout *pathTemplate, name string, r io.Reader, maxDepth int, maxManifests int, modes fileModes) error {
+	staging, err := os.MkdirTemp(rootDir, "_import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	var ociLayout, indexJSON []byte
+	staged := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &ociError{"BLOB_UPLOAD_INVALID", "malformed archive", err.Error()}
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		entry := path.Clean(hdr.Name)
+		switch {
+		case entry == v1.ImageLayoutFile:
+			ociLayout, err = io.ReadAll(io.LimitReader(tr, 1<<20))
+		case entry == "index.json":
+			indexJSON, err = io.ReadAll(io.LimitReader(tr, 1<<24))
+		case strings.HasPrefix(entry, "blobs/"):
+			d := strings.Replace(strings.TrimPrefix(entry, "blobs/"), "/", ":", 1)
+			if !matches(digestRegex, d) {
+				return &ociError{"BLOB_UPLOAD_INVALID", "malformed archive", "unexpected entry " + hdr.Name}
+			}
+			staged[d] = path.Join(staging, strings.Replace(d, ":", "-", 1))
+			err = stageBlob(tr, staged[d], d)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var l v1.ImageLayout
+	if err := json.Unmarshal(ociLayout, &l); err != nil || l.Version != v1.ImageLayoutVersion {
+		return &ociError{"BLOB_UPLOAD_INVALID", "malformed archive", "missing or unsupported oci-layout"}
+	}
+	var index v1.Index
+	if err := json.Unmarshal(indexJSON, &index); err != nil {
+		return &ociError{"MANIFEST_INVALID", "manifest invalid", "missing or invalid index.json"}
+	}
+	if maxManifests > 0 && len(index.Manifests) > maxManifests {
+		return &ociError{"MANIFEST_INVALID", "manifest invalid", fmt.Sprintf("index.json lists %d manifests, more than %d", len(index.Manifests), maxManifests)}
+	}
+
+	// Work out which blobs are manifests, following image indexes down to the
+	// manifests they list, before storing anything.
+	manifests := make(map[string][]byte)
+	pending := index.Manifests
+	for len(pending) > 0 {
+		desc := pending[0]
+		pending = pending[1:]
+		d := string(desc.Digest)
+		if _, ok := manifests[d]; ok {
+			continue
+		}
+		p, ok := staged[d]
+		if !ok {
+			return &ociError{"MANIFEST_BLOB_UNKNOWN", "blob unknown to registry", map[string]string{"digest": d}}
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		manifests[d] = b
+		if maxManifests > 0 {
+			if err := checkIndexSize(b, maxManifests); err != nil {
+				return err
+			}
+		}
+		if isImageIndex(b) {
+			var child v1.Index
+			if err := json.Unmarshal(b, &child); err != nil {
+				return &ociError{"MANIFEST_INVALID", "manifest invalid", err.Error()}
+			}
+			pending = append(pending, child.Manifests...)
+		}
+	}
+	if maxDepth > 0 {
+		load := func(d string) ([]byte, error) { return manifests[d], nil }
+		for _, desc := range index.Manifests {
+			if err := checkIndexDepth(manifests[string(desc.Digest)], maxDepth, load); err != nil {
+				return err
+			}
+		}
+	}
+
+	defer storageGeneration.Add(1)
+	for d, p := range staged {
+		if _, ok := manifests[d]; ok {
+			continue
+		}
+		dest := blobPath(rootDir, layout, name, d)
+		if err := makeDirs(path.Dir(dest), modes); err != nil {
+			return err
+		}
+		if err := os.Chmod(p, modes.file); err != nil {
+			return err
+		}
+		if err := os.Rename(p, dest); err != nil {
+			return err
+		}
+	}
+	for d, b := range manifests {
+		if err := writeManifestFile(digestManifestPath(rootDir, name, d), b, modes); err != nil {
+			return err
+		}
+	}
+	for _, desc := range index.Manifests {
+		tag := desc.Annotations[v1.AnnotationRefName]
+		if !matches(refRegex, tag) {
+			continue
+		}
+		if err := writeManifestFile(tagManifestPath(rootDir, name, tag), manifests[string(desc.Digest)], modes); err != nil {
+			return err
+		}
+	}
+	return rebuildIndex(rootDir, name, modes)
+}
+
+// stageBlob copies a blob out of an archive, verifying it against digest.
+func stageBlob(r io.Reader, dest string, digest string) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := algorithmFor(digest)
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return &ociError{"BLOB_UPLOAD_INVALID", "malformed archive", err.Error()}
+	}
+	if sumDigest(h, digest) != digest {
+		return &ociError{"DIGEST_INVALID", "provided digest did not match uploaded content", map[string]string{"digest": digest}}
+	}
+	return nil
+}
+
+func writeManifestFile(dest string, b []byte, modes fileModes) error {
+	if err := makeDirs(path.Dir(dest), modes); err != nil {
+		return err
+	}
+	return writeFileAtomic(dest, b, modes, false)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// pushTestImage stores a config, one layer and a manifest tagged tag, and
+// returns the manifest.
+func pushTestImage(t *testing.T, reg *registry, name string, tag string, layer []byte) []byte {
+	t.Helper()
+	config := putTestBlob(t, reg.rootDir, name, []byte(`{"architecture":"amd64","os":"linux"}`))
+	l := putTestBlob(t, reg.rootDir, name, layer)
+	m := imageManifest(config, l)
+	putTestManifest(t, reg, name, tag, m)
+	return m
+}
+
+func readTar(t *testing.T, r io.Reader) map[string][]byte {
+	t.Helper()
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = b
+	}
+	return files
+}
+
+func TestExportRepo(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	layer := []byte("layer")
+	m := pushTestImage(t, reg, "test/image", "v1", layer)
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/_export", nil))
+	if w.Code != 200 {
+		t.Fatalf("want 200, got %d", w.Code)
+	}
+	files := readTar(t, w.Body)
+
+	if _, ok := files["oci-layout"]; !ok {
+		t.Error("missing oci-layout")
+	}
+	var index v1.Index
+	if err := json.Unmarshal(files["index.json"], &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 {
+		t.Fatalf("want 1 manifest in index, got %d", len(index.Manifests))
+	}
+	desc := index.Manifests[0]
+	if string(desc.Digest) != getDigest(m) || desc.Annotations[v1.AnnotationRefName] != "v1" {
+		t.Errorf("unexpected index entry %+v", desc)
+	}
+	if !bytes.Equal(files[layoutBlobPath(getDigest(m))], m) {
+		t.Error("manifest blob missing from export")
+	}
+	if !bytes.Equal(files[layoutBlobPath(getDigest(layer))], layer) {
+		t.Error("layer blob missing from export")
+	}
+}
+
+func TestExportUnknownRepo(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/missing/_export", nil))
+	if w.Code != 404 {
+		t.Errorf("want 404, got %d", w.Code)
+	}
+}
+
+func TestReferencesEmptyJSON(t *testing.T) {
+	config := v1.Descriptor{MediaType: "application/vnd.oci.empty.v1+json", Digest: emptyJSONDigest, Size: 2}
+	annotated := v1.Manifest{
+		Config:      v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: digest.Digest(getDigest([]byte("config")))},
+		Annotations: map[string]string{"note": emptyJSONDigest},
+	}
+	for want, m := range map[bool]v1.Manifest{true: {Config: config}, false: annotated} {
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := referencesEmptyJSON(map[string][]byte{getDigest(b): b}); got != want {
+			t.Errorf("want %v for %s, got %v", want, b, got)
+		}
+	}
+}
+
+func TestImportRepo(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	layer := []byte("layer")
+	m := pushTestImage(t, reg, "test/image", "v1", layer)
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/_export", nil))
+	archive := w.Body.Bytes()
+
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("POST", "/v2/test/copy/_import", bytes.NewReader(archive)))
+	if w.Code != 201 {
+		t.Fatalf("want 201, got %d: %s", w.Code, w.Body.String())
+	}
+	w = getTestManifest(reg, "test/copy", "v1")
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), m) {
+		t.Fatalf("imported manifest not pullable: %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/copy/blobs/"+getDigest(layer), nil))
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), layer) {
+		t.Errorf("imported layer not pullable: %d", w.Code)
+	}
+}
+
+func TestImportRepoMalformed(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := writeTarFile(tw, layoutBlobPath(getDigest([]byte("original"))), []byte("tampered")); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+
+	for _, body := range [][]byte{[]byte("not a tar archive"), buf.Bytes()} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("POST", "/v2/test/copy/_import", bytes.NewReader(body)))
+		if w.Code != 400 {
+			t.Errorf("want 400, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestImportRepoIndexTooDeep(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	image := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", getDigest(image), image)
+	inner := indexManifest(getDigest(image))
+	putTestManifest(t, reg, "test/image", getDigest(inner), inner)
+	outer := indexManifest(getDigest(inner))
+	putTestManifest(t, reg, "test/image", "v1", outer)
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/_export", nil))
+	archive := w.Body.Bytes()
+
+	reg.config.MaxIndexDepth = 1
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("POST", "/v2/test/copy/_import", bytes.NewReader(archive)))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "MANIFEST_INVALID") {
+		t.Errorf("want 400 MANIFEST_INVALID, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestImportRepoIndexTooLarge(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	image := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", getDigest(image), image)
+	outer := indexManifest(getDigest(image), getDigest(image), getDigest(image))
+	putTestManifest(t, reg, "test/image", "v1", outer)
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/_export", nil))
+	archive := w.Body.Bytes()
+
+	// index.json lists two manifests, which is fine, but v1 lists three.
+	reg.config.MaxIndexManifests = 2
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("POST", "/v2/test/copy/_import", bytes.NewReader(archive)))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "MANIFEST_INVALID") {
+		t.Errorf("want 400 MANIFEST_INVALID, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// manifestRefs holds what a manifest refers to, whatever its kind. Subject is
+// read separately because the vendored image-spec predates it.
+type manifestRefs struct {
+	Config *v1.Descriptor  `json:"config"`
+	Layers []v1.Descriptor `json:"layers"`
+	// Blobs are those of an artifact manifest.
+	Blobs     []v1.Descriptor `json:"blobs"`
+	Manifests []v1.Descriptor `json:"manifests"`
+	Subject   *v1.Descriptor  `json:"subject"`
+}
+
+// markBlobs marks the blobs the manifest refers to as used.
+func (r manifestRefs) markBlobs(used map[string]bool) {
+	if r.Config != nil {
+		used[string(r.Config.Digest)] = true
+	}
+	for _, l := range r.Layers {
+		used[string(l.Digest)] = true
+	}
+	for _, b := range r.Blobs {
+		used[string(b.Digest)] = true
+	}
+}
+
+// gcGracePeriod is how old content must be before garbage collection over
+// HTTP removes it, so that blobs pushed ahead of their manifest survive a
+// collection that runs in the middle of the push.
+const gcGracePeriod = time.Hour
+
+// gcOptions controls a garbage collection.
+type gcOptions struct {
+	// deleteUntagged also deletes manifests that no tag points at.
+	deleteUntagged bool
+	// dryRun reports what would be deleted without deleting it.
+	dryRun bool
+	// minAge keeps anything modified more recently.
+	minAge time.Duration
+	// softDeleteWindow keeps tombstones of deleted manifests, and what they
+	// refer to, for this long after the deletion; older ones are purged.
+	softDeleteWindow time.Duration
+}
+
+// gcResult is what a garbage collection removed, with manifests and blobs
+// given as <name>@<digest>.
+type gcResult struct {
+	DryRun         bool     `json:"dryRun"`
+	Manifests      []string `json:"manifests"`
+	Blobs          []string `json:"blobs"`
+	ReclaimedBytes int64    `json:"reclaimedBytes"`
+}
+
+// gcMu keeps garbage collections from running concurrently.
+var gcMu sync.Mutex
+
+// collectGarbage deletes the blobs that no kept manifest refers to, in every
+// repository. Tagged manifests are kept, along with the manifests listed by a
+// kept index and those whose subject is kept, such as signatures and other
+// attestations. Manifests pushed only by digest are kept as well unless
+// opts.deleteUntagged is set, and pinned manifests are always kept. So are
+// manifests deleted within opts.softDeleteWindow, which may yet be
+// restored, while tombstones past it are purged.
+//
+// Without a minimum age it must not run while the registry is serving
+// pushes, since a blob uploaded ahead of its manifest would be collected.
+func collectGarbage(rootDir string, layout *pathTemplate, opts gcOptions) (gcResult, error) {
+	gcMu.Lock()
+	defer gcMu.Unlock()
+	total := gcResult{DryRun: opts.dryRun, Manifests: make([]string, 0), Blobs: make([]string, 0)}
+	if !opts.dryRun {
+		defer storageGeneration.Add(1)
+	}
+	repos, err := listRepos(rootDir)
+	if err != nil {
+		return total, err
+	}
+	for _, name := range repos {
+		res, err := collectRepoGarbage(rootDir, layout, name, opts)
+		if err != nil {
+			return total, err
+		}
+		if (len(res.Manifests) > 0 || len(res.Blobs) > 0) && !opts.dryRun {
+			log.Printf("Garbage collected %d manifests and %d blobs from %s", len(res.Manifests), len(res.Blobs), name)
+		}
+		total.Manifests = append(total.Manifests, res.Manifests...)
+		total.Blobs = append(total.Blobs, res.Blobs...)
+		total.ReclaimedBytes += res.ReclaimedBytes
+	}
+	return total, nil
+}
+
+func collectRepoGarbage(rootDir string, layout *pathTemplate, name string, opts gcOptions) (gcResult, error) {
+	var res gcResult
+	// remove deletes a file unless it is too recent, adding its size to
+	// the bytes reclaimed. It reports whether the file is, or would be, gone.
+	remove := func(p string, dir bool) (bool, error) {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return false, err
+		}
+		if time.Since(fi.ModTime()) < opts.minAge {
+			return false, nil
+		}
+		res.ReclaimedBytes += fi.Size()
+		if opts.dryRun {
+			return true, nil
+		}
+		if dir {
+			return true, os.RemoveAll(path.Dir(p))
+		}
+		return true, os.Remove(p)
+	}
+	refs := make(map[string]manifestRefs)
+	kept := make(map[string]bool)
+
+	tags, err := getTags(path.Join(rootDir, name))
+	if err != nil {
+		return res, err
+	}
+	for _, tag := range tags {
+		b, err := os.ReadFile(tagManifestPath(rootDir, name, tag))
+		if err != nil {
+			return res, err
+		}
+		d := getDigest(b)
+		refs[d] = parseManifestRefs(b)
+		kept[d] = true
+	}
+	untagged, err := listDigestManifests(rootDir, name)
+	if err != nil {
+		return res, err
+	}
+	for _, d := range untagged {
+		if _, ok := refs[d]; ok {
+			continue
+		}
+		p := digestManifestPath(rootDir, name, d)
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return res, err
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return res, err
+		}
+		refs[d] = parseManifestRefs(b)
+		kept[d] = !opts.deleteUntagged || time.Since(fi.ModTime()) < opts.minAge
+	}
+
+	pins, err := loadPins(rootDir, name)
+	if err != nil {
+		return res, err
+	}
+	for d := range pins {
+		if _, ok := refs[d]; ok {
+			kept[d] = true
+		}
+	}
+
+	tombstones, err := listTombstones(rootDir, name)
+	if err != nil {
+		return res, err
+	}
+	buried := make([]manifestRefs, 0, len(tombstones))
+	for _, t := range tombstones {
+		dir := tombstoneDir(rootDir, name, t.Digest)
+		if t.expired(opts.softDeleteWindow) {
+			removed, err := remove(path.Join(dir, "manifest.json"), true)
+			if err != nil {
+				return res, err
+			}
+			if removed {
+				res.Manifests = append(res.Manifests, name+"@"+t.Digest)
+				continue
+			}
+			// Too recent to purge yet: it still holds on to what it refers
+			// to, as an unexpired one does.
+		}
+		b, err := os.ReadFile(path.Join(dir, "manifest.json"))
+		if err != nil {
+			return res, err
+		}
+		r := parseManifestRefs(b)
+		buried = append(buried, r)
+		// Its referrers and children are kept as they would be if it had
+		// not been deleted.
+		kept[t.Digest] = true
+		for _, child := range r.Manifests {
+			if _, ok := refs[string(child.Digest)]; ok {
+				kept[string(child.Digest)] = true
+			}
+		}
+	}
+
+	// Keep the children of kept indexes and the referrers of kept manifests
+	// until nothing more changes.
+	for changed := true; changed; {
+		changed = false
+		for d, r := range refs {
+			if kept[d] {
+				for _, child := range r.Manifests {
+					if _, ok := refs[string(child.Digest)]; ok && !kept[string(child.Digest)] {
+						kept[string(child.Digest)] = true
+						changed = true
+					}
+				}
+			} else if r.Subject != nil && kept[string(r.Subject.Digest)] {
+				kept[d] = true
+				changed = true
+			}
+		}
+	}
+
+	used := make(map[string]bool)
+	for d, r := range refs {
+		if !kept[d] {
+			if _, err := remove(digestManifestPath(rootDir, name, d), true); err != nil {
+				return res, err
+			}
+			res.Manifests = append(res.Manifests, name+"@"+d)
+			continue
+		}
+		r.markBlobs(used)
+	}
+	for _, r := range buried {
+		r.markBlobs(used)
+	}
+
+	blobs, err := listBlobs(rootDir, layout, name)
+	if err != nil {
+		return res, err
+	}
+	for _, d := range blobs {
+		if used[d] {
+			continue
+		}
+		removed, err := remove(blobPath(rootDir, layout, name, d), false)
+		if err != nil {
+			return res, err
+		}
+		if removed {
+			res.Blobs = append(res.Blobs, name+"@"+d)
+		}
+	}
+	return res, nil
+}
+
+// parseManifestRefs reads the references of a manifest. Content that is not
+// a manifest refers to nothing.
+func parseManifestRefs(b []byte) manifestRefs {
+	var r manifestRefs
+	_ = json.Unmarshal(b, &r)
+	return r
+}
+
+// gcHandler runs a garbage collection for POST /admin/gc and answers with
+// what was removed. ?dry-run=true only reports what would be removed and
+// ?delete-untagged=true also removes untagged manifests. Content younger
+// than gcGracePeriod is kept since pushes may be under way.
+type gcHandler struct {
+	reg *registry
+}
+
+func (h *gcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeOciError("UNSUPPORTED", "garbage collection is started with POST", w, 405)
+		return
+	}
+	q := r.URL.Query()
+	opts := gcOptions{
+		deleteUntagged:   q.Get("delete-untagged") == "true",
+		dryRun:           q.Get("dry-run") == "true",
+		minAge:           gcGracePeriod,
+		softDeleteWindow: time.Duration(h.reg.config.SoftDeleteWindow),
+	}
+	res, err := collectGarbage(h.reg.rootDir, h.reg.config.layout(), opts)
+	if !opts.dryRun {
+		// The storage usage is walked again after a collection.
+		h.reg.usage.invalidate()
+	}
+	if err != nil {
+		h.reg.writeServerError(err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
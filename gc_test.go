@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestCollectGarbageDeleteUntagged(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	name := "test/image"
+	taggedLayer := putTestBlob(t, reg.rootDir, name, []byte("tagged layer"))
+	untaggedLayer := putTestBlob(t, reg.rootDir, name, []byte("untagged layer"))
+	sigLayer := putTestBlob(t, reg.rootDir, name, []byte("signature"))
+	orphan := putTestBlob(t, reg.rootDir, name, []byte("orphan"))
+	putTestBlob(t, reg.rootDir, name, emptyJSON)
+
+	tagged := imageManifest(emptyJSONDigest, taggedLayer)
+	putTestManifest(t, reg, name, "v1", tagged)
+	untagged := imageManifest(emptyJSONDigest, untaggedLayer)
+	putTestManifest(t, reg, name, getDigest(untagged), untagged)
+
+	// A signature refers to the tagged manifest as its subject and is itself
+	// only pushed by digest.
+	var sig map[string]interface{}
+	_ = json.Unmarshal(imageManifest(emptyJSONDigest, sigLayer), &sig)
+	sig["subject"] = v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: digest.Digest(getDigest(tagged)), Size: int64(len(tagged))}
+	signature, _ := json.Marshal(sig)
+	putTestManifest(t, reg, name, getDigest(signature), signature)
+
+	res, err := collectGarbage(reg.rootDir, reg.config.layout(), gcOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Manifests) != 0 || len(res.Blobs) != 1 {
+		t.Errorf("want only the orphaned blob collected, got %+v", res)
+	}
+	if found, _ := blobExists(reg.rootDir, reg.config.layout(), name, orphan); found {
+		t.Error("orphaned blob was kept")
+	}
+	if w := getTestManifest(reg, name, getDigest(untagged)); w.Code != 200 {
+		t.Errorf("untagged manifest was deleted without -gc-delete-untagged: %d", w.Code)
+	}
+
+	res, err = collectGarbage(reg.rootDir, reg.config.layout(), gcOptions{deleteUntagged: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Manifests) != 1 || len(res.Blobs) != 1 {
+		t.Errorf("want the untagged manifest and its layer collected, got %+v", res)
+	}
+	if w := getTestManifest(reg, name, getDigest(untagged)); w.Code != 404 {
+		t.Errorf("want the untagged manifest gone, got %d", w.Code)
+	}
+	if found, _ := blobExists(reg.rootDir, reg.config.layout(), name, untaggedLayer); found {
+		t.Error("layer of the untagged manifest was kept")
+	}
+	for _, ref := range []string{"v1", getDigest(signature)} {
+		if w := getTestManifest(reg, name, ref); w.Code != 200 {
+			t.Errorf("want %s kept, got %d", ref, w.Code)
+		}
+	}
+	for _, d := range []string{taggedLayer, sigLayer, emptyJSONDigest} {
+		if found, _ := blobExists(reg.rootDir, reg.config.layout(), name, d); !found {
+			t.Errorf("blob %s was collected", d)
+		}
+	}
+}
+
+func TestAdminGC(t *testing.T) {
+	rootDir := t.TempDir()
+	orphanContent := []byte("orphan")
+	orphan := putTestBlob(t, rootDir, "test/image", orphanContent)
+	old := time.Now().Add(-2 * gcGracePeriod)
+	if err := os.Chtimes(blobPath(rootDir, defaultLayout, "test/image", orphan), old, old); err != nil {
+		t.Fatal(err)
+	}
+	// Too recent to collect: it may belong to a push under way.
+	putTestBlob(t, rootDir, "test/image", []byte("pushing"))
+
+	users := testUsers(t)
+	users["bob"] = htpasswdSHA("hunter2")
+	h := requireAdmin(&gcHandler{reg: &registry{rootDir: rootDir}}, users, []string{"alice"})
+	gc := func(query string, user string, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/gc"+query, nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	if w := gc("", "", ""); w.Code != 401 {
+		t.Errorf("anonymous: want 401, got %d", w.Code)
+	}
+	if w := gc("", "bob", "hunter2"); w.Code != 403 {
+		t.Errorf("non-admin: want 403, got %d", w.Code)
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		w := gc(fmt.Sprintf("?dry-run=%v", dryRun), "alice", "secret")
+		if w.Code != 200 {
+			t.Fatalf("dry-run=%v: want 200, got %d", dryRun, w.Code)
+		}
+		var res gcResult
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res.DryRun != dryRun || len(res.Blobs) != 1 || res.Blobs[0] != "test/image@"+orphan || res.ReclaimedBytes != int64(len(orphanContent)) {
+			t.Errorf("dry-run=%v: want the orphan reported, got %+v", dryRun, res)
+		}
+		if found, _ := blobExists(rootDir, defaultLayout, "test/image", orphan); found == !dryRun {
+			t.Errorf("dry-run=%v: orphan present is %v", dryRun, found)
+		}
+	}
+}
+
+func TestCollectGarbageKeepsArtifactBlobs(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	name := "test/artifact"
+	blob := putTestBlob(t, reg.rootDir, name, []byte("sbom"))
+	artifact, _ := json.Marshal(map[string]interface{}{
+		"mediaType":    mediaTypeArtifactManifest,
+		"artifactType": "application/spdx+json",
+		"blobs":        []v1.Descriptor{{MediaType: "application/spdx+json", Digest: digest.Digest(blob), Size: 4}},
+	})
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/v2/"+name+"/manifests/sbom", bytes.NewReader(artifact))
+	req.Header.Set("Content-Type", mediaTypeArtifactManifest)
+	reg.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Fatalf("push failed with %d: %s", w.Code, w.Body.String())
+	}
+
+	res, err := collectGarbage(reg.rootDir, reg.config.layout(), gcOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Blobs) != 0 {
+		t.Errorf("want no blobs collected, got %v", res.Blobs)
+	}
+	if found, _ := blobExists(reg.rootDir, reg.config.layout(), name, blob); !found {
+		t.Error("blob of the artifact manifest was collected")
+	}
+}
@@ -4,7 +4,6 @@ go 1.19
 
 require (
 	github.com/distribution/distribution v2.8.1+incompatible
+	github.com/opencontainers/go-digest v1.0.0
 	github.com/opencontainers/image-spec v1.0.2
 )
-
-require github.com/opencontainers/go-digest v1.0.0 // indirect
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyKeysSize bounds the number of pushes remembered by key.
+const idempotencyKeysSize = 10000
+
+// replayedHeaders are the headers of a 201 push response that are sent
+// again when the push is replayed.
+var replayedHeaders = []string{"Location", "Docker-Content-Digest", "OCI-Subject"}
+
+// committedPush is the result of a push completed with an Idempotency-Key.
+type committedPush struct {
+	digest  string
+	header  http.Header
+	expires time.Time
+}
+
+// idempotencyKeys remembers for -idempotency-ttl the pushes completed with
+// an Idempotency-Key header, so that a client retrying one whose response
+// was lost gets the original 201 back without anything being written again.
+// A key is only replayed for the same URL and digest, and while what it
+// pushed is still stored; a key reused for other content, or for content
+// deleted since, is pushed as usual.
+type idempotencyKeys struct {
+	ttl time.Duration
+	max int
+
+	mu     sync.Mutex
+	pushes map[string]committedPush
+}
+
+func newIdempotencyKeys(ttl time.Duration) *idempotencyKeys {
+	return &idempotencyKeys{ttl: ttl, max: idempotencyKeysSize, pushes: make(map[string]committedPush)}
+}
+
+// replay answers r with the original result when its Idempotency-Key was
+// already used to push digest to the same URL and stored reports that the
+// content is still there, reporting whether it did. It never replays on a
+// nil set of keys.
+func (k *idempotencyKeys) replay(w http.ResponseWriter, r *http.Request, digest string, stored func() bool) bool {
+	key := r.Header.Get("Idempotency-Key")
+	if k == nil || key == "" {
+		return false
+	}
+	k.mu.Lock()
+	p, ok := k.pushes[r.URL.Path+" "+key]
+	k.mu.Unlock()
+	if !ok || p.digest != digest || time.Now().After(p.expires) || !stored() {
+		return false
+	}
+	for h, v := range p.header {
+		w.Header()[h] = v
+	}
+	w.WriteHeader(201)
+	return true
+}
+
+// commit remembers the result about to be written to w for the
+// Idempotency-Key of r, if any. It is a no-op on a nil set of keys.
+func (k *idempotencyKeys) commit(w http.ResponseWriter, r *http.Request, digest string) {
+	key := r.Header.Get("Idempotency-Key")
+	if k == nil || key == "" {
+		return
+	}
+	header := make(http.Header)
+	for _, h := range replayedHeaders {
+		if v := w.Header().Values(h); len(v) > 0 {
+			header[h] = v
+		}
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.pushes) >= k.max {
+		k.evict()
+	}
+	k.pushes[r.URL.Path+" "+key] = committedPush{digest: digest, header: header, expires: time.Now().Add(k.ttl)}
+}
+
+// evict makes room for a push by dropping the expired ones, or else an
+// arbitrary one. The caller holds mu.
+func (k *idempotencyKeys) evict() {
+	now := time.Now()
+	for key, p := range k.pushes {
+		if now.After(p.expires) {
+			delete(k.pushes, key)
+		}
+	}
+	for key := range k.pushes {
+		if len(k.pushes) < k.max {
+			break
+		}
+		delete(k.pushes, key)
+	}
+}
+
+// blobStored returns a check, for replay, that the blob digest is still
+// stored in the repository name.
+func (reg *registry) blobStored(name string, digest string) func() bool {
+	return func() bool {
+		found, err := blobExists(reg.rootDir, reg.config.layout(), name, digest)
+		return err == nil && found
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeyReplaysBlobPush(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), idempotency: newIdempotencyKeys(time.Minute)}
+	content := []byte("layer")
+	location := startTestUpload(t, reg, "test/image")
+	complete := func(content []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", location+"?digest="+getDigest(content), bytes.NewReader(content))
+		req.Header.Set("Idempotency-Key", "push-1")
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, req)
+		return w
+	}
+	first := complete(content)
+	if first.Code != 201 {
+		t.Fatalf("want 201, got %d: %s", first.Code, first.Body.String())
+	}
+	replayed := complete(content)
+	if replayed.Code != 201 {
+		t.Fatalf("replay: want 201, got %d: %s", replayed.Code, replayed.Body.String())
+	}
+	for _, h := range []string{"Location", "Docker-Content-Digest"} {
+		if replayed.Header().Get(h) != first.Header().Get(h) {
+			t.Errorf("replay: want %s %q, got %q", h, first.Header().Get(h), replayed.Header().Get(h))
+		}
+	}
+	blobs, err := listBlobs(reg.rootDir, reg.config.layout(), "test/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 1 || blobs[0] != getDigest(content) {
+		t.Errorf("want the one blob stored, got %v", blobs)
+	}
+
+	// The same key with other content is a push of its own.
+	other := []byte("other layer")
+	if w := complete(other); w.Code != 201 {
+		t.Fatalf("want 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if ok, _ := blobExists(reg.rootDir, reg.config.layout(), "test/image", getDigest(other)); !ok {
+		t.Error("want the other content stored")
+	}
+
+	// A blob deleted since is pushed again rather than replayed.
+	if err := os.Remove(blobPath(reg.rootDir, reg.config.layout(), "test/image", getDigest(other))); err != nil {
+		t.Fatal(err)
+	}
+	if w := complete(other); w.Code != 201 {
+		t.Fatalf("want 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if ok, _ := blobExists(reg.rootDir, reg.config.layout(), "test/image", getDigest(other)); !ok {
+		t.Error("want the deleted content stored again")
+	}
+}
+
+func TestIdempotencyKeyReplaysManifestPush(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), idempotency: newIdempotencyKeys(time.Minute)}
+	body := []byte(testManifest)
+	push := func(key string) {
+		t.Helper()
+		req := httptest.NewRequest("PUT", "/v2/test/image/manifests/v1", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		req.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, req)
+		if w.Code != 201 {
+			t.Fatalf("want 201, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	p := tagManifestPath(reg.rootDir, "test/image", "v1")
+	pushedAt := func() time.Time {
+		t.Helper()
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.ModTime()
+	}
+	push("push-1")
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(p, old, old); err != nil {
+		t.Fatal(err)
+	}
+	push("push-1")
+	if !pushedAt().Equal(old) {
+		t.Error("want the replayed push not to write the manifest again")
+	}
+	push("push-2")
+	if pushedAt().Equal(old) {
+		t.Error("want a push with a new key to write the manifest")
+	}
+
+	// A tag deleted since is written again rather than replayed.
+	if err := os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+	push("push-2")
+	pushedAt()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// manifestIndex maps manifest digests to the tags whose manifest has that
+// digest. It is persisted per repository so digest lookups do not have to
+// read and hash the manifest of every tag.
+type manifestIndex map[string][]string
+
+// indexMu serialises read-modify-write updates of index files.
+var indexMu sync.Mutex
+
+func indexPath(rootDir string, name string) string {
+	return path.Join(rootDir, name, "_index.json")
+}
+
+// loadIndex reads the index of a repository. A missing index is empty.
+func loadIndex(rootDir string, name string) (manifestIndex, error) {
+	idx := make(manifestIndex)
+	b, err := os.ReadFile(indexPath(rootDir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return idx, err
+	}
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return make(manifestIndex), nil
+	}
+	return idx, nil
+}
+
+func saveIndex(rootDir string, name string, idx manifestIndex, modes fileModes) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(indexPath(rootDir, name), b, modes, false)
+}
+
+// without returns the index with tag removed from every digest.
+func (idx manifestIndex) without(tag string) manifestIndex {
+	for d, tags := range idx {
+		kept := tags[:0]
+		for _, t := range tags {
+			if t != tag {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) == 0 {
+			delete(idx, d)
+		} else {
+			idx[d] = kept
+		}
+	}
+	return idx
+}
+
+// indexTag records that tag now points at a manifest with the given digest.
+func indexTag(rootDir string, name string, tag string, digest string, modes fileModes) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	idx, err := loadIndex(rootDir, name)
+	if err != nil {
+		return err
+	}
+	idx = idx.without(tag)
+	idx[digest] = append(idx[digest], tag)
+	sort.Strings(idx[digest])
+	return saveIndex(rootDir, name, idx, modes)
+}
+
+// unindexTag forgets a tag, e.g. once it has been deleted.
+func unindexTag(rootDir string, name string, tag string, modes fileModes) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	idx, err := loadIndex(rootDir, name)
+	if err != nil {
+		return err
+	}
+	return saveIndex(rootDir, name, idx.without(tag), modes)
+}
+
+// rebuildIndex recreates the index of a repository from its tags.
+func rebuildIndex(rootDir string, name string, modes fileModes) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	tags, err := getTags(path.Join(rootDir, name))
+	if err != nil {
+		return err
+	}
+	idx := make(manifestIndex)
+	for _, tag := range tags {
+		b, err := readFile(tagManifestPath(rootDir, name, tag))
+		if err != nil {
+			return err
+		}
+		d := getDigest(b.Bytes())
+		idx[d] = append(idx[d], tag)
+	}
+	return saveIndex(rootDir, name, idx, modes)
+}
+
+// lookupIndex returns the manifest path of a tag that the index says has the
+// given digest. Entries are checked against the manifest on disk so a stale
+// index never returns the wrong manifest; an empty path means no valid entry.
+func lookupIndex(rootDir string, name string, digest string) (string, error) {
+	indexMu.Lock()
+	idx, err := loadIndex(rootDir, name)
+	indexMu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range idx[digest] {
+		p := tagManifestPath(rootDir, name, tag)
+		b, err := readFile(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if getDigest(b.Bytes()) == digest {
+			return p, nil
+		}
+	}
+	return "", nil
+}
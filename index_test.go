@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestIndexHit(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	body := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", "v1", body)
+
+	idx, err := loadIndex(reg.rootDir, "test/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := idx[getDigest(body)]; len(tags) != 1 || tags[0] != "v1" {
+		t.Fatalf("want v1 indexed under its digest, got %v", idx)
+	}
+
+	// A tag whose manifest cannot be read would fail a scan of the repository,
+	// so resolving succeeds only if the index is used.
+	if err := os.MkdirAll(tagManifestPath(reg.rootDir, "test/image", "broken"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	p, err := resolveManifest(reg.rootDir, "test/image", getDigest(body), reg.config.modes())
+	if err != nil {
+		t.Fatalf("want lookup served from the index, got %s", err)
+	}
+	if p != tagManifestPath(reg.rootDir, "test/image", "v1") {
+		t.Errorf("unexpected manifest path %s", p)
+	}
+}
+
+func TestIndexMissRebuilds(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	body := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", "v1", body)
+	if err := os.Remove(indexPath(reg.rootDir, "test/image")); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := getTestManifest(reg, "test/image", getDigest(body)); w.Code != 200 {
+		t.Fatalf("want 200 by digest without an index, got %d", w.Code)
+	}
+	idx, err := loadIndex(reg.rootDir, "test/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := idx[getDigest(body)]; len(tags) != 1 || tags[0] != "v1" {
+		t.Errorf("want index rebuilt after a miss, got %v", idx)
+	}
+}
+
+func TestIndexInvalidatedAfterDelete(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	body := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", "v1", body)
+	putTestManifest(t, reg, "test/image", "v2", body)
+
+	if err := os.RemoveAll(path.Join(reg.rootDir, "test/image", "v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := unindexTag(reg.rootDir, "test/image", "v1", reg.config.modes()); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := loadIndex(reg.rootDir, "test/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := idx[getDigest(body)]; len(tags) != 1 || tags[0] != "v2" {
+		t.Errorf("want only v2 left in the index, got %v", idx)
+	}
+
+	if err := os.RemoveAll(path.Join(reg.rootDir, "test/image", "v2")); err != nil {
+		t.Fatal(err)
+	}
+	if w := getTestManifest(reg, "test/image", getDigest(body)); w.Code != 404 {
+		t.Errorf("want 404 once every tag is gone despite a stale index, got %d", w.Code)
+	}
+}
+
+func TestIndexRetag(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	first := []byte(testManifest)
+	second := imageManifest(emptyJSONDigest)
+	putTestManifest(t, reg, "test/image", "latest", first)
+	putTestManifest(t, reg, "test/image", "latest", second)
+
+	idx, err := loadIndex(reg.rootDir, "test/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := idx[getDigest(first)]; ok {
+		t.Errorf("want moved tag removed from its old digest, got %v", idx)
+	}
+	if tags := idx[getDigest(second)]; len(tags) != 1 || tags[0] != "latest" {
+		t.Errorf("want latest indexed under its new digest, got %v", idx)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// journalCompactEvery is how many entries are appended to the upload journal
+// before it is rewritten with only the sessions still open.
+const journalCompactEvery = 10000
+
+// journalEntry records the bytes of an upload session acknowledged to the
+// client. Done marks a session that was completed or canceled.
+type journalEntry struct {
+	Name   string    `json:"name"`
+	ID     string    `json:"id"`
+	Offset int64     `json:"offset"`
+	Time   time.Time `json:"time"`
+	Done   bool      `json:"done,omitempty"`
+}
+
+// uploadJournal is an append-only log of upload sessions, kept so that they
+// can be resumed after the server crashes or restarts. A chunk that was being
+// written when the server went down is cut off again on recovery, so the
+// session matches what the client was last told it holds.
+type uploadJournal struct {
+	mu       sync.Mutex
+	path     string
+	modes    fileModes
+	fsync    bool
+	f        *os.File
+	active   map[string]journalEntry
+	appended int
+}
+
+func journalPath(rootDir string) string {
+	return path.Join(rootDir, "_uploads.journal")
+}
+
+// openUploadJournal replays the journal in rootDir and recovers the sessions
+// it lists. Sessions not touched for longer than expiry are removed, unless
+// expiry is 0. The journal is then compacted and opened for appending.
+func openUploadJournal(rootDir string, expiry time.Duration, modes fileModes, fsync bool) (*uploadJournal, error) {
+	j := &uploadJournal{path: journalPath(rootDir), modes: modes, fsync: fsync, active: make(map[string]journalEntry)}
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+	recovered := 0
+	for key, e := range j.active {
+		ok, err := recoverUpload(rootDir, e, expiry)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			delete(j.active, key)
+			continue
+		}
+		recovered++
+	}
+	if recovered > 0 {
+		log.Printf("Recovered %d upload sessions", recovered)
+	}
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// replay loads the latest entry of every open session. A line cut short by
+// a crash ends the journal.
+func (j *uploadJournal) replay() error {
+	f, err := os.Open(j.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			break
+		}
+		if e.Done {
+			delete(j.active, e.Name+"/"+e.ID)
+		} else {
+			j.active[e.Name+"/"+e.ID] = e
+		}
+	}
+	return sc.Err()
+}
+
+// recoverUpload truncates the file of a session to its acknowledged offset.
+// It reports false when the session is expired or its bytes are lost, in
+// which case the file is removed.
+func recoverUpload(rootDir string, e journalEntry, expiry time.Duration) (bool, error) {
+	if !matches(nameRegex, e.Name) || !matches(uploadIDRegex, e.ID) {
+		return false, nil
+	}
+	p := uploadPath(rootDir, e.Name, e.ID)
+	fi, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if (expiry > 0 && time.Since(e.Time) > expiry) || fi.Size() < e.Offset {
+		os.Remove(uploadDigestPath(p))
+		return false, os.Remove(p)
+	}
+	if fi.Size() > e.Offset {
+		return true, os.Truncate(p, e.Offset)
+	}
+	return true, nil
+}
+
+// compact rewrites the journal with one entry per open session and reopens
+// it for appending. The caller holds mu, or has sole use of the journal.
+func (j *uploadJournal) compact() error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, j.modes.file)
+	if err != nil {
+		return err
+	}
+	if err = f.Chmod(j.modes.file); err != nil {
+		f.Close()
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range j.active {
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+	if err == nil && j.fsync {
+		err = syncFile(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, j.modes.file)
+	j.appended = 0
+	return err
+}
+
+// record appends the state of a session to the journal. Journaling is
+// best effort: failures are logged and do not fail the upload. A nil journal
+// records nothing.
+func (j *uploadJournal) record(name string, id string, offset int64, done bool) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e := journalEntry{Name: name, ID: id, Offset: offset, Time: time.Now().UTC(), Done: done}
+	if done {
+		delete(j.active, name+"/"+id)
+	} else {
+		j.active[name+"/"+id] = e
+	}
+	b, err := json.Marshal(e)
+	if err == nil {
+		_, err = j.f.Write(append(b, '\n'))
+	}
+	if err == nil && j.fsync {
+		err = syncFile(j.f)
+	}
+	if err == nil {
+		if j.appended++; j.appended >= journalCompactEvery {
+			err = j.compact()
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to journal upload %s: %s", id, err)
+	}
+}
+
+// close closes the journal file.
+func (j *uploadJournal) close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.f.Close()
+}
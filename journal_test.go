@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func openTestJournal(t *testing.T, rootDir string, expiry time.Duration) *uploadJournal {
+	t.Helper()
+	j, err := openUploadJournal(rootDir, expiry, defaultModes, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { j.close() })
+	return j
+}
+
+func TestUploadJournalResumeAfterRestart(t *testing.T) {
+	rootDir := t.TempDir()
+	reg := &registry{rootDir: rootDir}
+	reg.journal = openTestJournal(t, rootDir, time.Hour)
+	location := startTestUpload(t, reg, "test/image")
+	if w := patchTestUpload(t, reg, location, []byte("hello "), "0-5"); w.Code != 202 {
+		t.Fatalf("first chunk: want 202, got %d", w.Code)
+	}
+	// The server goes down while the next chunk is being written.
+	f, err := os.OpenFile(uploadPath(rootDir, "test/image", uploadID(location)), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("wo"))
+	f.Close()
+	reg.journal.close()
+
+	reg = &registry{rootDir: rootDir}
+	reg.journal = openTestJournal(t, rootDir, time.Hour)
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", location, nil))
+	if w.Code != 204 || w.Header().Get("Range") != "0-5" {
+		t.Fatalf("want the acknowledged range 0-5 after recovery, got %d with %q", w.Code, w.Header().Get("Range"))
+	}
+	if w := patchTestUpload(t, reg, location, []byte("world"), "6-10"); w.Code != 202 {
+		t.Fatalf("resumed chunk: want 202, got %d", w.Code)
+	}
+	content := []byte("hello world")
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", location+"?digest="+getDigest(content), nil))
+	if w.Code != 201 {
+		t.Fatalf("want 201, got %d: %s", w.Code, w.Body.String())
+	}
+	b, err := os.ReadFile(blobPath(rootDir, defaultLayout, "test/image", getDigest(content)))
+	if err != nil || !bytes.Equal(b, content) {
+		t.Errorf("want %q stored, got %q (%v)", content, b, err)
+	}
+	if len(reg.journal.active) != 0 {
+		t.Errorf("want no open sessions after completion, got %v", reg.journal.active)
+	}
+}
+
+func TestUploadJournalExpiry(t *testing.T) {
+	rootDir := t.TempDir()
+	reg := &registry{rootDir: rootDir}
+	reg.journal = openTestJournal(t, rootDir, time.Hour)
+	location := startTestUpload(t, reg, "test/image")
+	reg.journal.close()
+
+	time.Sleep(10 * time.Millisecond)
+	openTestJournal(t, rootDir, time.Millisecond)
+	if _, err := os.Stat(uploadPath(rootDir, "test/image", uploadID(location))); !os.IsNotExist(err) {
+		t.Errorf("want the expired session removed, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// rejectResponse is written to connections refused by a limitListener.
+var rejectResponse = func() string {
+	body := `{"errors":[{"code":"UNAVAILABLE","message":"too many connections","detail":{}}]}`
+	return fmt.Sprintf("HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Type: application/json\r\nContent-Length: %d\r\nRetry-After: 1\r\n\r\n%s", len(body), body)
+}()
+
+// listen opens the listener the server is run on: TLS when a certificate is
+// configured, and limited to -max-connections open connections.
+func listen(config Config) (net.Listener, error) {
+	ln, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}})
+	}
+	return newLimitListener(ln, config.MaxConnections), nil
+}
+
+// limitListener accepts at most a fixed number of connections at once.
+// Connections beyond the limit are answered with a 503 and closed straight
+// away, so clients back off instead of waiting in the accept queue.
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+}
+
+// newLimitListener limits l to max open connections, or returns it as is
+// when max is 0.
+func newLimitListener(l net.Listener, max int) net.Listener {
+	if max <= 0 {
+		return l
+	}
+	return &limitListener{Listener: l, slots: make(chan struct{}, max)}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.slots <- struct{}{}:
+			return &limitConn{Conn: c, slots: l.slots}, nil
+		default:
+			go rejectConn(c)
+		}
+	}
+}
+
+// rejectConn answers a connection over the limit. The request is drained
+// until the client hangs up so that the response is not lost to a reset.
+func rejectConn(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.WriteString(c, rejectResponse); err != nil {
+		return
+	}
+	io.Copy(io.Discard, c)
+}
+
+// limitConn frees its slot in the limitListener once closed.
+type limitConn struct {
+	net.Conn
+	slots   chan struct{}
+	release sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.release.Do(func() { <-c.slots })
+	return err
+}
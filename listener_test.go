@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})}
+	go srv.Serve(newLimitListener(ln, 2))
+	defer srv.Close()
+
+	// Hold both slots with idle connections.
+	held := make([]net.Conn, 0)
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		held = append(held, c)
+	}
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET /v2/ HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	status, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(status, " 503 ") {
+		t.Fatalf("want a connection over the limit refused with 503, got %q", status)
+	}
+
+	// Closing a held connection frees its slot.
+	held[0].Close()
+	client := &http.Client{Timeout: 5 * time.Second}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		resp, err := client.Get("http://" + ln.Addr().String() + "/v2/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot was not freed, last status %d", resp.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
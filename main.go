@@ -10,20 +10,28 @@ import (
 	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/distribution/distribution/uuid"
-	_ "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 const (
 	// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pulling-manifests
 	nameRegex   string = "^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$"
 	refRegex    string = "^[a-zA-Z0-9_][a-zA-Z0-9._-]{1,127}$"
-	digestRegex string = "^sha256:([a-f0-9]{64})$"
+	digestRegex string = "^(sha256:[a-f0-9]{64}|sha512:[a-f0-9]{128})$"
+	// blobEndpointRegex matches a /blobs/<alg>:<hex> endpoint for any
+	// supported algorithm. The digest is validated separately so that a
+	// malformed one is answered as such.
+	blobEndpointRegex string = "/blobs/(sha256|sha512):[^/]*$"
 )
 
 type ErrorResponse struct {
@@ -31,9 +39,33 @@ type ErrorResponse struct {
 }
 
 type ErrorDetail struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
-	Detail  string `json:"detail"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Detail  interface{} `json:"detail"`
+}
+
+// ociError is a client error that is reported with an OCI error code,
+// message and detail rather than as an internal server error.
+type ociError struct {
+	code    string
+	message string
+	detail  interface{}
+}
+
+func (e *ociError) Error() string {
+	return e.message
+}
+
+// ociErrors are client errors found together, which are all reported at
+// once so that a client can fix every problem in one round trip.
+type ociErrors []*ociError
+
+func (e ociErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, oe := range e {
+		msgs = append(msgs, oe.message)
+	}
+	return strings.Join(msgs, "; ")
 }
 
 type TagList struct {
@@ -42,237 +74,1037 @@ type TagList struct {
 }
 
 func main() {
-	fmt.Println("Starting...")
 	logFlags := log.LstdFlags | log.LUTC
 	if e := os.Getenv("DEBUG"); e != "" {
 		logFlags = logFlags | log.Lshortfile
 	}
 	log.SetFlags(logFlags)
-	rootDir := setupStorage()
+	config, err := parseConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+	if config.Version {
+		fmt.Println(currentBuild())
+		return
+	}
+	fmt.Println("Starting...")
+	log.Printf("Version: %s", currentBuild())
+	rootDir, err := setupStorage(config.Root, !config.NoCreateRoot, config.modes())
+	if err != nil {
+		log.Fatalf("Unable to set up storage: %s", err)
+	}
 	log.Printf("Storage: %s", rootDir)
-	http.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
-		if e := os.Getenv("DEBUG"); e != "" {
-			printInfo(r)
+	if config.TrustForwarded {
+		log.Printf("Warning: -trust-forwarded believes X-Forwarded-* headers from any client; list your proxies with -trusted-proxies instead")
+	}
+	if err := migrateBlobLayout(rootDir, config.layout(), config.modes()); err != nil {
+		log.Fatalf("Unable to migrate blob storage layout: %s", err)
+	}
+	if config.GC {
+		res, err := collectGarbage(rootDir, config.layout(), gcOptions{deleteUntagged: config.GCDeleteUntagged, softDeleteWindow: time.Duration(config.SoftDeleteWindow)})
+		if err != nil {
+			log.Fatalf("Garbage collection failed: %s", err)
+		}
+		log.Printf("Garbage collection removed %d manifests and %d blobs, reclaiming %d bytes", len(res.Manifests), len(res.Blobs), res.ReclaimedBytes)
+		return
+	}
+	reg := &registry{rootDir: rootDir, config: config}
+	if config.MaxTotalStorage > 0 {
+		reg.usage = &storageUsage{rootDir: rootDir, max: config.MaxTotalStorage}
+		reg.repos.usage = reg.usage
+	}
+	if config.MaxInFlightBytes > 0 {
+		reg.transfers = &transferBudget{max: config.MaxInFlightBytes}
+	}
+	if reg.journal, err = openUploadJournal(rootDir, time.Duration(config.UploadExpiry), config.modes(), config.Fsync); err != nil {
+		log.Fatalf("Unable to recover uploads: %s", err)
+	}
+	if config.MirrorPushTo != "" {
+		if reg.mirror, err = newMirror(config.MirrorPushTo, rootDir, config); err != nil {
+			log.Fatalf("Invalid mirror: %s", err)
 		}
-		if r.Method == "GET" && r.RequestURI == "/v2/" {
-			w.WriteHeader(200)
+		log.Printf("Mirroring pushes to %s", config.MirrorPushTo)
+	}
+	if config.IdempotencyTTL > 0 {
+		reg.idempotency = newIdempotencyKeys(time.Duration(config.IdempotencyTTL))
+	}
+	if config.BlobStatCacheTTL > 0 {
+		reg.blobStats = newBlobStatCache(time.Duration(config.BlobStatCacheTTL))
+	}
+	if len(config.Webhooks) > 0 {
+		reg.notifier = newNotifier(config)
+	}
+	if config.ScrubInterval > 0 {
+		s := &scrubber{rootDir: rootDir, layout: config.layout(), modes: config.modes(), batch: scrubBatch, rate: scrubRate}
+		if config.DigestCacheTTL > 0 {
+			s.cache = loadDigestCache(rootDir, time.Duration(config.DigestCacheTTL), config.modes())
+		}
+		go s.run(time.Duration(config.ScrubInterval))
+	}
+	var breaker *storageBreaker
+	if config.BreakerThreshold > 0 {
+		breaker = &storageBreaker{threshold: config.BreakerThreshold, cooldown: time.Duration(config.BreakerCooldown)}
+	}
+	handler := timeoutRequests(breakOnStorageFailures(reg, breaker), time.Duration(config.RequestTimeout))
+	if config.StorageReadOnlyFallback {
+		reg.readOnly = &readOnlyFallback{}
+		handler = refuseWritesWhenReadOnly(handler, reg.readOnly)
+	}
+	denyUserAgents, _ := config.userAgentPatterns()
+	handler = filterUserAgents(handler, denyUserAgents, config.RequireUserAgent)
+	var users map[string]string
+	if config.AuthHtpasswd != "" {
+		if users, err = loadHtpasswd(config.AuthHtpasswd); err != nil {
+			log.Fatalf("Unable to load users: %s", err)
+		}
+		handler = basicAuth(handler, users, config.AnonymousPull)
+	}
+	handler = corsHeaders(handler, config.CORSOrigins, config.CORSExposeHeaders, time.Duration(config.CORSMaxAge))
+	handler = serverTimings(handler)
+	if config.Metrics {
+		reg.stats = &metricsCache{rootDir: rootDir, layout: config.layout(), refresh: time.Duration(config.MetricsRefresh), breaker: breaker, readOnly: reg.readOnly, verboseErrors: config.VerboseErrors}
+	}
+	srv := &http.Server{Addr: config.Addr, IdleTimeout: time.Duration(config.IdleTimeout)}
+	srv.SetKeepAlivesEnabled(!config.NoKeepAlive)
+	ln, err := listen(config)
+	if err != nil {
+		log.Fatalf("Unable to listen: %s", err)
+	}
+	reqs := &inFlight{}
+	srv.Handler = reqs.track(reg.routes(handler, users))
+	log.Printf("Listening on %s", config.Addr)
+	if err := serve(srv, ln, time.Duration(config.ShutdownGrace), reqs); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// routes serves the registry API with v2 under /v2/, along with the admin,
+// metrics and UI endpoints. Requests to any of them from client addresses
+// refused by -allow-cidr or -deny-cidr are answered with 403.
+func (reg *registry) routes(v2 http.Handler, users map[string]string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/v2/", recoverPanics(v2))
+	if admins := reg.config.AdminUsers; len(admins) > 0 {
+		mux.Handle("/admin/gc", recoverPanics(requireAdmin(&gcHandler{reg: reg}, users, admins)))
+		mux.Handle("/admin/restore", recoverPanics(requireAdmin(&restoreHandler{reg: reg}, users, admins)))
+		mux.Handle("/admin/warm", recoverPanics(requireAdmin(&warmHandler{reg: reg}, users, admins)))
+	}
+	if reg.stats != nil {
+		mux.Handle("/metrics", reg.stats)
+	}
+	if reg.config.UI {
+		serveUI(mux)
+	} else {
+		mux.Handle("/", &rootHandler{service: reg.config.ServiceName})
+	}
+	allowCIDRs, _ := parseCIDRs("allow-cidr", reg.config.AllowCIDRs)
+	denyCIDRs, _ := parseCIDRs("deny-cidr", reg.config.DenyCIDRs)
+	return filterClientIPs(mux, allowCIDRs, denyCIDRs, reg.config.proxyTrust())
+}
+
+// registry serves the OCI distribution API from a storage root on disk.
+type registry struct {
+	rootDir string
+	config  Config
+	repos   repoTracker
+	uploads uploadTracker
+	// manifests serialises pushes to the same tag or digest.
+	manifests keyedLocks
+	// mirror replicates pushes when -mirror-push-to is set; nil otherwise.
+	mirror *mirror
+	// journal records upload sessions so they survive a restart.
+	journal *uploadJournal
+	// notifier posts push events when -webhooks is set; nil otherwise.
+	notifier *notifier
+	// blobStats caches blob existence for HEAD requests when
+	// -blob-stat-cache-ttl is set; nil otherwise.
+	blobStats *blobStatCache
+	// stats caches repository statistics when -metrics is set; nil otherwise.
+	stats *metricsCache
+	// usage tracks stored bytes when -max-total-storage is set; nil otherwise.
+	usage *storageUsage
+	// transfers caps the bytes of blob transfers in flight when
+	// -max-in-flight-bytes is set; nil otherwise.
+	transfers *transferBudget
+	// idempotency replays pushes retried with the same Idempotency-Key when
+	// -idempotency-ttl is set; nil otherwise.
+	idempotency *idempotencyKeys
+	// readOnly serves pulls only once storage is found read-only when
+	// -storage-readonly-fallback is set; nil otherwise.
+	readOnly *readOnlyFallback
+}
+
+func (reg *registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	timing, start := timingFrom(r.Context()), time.Now()
+	if e := os.Getenv("DEBUG"); e != "" {
+		printInfo(r)
+	}
+	if r.Method == "OPTIONS" && (r.URL.Path == "/v2/" || r.URL.Path == "/v2/_catalog" || r.URL.Path == "/v2/_version") {
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(200)
+		return
+	}
+	if r.Method == "GET" && r.RequestURI == "/v2/" {
+		w.WriteHeader(200)
+		return
+	}
+	if r.Method == "GET" && r.URL.Path == "/v2/_catalog" {
+		reg.serveCatalog(w, r)
+		return
+	}
+	if r.Method == "GET" && r.URL.Path == "/v2/_version" {
+		serveVersion(w)
+		return
+	}
+	name, err := parseName(r.RequestURI)
+	if err != nil {
+		writeUnknownEndpoint(r, w)
+		return
+	}
+	endpoint := strings.TrimPrefix(r.RequestURI, strings.Join([]string{"/v2/", name}, ""))
+	if lower := strings.ToLower(name); lower != name && matches(nameRegex, lower) {
+		if reg.config.NameCase != "lower" {
+			writeOciErrorDetail("NAME_INVALID", "invalid repository name", fmt.Sprintf("repository names must be lowercase, found %q", uppercaseLetters(name)), w, 400)
+			return
+		}
+		name = lower
+	}
+	if !matches(nameRegex, name) {
+		writeOciError("NAME_INVALID", "invalid repository name", w, 400)
+		return
+	}
+	if e := os.Getenv("DEBUG"); e != "" {
+		log.Printf("Endpoint: %s", endpoint)
+	}
+	if r.Method == "OPTIONS" {
+		methods := reg.allowedMethods(strings.SplitN(endpoint, "?", 2)[0])
+		if methods == nil {
+			writeUnknownEndpoint(r, w)
 			return
 		}
-		name, err := parseName(r.RequestURI)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		w.WriteHeader(200)
+		return
+	}
+	if reg.config.MaxRepos > 0 {
+		if r.Method == "POST" || r.Method == "PUT" {
+			release, admitted, err := reg.repos.admit(reg.rootDir, name, reg.config.MaxRepos, reg.config.RepoEviction)
+			if err != nil {
+				reg.writeServerError(err, w)
+				return
+			}
+			defer release()
+			if !admitted {
+				writeOciError("DENIED", "repository limit reached", w, 403)
+				return
+			}
+		} else {
+			reg.repos.touch(reg.rootDir, name)
+		}
+	}
+	if reg.usage != nil && isPush(r.Method, endpoint) {
+		full, err := reg.usage.full()
 		if err != nil {
-			writeServerError(err, w)
+			reg.writeServerError(err, w)
 			return
 		}
-		if !matches(nameRegex, name) {
-			writeOciError("NAME_INVALID", "invalid repository name", w, 400)
+		if full {
+			writeOciErrorDetail("DENIED", "storage limit reached", map[string]int64{"max": reg.usage.max}, w, 507)
 			return
 		}
-		endpoint := strings.TrimPrefix(r.RequestURI, strings.Join([]string{"/v2/", name}, ""))
-		if e := os.Getenv("DEBUG"); e != "" {
-			log.Printf("Endpoint: %s", endpoint)
+	}
+	if isPush(r.Method, endpoint) && strings.Contains(endpoint, "/blobs/uploads/") {
+		// Uploads of unknown length only go ahead while there is room left.
+		n := r.ContentLength
+		if n < 0 {
+			n = 0
 		}
-		if r.Method == "HEAD" && strings.Contains(endpoint, "/blobs/sha256:") {
-			parts := strings.Split(endpoint, "/")
-			requestDigest := parts[len(parts)-1]
-			if !matches(digestRegex, requestDigest) {
-				writeOciError("BLOB_UNKNOWN", "blob unknown to registry", w, 400)
+		if !reg.transfers.acquire(n) {
+			writeTransfersBusy(w)
+			return
+		}
+		defer reg.transfers.release(n)
+	}
+	timing.since("route", start)
+	if r.Method == "HEAD" && matches(blobEndpointRegex, endpoint) {
+		parts := strings.Split(endpoint, "/")
+		requestDigest := parts[len(parts)-1]
+		if reg.config.AllowShortDigests && matches(shortDigestRegex, requestDigest) {
+			var ok bool
+			if requestDigest, ok = reg.expandBlobDigest(w, name, requestDigest); !ok {
 				return
 			}
-			b, err := fileExists(path.Join(rootDir, name, "_blobs", requestDigest))
-			var status int
+		}
+		if !matches(digestRegex, requestDigest) {
+			writeOciError("BLOB_UNKNOWN", "blob unknown to registry", w, 400)
+			return
+		}
+		start := time.Now()
+		st, err := reg.blobStats.stat(reg.rootDir, reg.config.layout(), name, requestDigest)
+		timing.since("storage", start)
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		if !st.exists {
+			reg.writeNotFound(w, name, "BLOB_UNKNOWN", "blob unknown to registry")
+			return
+		}
+		if requestDigest == emptyJSONDigest {
+			found, err := repoExists(reg.rootDir, name)
 			if err != nil {
-				writeServerError(err, w)
+				reg.writeServerError(err, w)
 				return
 			}
-			if b {
-				w.Header().Set("Docker-Content-Digest", requestDigest)
-				status = 200
-			} else {
-				status = 404
-			}
-			w.WriteHeader(status)
-		}
-		if r.Method == "GET" && strings.Contains(endpoint, "/blobs/sha256:") {
-			parts := strings.Split(endpoint, "/")
-			requestDigest := parts[len(parts)-1]
-			blobPath := path.Join(rootDir, name, "_blobs", requestDigest)
-			b, err := fileExists(blobPath)
-			var status int
-			if err != nil {
-				writeServerError(err, w)
+			if !found {
+				reg.writeNotFound(w, name, "BLOB_UNKNOWN", "blob unknown to registry")
 				return
 			}
-			if b {
-				w.Header().Set("Docker-Content-Digest", requestDigest)
-				status = 200
-				content, e := readFile(blobPath)
-				if e != nil {
-					writeServerError(e, w)
-					return
-				}
-				_, err := content.WriteTo(w)
-				if err != nil {
-					writeServerError(err, w)
-					return
-				}
-			} else {
-				status = 404
-				w.WriteHeader(status)
-			}
-		}
-		if r.Method == "POST" && strings.HasSuffix(endpoint, "/blobs/uploads/") {
-			id := uuid.Generate().String()
-			w.Header().Set("Location", r.RequestURI+id)
-			w.WriteHeader(202)
 		}
-		if r.Method == "POST" && strings.Contains(endpoint, "/blobs/uploads/") {
-			digest := r.FormValue("digest")
-			if digest == "" {
-				http.Error(w, "Digest missing", 400)
+		w.Header().Set("Content-Length", fmt.Sprint(st.size))
+		w.Header().Set("Docker-Content-Digest", requestDigest)
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", `"`+requestDigest+`"`)
+		w.WriteHeader(200)
+		return
+	}
+	if r.Method == "GET" && matches(blobEndpointRegex, endpoint) {
+		parts := strings.Split(endpoint, "/")
+		requestDigest := parts[len(parts)-1]
+		if reg.config.AllowShortDigests && matches(shortDigestRegex, requestDigest) {
+			var ok bool
+			if requestDigest, ok = reg.expandBlobDigest(w, name, requestDigest); !ok {
 				return
 			}
-			destFile := path.Join(rootDir, name, "_blobs", digest)
-			writeBodyToFileWithLocation(destFile, w, r, name, digest)
+		}
+		if !matches(digestRegex, requestDigest) {
+			writeOciError("BLOB_UNKNOWN", "blob unknown to registry", w, 400)
 			return
 		}
-		if r.Method == "PUT" && strings.Contains(endpoint, "/blobs/uploads/") {
-			err := os.MkdirAll(path.Join(rootDir, name, "_blobs"), 0755)
-			if err != nil {
-				writeServerError(err, w)
+		var content io.ReadSeeker
+		var size int64
+		start := time.Now()
+		f, err := os.Open(blobPath(reg.rootDir, reg.config.layout(), name, requestDigest))
+		timing.since("storage", start)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				reg.writeServerError(err, w)
 				return
 			}
-			digest := r.FormValue("digest")
-			log.Printf("Digest: %s", digest)
-			destFile := path.Join(rootDir, name, "_blobs", digest)
-			writeBodyToFile(destFile, w, r)
-			w.WriteHeader(201)
-		}
-		if r.Method == "GET" && strings.HasSuffix(endpoint, "/tags/list") {
-			if _, err := os.ReadDir(path.Join(rootDir, name)); err != nil {
-				writeOciError("NAME_UNKNOWN", "repository name not known to registry", w, 404)
+			if requestDigest != emptyJSONDigest {
+				reg.writeNotFound(w, name, "BLOB_UNKNOWN", "blob unknown to registry")
 				return
 			}
-			tags, err := getTags(path.Join(rootDir, name))
+			// The empty JSON blob is served without being stored, but only
+			// from repositories that exist.
+			found, err := repoExists(reg.rootDir, name)
 			if err != nil {
-				writeServerError(err, w)
+				reg.writeServerError(err, w)
 				return
 			}
-			tl := TagList{
-				Name:    name,
-				TagList: tags,
-			}
-			jb, jE := json.Marshal(tl)
-			if jE != nil {
-				writeServerError(jE, w)
+			if !found {
+				reg.writeNotFound(w, name, "BLOB_UNKNOWN", "blob unknown to registry")
 				return
 			}
-			_, wE := w.Write(jb)
-			if wE != nil {
-				writeServerError(wE, w)
-				return
+			content, size = bytes.NewReader(emptyJSON), int64(len(emptyJSON))
+		} else {
+			defer f.Close()
+			content = f
+			if fi, err := f.Stat(); err == nil {
+				size = fi.Size()
 			}
 		}
-		if r.Method == "PUT" && strings.Contains(endpoint, "/manifests/") {
-			parts := strings.Split(endpoint, "/manifests/")
-			requestRef := parts[len(parts)-1]
-			if !matches(refRegex, requestRef) {
-				writeOciError("MANIFEST_INVALID", "manifest invalid", w, 400)
+		if !reg.transfers.acquire(size) {
+			writeTransfersBusy(w)
+			return
+		}
+		defer reg.transfers.release(size)
+		reg.notifier.blob(r, "pull", name, requestDigest, size)
+		w.Header().Set("Docker-Content-Digest", requestDigest)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		// Blobs are immutable, so the digest is a strong ETag.
+		w.Header().Set("ETag", `"`+requestDigest+`"`)
+		// ServeContent also advertises Accept-Ranges, honours Range requests so
+		// interrupted layer pulls can be resumed, and answers If-None-Match.
+		http.ServeContent(w, r, "", time.Time{}, content)
+		return
+	}
+	if r.Method == "DELETE" && matches(blobEndpointRegex, endpoint) {
+		if !reg.config.AllowBlobDelete {
+			writeOciError("UNSUPPORTED", "blob deletion is disabled", w, 405)
+			return
+		}
+		parts := strings.Split(endpoint, "/")
+		digest := parts[len(parts)-1]
+		if !matches(digestRegex, digest) {
+			writeOciError("DIGEST_INVALID", "invalid digest", w, 400)
+			return
+		}
+		p := blobPath(reg.rootDir, reg.config.layout(), name, digest)
+		fi, err := os.Stat(p)
+		if err == nil {
+			err = os.Remove(p)
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			reg.writeNotFound(w, name, "BLOB_UNKNOWN", "blob unknown to registry")
+			return
+		}
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		reg.usage.add(-fi.Size())
+		reg.blobStats.forget(name, digest)
+		reg.notifier.blob(r, "delete", name, digest, fi.Size())
+		w.WriteHeader(202)
+		return
+	}
+	if r.Method == "POST" && strings.HasSuffix(endpoint, "/blobs/uploads/") {
+		reg.startUpload(w, r, name)
+		return
+	}
+	if r.Method == "POST" && strings.Contains(endpoint, "/blobs/uploads/") {
+		digest := r.FormValue("digest")
+		if digest == "" {
+			http.Error(w, "Digest missing", 400)
+			return
+		}
+		if !matches(digestRegex, digest) {
+			writeOciError("DIGEST_INVALID", "provided digest did not match uploaded content", w, 400)
+			return
+		}
+		if reg.idempotency.replay(w, r, digest, reg.blobStored(name, digest)) {
+			return
+		}
+		expected, err := requestContentDigest(r)
+		if err != nil {
+			writeOciError("DIGEST_INVALID", err.Error(), w, 400)
+			return
+		}
+		// A blob that is already stored need not be transferred again.
+		start := time.Now()
+		exists, err := blobExists(reg.rootDir, reg.config.layout(), name, digest)
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		if !exists {
+			// The body is also hashed as the client asserted with
+			// Content-Digest, so content altered on the way is refused.
+			var body io.Reader = r.Body
+			var check func(string) error
+			if expected != "" {
+				he := algorithmFor(expected)
+				body = io.TeeReader(r.Body, he)
+				check = func(string) error {
+					if sumDigest(he, expected) != expected {
+						return &ociError{"DIGEST_INVALID", "Content-Digest did not match uploaded content", nil}
+					}
+					return nil
+				}
+			}
+			size, stored, err := storeBlob(reg.rootDir, reg.config.layout(), name, digest, body, reg.config.modes(), reg.config.Fsync, check)
+			var oe *ociError
+			if errors.As(err, &oe) {
+				writeOciError(oe.code, oe.message, w, 400)
 				return
 			}
-			err := os.MkdirAll(path.Join(rootDir, name, requestRef), 0755)
 			if err != nil {
-				writeServerError(err, w)
+				reg.writeServerError(err, w)
 				return
 			}
-			destFile := path.Join(rootDir, name, requestRef, "manifest.json")
-			writeBodyToFile(destFile, w, r)
-			w.WriteHeader(201)
-		}
-		if r.Method == "HEAD" && strings.Contains(endpoint, "/manifests/") {
-			parts := strings.Split(endpoint, "/")
-			lastPart := parts[len(parts)-1]
-			isRef := matches(refRegex, lastPart)
-			isDigest := matches(digestRegex, lastPart)
-
-			if !(isRef || isDigest) {
-				writeOciError("MANIFEST_INVALID", "manifest invalid", w, 404)
+			if !stored {
+				writeOciError("DIGEST_INVALID", "provided digest did not match uploaded content", w, 400)
 				return
 			}
-			manifestPath := path.Join(rootDir, name)
-			if isRef {
-				manifestPath = path.Join(manifestPath, lastPart, "manifest.json")
-			} else {
-				foundPath, err := findManifest(rootDir, name, lastPart)
-				if err != nil {
-					return
-				}
-				if foundPath == "" {
-					writeOciError("MANIFEST_UNKNOWN", "manifest unknown to registry", w, 404)
-					return
-				}
-				manifestPath = foundPath
-			}
-			log.Printf("Manifest path: %s", manifestPath)
-			b, err := fileExists(manifestPath)
-			var status int
-			if err != nil {
-				writeServerError(err, w)
+			reg.usage.add(size)
+			reg.blobStats.forget(name, digest)
+			reg.mirror.blob(name, digest)
+			reg.notifier.blob(r, "push", name, digest, size)
+		}
+		timing.since("storage", start)
+		reg.repoCommitted(name)
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+		w.Header().Set("Docker-Content-Digest", digest)
+		reg.idempotency.commit(w, r, digest)
+		w.WriteHeader(201)
+		return
+	}
+	if r.Method == "GET" && strings.Contains(endpoint, "/blobs/uploads/") {
+		if strings.HasSuffix(r.URL.Path, "/events") {
+			reg.streamUploadEvents(w, r, name)
+		} else {
+			reg.uploadStatus(w, r, name)
+		}
+		return
+	}
+	if r.Method == "PATCH" && strings.Contains(endpoint, "/blobs/uploads/") {
+		reg.patchUpload(w, r, name)
+		return
+	}
+	if r.Method == "PUT" && strings.Contains(endpoint, "/blobs/uploads/") {
+		reg.finishUpload(w, r, name)
+		return
+	}
+	if r.Method == "DELETE" && strings.Contains(endpoint, "/blobs/uploads/") {
+		reg.cancelUpload(w, r, name)
+		return
+	}
+	if r.Method == "HEAD" && strings.HasPrefix(endpoint, "/tags/") {
+		// Non-standard: checks that a tag exists without fetching its manifest.
+		tag := strings.SplitN(strings.TrimPrefix(endpoint, "/tags/"), "?", 2)[0]
+		if !matches(refRegex, tag) {
+			writeOciError("TAG_INVALID", "invalid tag", w, 400)
+			return
+		}
+		content, err := readFile(tagManifestPath(reg.rootDir, name, tag))
+		if errors.Is(err, fs.ErrNotExist) {
+			reg.writeNotFound(w, name, "MANIFEST_UNKNOWN", "manifest unknown to registry")
+			return
+		}
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", getDigest(content.Bytes()))
+		w.WriteHeader(200)
+		return
+	}
+	if r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/tags/list") {
+		found, err := repoExists(reg.rootDir, name)
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		if !found {
+			writeOciError("NAME_UNKNOWN", "repository name not known to registry", w, 404)
+			return
+		}
+		tags, err := getTags(path.Join(reg.rootDir, name))
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		tags, ok := paginate(w, r, tags)
+		if !ok {
+			return
+		}
+		tl := TagList{
+			Name:    name,
+			TagList: tags,
+		}
+		jb, jE := json.Marshal(tl)
+		if jE != nil {
+			reg.writeServerError(jE, w)
+			return
+		}
+		_, wE := w.Write(jb)
+		if wE != nil {
+			reg.writeServerError(wE, w)
+			return
+		}
+		return
+	}
+	if r.Method == "GET" && strings.HasPrefix(endpoint, "/_export") {
+		found, err := repoExists(reg.rootDir, name)
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		if !found {
+			writeOciError("NAME_UNKNOWN", "repository name not known to registry", w, 404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-tar")
+		if err := exportRepo(reg.rootDir, reg.config.layout(), name, w); err != nil {
+			// Headers are already sent, so all we can do is log and cut the stream.
+			log.Printf("Export of %s failed: %s", name, err)
+		}
+		return
+	}
+	if r.Method == "GET" && strings.HasPrefix(endpoint, "/_info") {
+		reg.serveRepoInfo(w, name)
+		return
+	}
+	if r.Method == "POST" && strings.HasPrefix(endpoint, "/_import") {
+		var oe *ociError
+		err := importRepo(reg.rootDir, reg.config.layout(), name, r.Body, reg.config.MaxIndexDepth, reg.config.MaxIndexManifests, reg.config.modes())
+		// The archive may have replaced any amount of content.
+		reg.usage.invalidate()
+		if errors.As(err, &oe) {
+			writeOciErrorDetail(oe.code, oe.message, oe.detail, w, 400)
+			return
+		}
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		reg.repoCommitted(name)
+		w.WriteHeader(201)
+		return
+	}
+	if (r.Method == "POST" || r.Method == "DELETE") && strings.HasPrefix(endpoint, "/_pin/") {
+		reg.servePin(w, r, name, endpoint)
+		return
+	}
+	if r.Method == "POST" && strings.HasPrefix(endpoint, "/_move") {
+		if !reg.config.AllowMove {
+			writeOciError("UNSUPPORTED", "repository moves are disabled", w, 405)
+			return
+		}
+		to := r.URL.Query().Get("to")
+		if !matches(nameRegex, to) {
+			writeOciError("NAME_INVALID", "invalid repository name", w, 400)
+			return
+		}
+		if to == name || strings.HasPrefix(to, name+"/") {
+			writeOciError("NAME_INVALID", "target repository is the source or nested under it", w, 400)
+			return
+		}
+		found, err := repoExists(reg.rootDir, name)
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		if !found {
+			writeOciError("NAME_UNKNOWN", "repository name not known to registry", w, 404)
+			return
+		}
+		taken, err := repoExists(reg.rootDir, to)
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		if taken {
+			writeOciError("DENIED", "target repository already exists", w, 409)
+			return
+		}
+		if err := moveRepo(reg.rootDir, name, to, reg.config.modes()); err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		reg.repos.rename(name, to)
+		w.WriteHeader(202)
+		return
+	}
+	if r.Method == "PUT" && strings.Contains(endpoint, "/manifests/") {
+		parts := strings.Split(endpoint, "/manifests/")
+		requestRef := parts[len(parts)-1]
+		var destFile string
+		if matches(digestRegex, requestRef) {
+			destFile = digestManifestPath(reg.rootDir, name, requestRef)
+		} else if matches(refRegex, requestRef) {
+			destFile = tagManifestPath(reg.rootDir, name, requestRef)
+		} else {
+			writeOciError("MANIFEST_INVALID", "manifest invalid", w, 400)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		mediaType := pushedMediaType(r, body)
+		if mediaType == "" {
+			writeOciErrorDetail("MANIFEST_INVALID", "manifest invalid", "no Content-Type given and the manifest is of no known type", w, 400)
+			return
+		}
+		expected, err := requestContentDigest(r)
+		if err != nil {
+			writeOciError("DIGEST_INVALID", err.Error(), w, 400)
+			return
+		}
+		start := time.Now()
+		bodyDigest := getDigest(body)
+		if expected != "" && expected != digestAs(expected, body) {
+			writeOciError("DIGEST_INVALID", "Content-Digest did not match uploaded content", w, 400)
+			return
+		}
+		if matches(digestRegex, requestRef) && requestRef != digestAs(requestRef, body) {
+			writeOciErrorDetail("MANIFEST_INVALID", "manifest invalid", "manifest content does not match digest "+requestRef, w, 400)
+			return
+		}
+		timing.since("hash", start)
+		storedAtRef := func() bool {
+			b, err := os.ReadFile(destFile)
+			return err == nil && getDigest(b) == bodyDigest
+		}
+		if reg.idempotency.replay(w, r, bodyDigest, storedAtRef) {
+			return
+		}
+		// Every problem with the manifest is reported at once, with the
+		// status of the first.
+		var problems ociErrors
+		status := 400
+		if !reg.config.allowsManifestType(mediaType) {
+			problems = append(problems, &ociError{"MANIFEST_INVALID", "manifest media type not allowed", map[string]string{"mediaType": mediaType}})
+			status = 415
+		}
+		// An index over the limits is refused as it stands, without loading
+		// its children or blobs for the checks that follow.
+		if reg.config.MaxIndexManifests > 0 {
+			var oe *ociError
+			if err := checkIndexSize(body, reg.config.MaxIndexManifests); errors.As(err, &oe) {
+				writeOciErrors(append(problems, oe), w, status)
 				return
 			}
-			if b {
-				status = 200
-			} else {
-				status = 404
+		}
+		if reg.config.MaxIndexDepth > 0 {
+			var oe *ociError
+			err := checkIndexDepth(body, reg.config.MaxIndexDepth, func(d string) ([]byte, error) {
+				return loadStoredManifest(reg.rootDir, name, d, reg.config.modes())
+			})
+			if errors.As(err, &oe) {
+				writeOciErrors(append(problems, oe), w, status)
+				return
+			} else if err != nil {
+				reg.writeServerError(err, w)
+				return
 			}
-			w.WriteHeader(status)
 		}
-		if r.Method == "GET" && strings.Contains(endpoint, "/manifests/") {
-			parts := strings.Split(endpoint, "/")
-			lastPart := parts[len(parts)-1]
-			isRef := matches(refRegex, lastPart)
-			isDigest := matches(digestRegex, lastPart)
-
-			if !(isRef || isDigest) {
-				writeOciError("MANIFEST_INVALID", "manifest invalid", w, 404)
+		if reg.config.StrictManifests {
+			var errs ociErrors
+			err := validateManifest(reg.rootDir, reg.config.layout(), name, body)
+			if errors.As(err, &errs) {
+				problems = append(problems, errs...)
+			} else if err != nil {
+				reg.writeServerError(err, w)
 				return
 			}
-			manifestPath := path.Join(rootDir, name)
-			if isRef {
-				manifestPath = path.Join(manifestPath, lastPart, "manifest.json")
-			} else {
-				foundPath, err := findManifest(rootDir, name, lastPart)
-				if err != nil {
-					return
-				}
-				if foundPath == "" {
-					writeOciError("MANIFEST_UNKNOWN", "manifest unknown to registry", w, 404)
-					return
+		}
+		if len(problems) > 0 {
+			writeOciErrors(problems, w, status)
+			return
+		}
+		pushed := false
+		if (reg.config.KeepLastN > 0 || reg.config.KeepMaxAge > 0) && !matches(digestRegex, requestRef) {
+			// Deferred before the lock so that it runs once the lock is
+			// released, since deleting other tags takes their locks.
+			defer func() {
+				if pushed {
+					reg.pruneTags(r, name, requestRef)
 				}
-				manifestPath = foundPath
+			}()
+		}
+		start = time.Now()
+		unlock := reg.manifests.lock(name + ":" + requestRef)
+		defer unlock()
+		err = makeDirs(path.Dir(destFile), reg.config.modes())
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		var replaced int64
+		if fi, err := os.Stat(destFile); err == nil {
+			replaced = fi.Size()
+		}
+		storedType := r.Header.Get("Content-Type")
+		if storedType == "" {
+			// Record the sniffed type so the manifest is served back as such.
+			storedType = mediaType
+		}
+		// Recorded first, so a pull never gets the manifest without its type.
+		if err := writeMediaType(destFile, body, storedType, reg.config.modes()); err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		var check func(string) error
+		if reg.config.VerifyManifests {
+			check = func(tmp string) error { return verifyStored(tmp, body) }
+		}
+		if err := replaceFile(destFile, body, reg.config.modes(), reg.config.Fsync, check); err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		reg.usage.add(int64(len(body)) - replaced)
+		if !matches(digestRegex, requestRef) {
+			if err := indexTag(reg.rootDir, name, requestRef, bodyDigest, reg.config.modes()); err != nil {
+				reg.writeServerError(err, w)
+				return
 			}
-			b, err := fileExists(manifestPath)
+		}
+		digest := bodyDigest
+		if matches(digestRegex, requestRef) {
+			digest = requestRef
+		}
+		if subject := manifestSubject(body); subject != "" {
+			desc := newReferrerDescriptor(body, digest, storedMediaType(destFile, body, reg.config.manifestTypeDefaults()))
+			if err := addReferrer(reg.rootDir, name, subject, desc, reg.config.modes()); err != nil {
+				reg.writeServerError(err, w)
+				return
+			}
+			// Tells the client that referrers are tracked, so it need not
+			// maintain a tag schema fallback itself.
+			w.Header().Set("OCI-Subject", subject)
+		}
+		if reg.config.AutoLatest && matches(digestRegex, requestRef) {
+			tagged, err := reg.tagLatest(name, body, storedType)
 			if err != nil {
-				writeServerError(err, w)
+				reg.writeServerError(err, w)
 				return
 			}
-			if b {
-				content, e := readFile(manifestPath)
-				if e != nil {
-					writeServerError(e, w)
-					return
-				}
-				_, err := content.WriteTo(w)
-				if err != nil {
-					writeServerError(err, w)
-					return
-				}
-			} else {
-				writeOciError("MANIFEST_UNKNOWN", "manifest unknown to registry", w, 404)
+			if tagged {
+				reg.mirror.manifest(name, "latest")
+			}
+		}
+		timing.since("storage", start)
+		reg.repoCommitted(name)
+		reg.mirror.manifest(name, requestRef)
+		reg.notifier.manifest(r, "push", name, requestRef, digest, storedType, int64(len(body)))
+		pushed = true
+		reg.idempotency.commit(w, r, bodyDigest)
+		w.WriteHeader(201)
+		return
+	}
+	if r.Method == "DELETE" && strings.Contains(endpoint, "/manifests/") {
+		if !reg.config.AllowManifestDelete {
+			writeOciError("UNSUPPORTED", "manifest deletion is disabled", w, 405)
+			return
+		}
+		ref := manifestReference(endpoint)
+		if ref == "" {
+			writeOciError("MANIFEST_INVALID", "manifest invalid", w, 400)
+			return
+		}
+		digest, err := reg.deleteManifest(name, ref)
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		if digest == "" {
+			reg.writeNotFound(w, name, "MANIFEST_UNKNOWN", "manifest unknown to registry")
+			return
+		}
+		reg.usage.invalidate()
+		reg.notifier.manifest(r, "delete", name, ref, digest, "", 0)
+		w.WriteHeader(202)
+		return
+	}
+	if r.Method == "GET" && strings.Contains(endpoint, "/referrers/") {
+		reg.serveReferrers(w, r, name)
+		return
+	}
+	if r.Method == "HEAD" && strings.Contains(endpoint, "/manifests/") {
+		ref := manifestReference(endpoint)
+		if short := shortManifestReference(endpoint); ref == "" && short != "" && reg.config.AllowShortDigests {
+			var ok bool
+			if ref, ok = reg.expandManifestDigest(w, name, short); !ok {
+				return
+			}
+		}
+		if ref == "" {
+			writeOciError("MANIFEST_INVALID", "manifest invalid", w, 404)
+			return
+		}
+		start := time.Now()
+		manifestPath, err := resolveManifest(reg.rootDir, name, ref, reg.config.modes())
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		if manifestPath == "" {
+			reg.writeNotFound(w, name, "MANIFEST_UNKNOWN", "manifest unknown to registry")
+			return
+		}
+		// Non-standard: ?platform=os/arch pulls one platform out of an index.
+		manifestPath, err = selectPlatform(reg.rootDir, name, manifestPath, r.URL.Query().Get("platform"), reg.config.modes())
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		log.Printf("Manifest path: %s", manifestPath)
+		body, mediaType, err := readManifest(manifestPath, reg.config.manifestTypeDefaults())
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		timing.since("storage", start)
+		start = time.Now()
+		w.Header().Set("Docker-Content-Digest", getDigest(body))
+		timing.since("hash", start)
+		w.Header().Set("Content-Type", mediaType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		w.WriteHeader(200)
+		return
+	}
+	if r.Method == "GET" && strings.Contains(endpoint, "/manifests/") {
+		ref := manifestReference(endpoint)
+		if short := shortManifestReference(endpoint); ref == "" && short != "" && reg.config.AllowShortDigests {
+			var ok bool
+			if ref, ok = reg.expandManifestDigest(w, name, short); !ok {
 				return
 			}
 		}
-	})
-	log.Fatal(http.ListenAndServe(":8080", nil))
+		if ref == "" {
+			writeOciError("MANIFEST_INVALID", "manifest invalid", w, 404)
+			return
+		}
+		start := time.Now()
+		manifestPath, err := resolveManifest(reg.rootDir, name, ref, reg.config.modes())
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		if manifestPath == "" {
+			reg.writeNotFound(w, name, "MANIFEST_UNKNOWN", "manifest unknown to registry")
+			return
+		}
+		// Non-standard: ?platform=os/arch pulls one platform out of an index.
+		manifestPath, err = selectPlatform(reg.rootDir, name, manifestPath, r.URL.Query().Get("platform"), reg.config.modes())
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		body, mediaType, err := readManifest(manifestPath, reg.config.manifestTypeDefaults())
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		timing.since("storage", start)
+		start = time.Now()
+		digest := getDigest(body)
+		timing.since("hash", start)
+		reg.notifier.manifest(r, "pull", name, ref, digest, mediaType, int64(len(body)))
+		if warning := pullWarning(body, reg.config.WarnAnnotation); warning != "" {
+			w.Header().Set("Warning", warning)
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Type", mediaType)
+		_, err = w.Write(body)
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		return
+	}
+	writeUnknownEndpoint(r, w)
+}
+
+// allowedMethods returns the methods served for endpoint, the path after the
+// repository name, for the Allow header of OPTIONS requests. It must be kept
+// in step with ServeHTTP, and is nil for an unknown endpoint.
+func (reg *registry) allowedMethods(endpoint string) []string {
+	var methods []string
+	switch {
+	case matches(blobEndpointRegex, endpoint):
+		methods = []string{"GET", "HEAD"}
+		if reg.config.AllowBlobDelete {
+			methods = append(methods, "DELETE")
+		}
+	case strings.HasSuffix(endpoint, "/blobs/uploads/"):
+		methods = []string{"POST"}
+	case strings.Contains(endpoint, "/blobs/uploads/"):
+		methods = []string{"GET", "PATCH", "PUT", "DELETE"}
+	case endpoint == "/tags/list":
+		// A tag named list can be checked with HEAD too.
+		methods = []string{"GET", "HEAD"}
+	case strings.HasPrefix(endpoint, "/tags/"):
+		methods = []string{"HEAD"}
+	case strings.Contains(endpoint, "/manifests/"):
+		methods = []string{"GET", "HEAD", "PUT"}
+		if reg.config.AllowManifestDelete {
+			methods = append(methods, "DELETE")
+		}
+	case strings.Contains(endpoint, "/referrers/"):
+		methods = []string{"GET"}
+	case strings.HasPrefix(endpoint, "/_export"), strings.HasPrefix(endpoint, "/_info"):
+		methods = []string{"GET"}
+	case strings.HasPrefix(endpoint, "/_import"):
+		methods = []string{"POST"}
+	case strings.HasPrefix(endpoint, "/_pin/"):
+		methods = []string{"POST", "DELETE"}
+	case strings.HasPrefix(endpoint, "/_move"):
+		if reg.config.AllowMove {
+			methods = []string{"POST"}
+		}
+	default:
+		return nil
+	}
+	return append(methods, "OPTIONS")
+}
+
+// uppercaseLetters returns the uppercase letters of s, each listed once.
+func uppercaseLetters(s string) string {
+	var found strings.Builder
+	for _, c := range s {
+		if unicode.IsUpper(c) && !strings.ContainsRune(found.String(), c) {
+			found.WriteRune(c)
+		}
+	}
+	return found.String()
+}
+
+// writeUnknownEndpoint answers requests that match no endpoint of the API.
+func writeUnknownEndpoint(r *http.Request, w http.ResponseWriter) {
+	writeOciErrorDetail("UNSUPPORTED", "unknown endpoint", map[string]string{"method": r.Method, "path": r.URL.Path}, w, 404)
+}
+
+// absoluteURL returns the URL of path p on the host a request was sent to.
+// When the request comes from a trusted proxy, the scheme and host it
+// reports in X-Forwarded-Proto and X-Forwarded-Host are used instead.
+func absoluteURL(r *http.Request, p string, trust proxyTrust) string {
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if trust.forwarded(r) {
+		if v, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ","); strings.TrimSpace(v) != "" {
+			scheme = strings.TrimSpace(v)
+		}
+		if v, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ","); strings.TrimSpace(v) != "" {
+			host = strings.TrimSpace(v)
+		}
+	}
+	return (&url.URL{Scheme: scheme, Host: host, Path: p}).String()
+}
+
+// paginate returns the page of names a list request asks for with the n,
+// last and prefix query parameters, setting a Link header to the next page
+// when there is one. It answers the request itself and returns false when n
+// is invalid.
+func paginate(w http.ResponseWriter, r *http.Request, names []string) ([]string, bool) {
+	q := r.URL.Query()
+	n := -1
+	if q.Has("n") {
+		var err error
+		if n, err = strconv.Atoi(q.Get("n")); err != nil || n < 0 {
+			writeOciError("PAGINATION_NUMBER_INVALID", "invalid number of results requested", w, 400)
+			return nil, false
+		}
+	}
+	page, more := pageNames(names, q.Get("prefix"), q.Get("last"), n)
+	if more {
+		// With n=0 the page is empty, and the next one starts where the
+		// client asked this one to.
+		next := url.Values{"n": {strconv.Itoa(n)}}
+		if len(page) > 0 {
+			next.Set("last", page[len(page)-1])
+		} else if q.Get("last") != "" {
+			next.Set("last", q.Get("last"))
+		}
+		if q.Get("prefix") != "" {
+			next.Set("prefix", q.Get("prefix"))
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+	return page, true
+}
+
+// pageNames returns the names starting with prefix that sort after last, at
+// most n of them unless n is negative, and whether more names follow.
+func pageNames(names []string, prefix string, last string, n int) ([]string, bool) {
+	sort.Strings(names)
+	page := make([]string, 0)
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) || (last != "" && name <= last) {
+			continue
+		}
+		if n >= 0 && len(page) == n {
+			return page, true
+		}
+		page = append(page, name)
+	}
+	return page, false
 }
 
 func getTags(path string) ([]string, error) {
@@ -282,7 +1114,7 @@ func getTags(path string) ([]string, error) {
 		return tags, err
 	}
 	for _, de := range files {
-		if de.Name() == "_blobs" {
+		if !isTagDir(path, "", de) {
 			continue
 		}
 		tags = append(tags, de.Name())
@@ -290,60 +1122,38 @@ func getTags(path string) ([]string, error) {
 	return tags, nil
 }
 
-func writeServerError(err error, w http.ResponseWriter) {
-	es := fmt.Sprintf("Unexpected error encountered: %s", err.Error())
-	http.Error(w, es, 500)
+// isTagDir reports whether a directory entry of a repository holds a tagged
+// manifest, as opposed to internal storage (prefixed with "_") or a nested
+// repository.
+func isTagDir(rootDir string, name string, de fs.DirEntry) bool {
+	if !de.IsDir() || strings.HasPrefix(de.Name(), "_") {
+		return false
+	}
+	b, err := fileExists(tagManifestPath(rootDir, name, de.Name()))
+	return err == nil && b
 }
 
-func writeBodyToFileWithLocation(destFile string, w http.ResponseWriter, r *http.Request, name string, digest string) {
-	writeBodyToFile(destFile, w, r)
-	if !validateBlob(destFile, r.ContentLength, digest) {
-		http.Error(w, "blob did not match length or digest", 400)
+// writeServerError answers with a 500 for a storage failure, or refuses the
+// request once the failure shows storage to be read-only.
+func (reg *registry) writeServerError(err error, w http.ResponseWriter) {
+	if reg.readOnly.check(err) {
+		writeReadOnly(w)
+		return
 	}
-	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
-	w.WriteHeader(201)
+	writeInternalError(err, w, reg.config.VerboseErrors)
 }
 
-func writeBodyToFile(destFile string, w http.ResponseWriter, r *http.Request) {
-	var f *os.File
-	if _, statE := os.Stat(destFile); os.IsNotExist(statE) {
-		innerF, err := os.OpenFile(destFile, os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			writeServerError(err, w)
-			return
-		}
-		f = innerF
-	} else {
-		innerF, err := os.OpenFile(destFile, os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			writeServerError(err, w)
-			return
-		}
-		err = os.Truncate(destFile, 0)
-		if err != nil {
-			writeServerError(err, w)
-			return
-		}
-		f = innerF
-	}
-	total := r.ContentLength
-	buf := make([]byte, 1024)
-	for {
-		n, err := r.Body.Read(buf)
-		_, err2 := f.Write(buf[0:n])
-		if err2 != nil {
-			log.Printf("Failed to write buffer to file: %s", err2)
-		}
-		if err == io.EOF {
-			break
-		}
-		total = total - int64(n)
-		if total > 0 {
-			for i := 0; i < 1024; i++ {
-				buf[i] = 0
-			}
-		}
+// writeInternalError answers with a 500 for err. By default clients only get
+// an ID to quote, since errors can reveal storage paths; the error is logged
+// under that ID. verbose, set with -verbose-errors, includes the error itself.
+func writeInternalError(err error, w http.ResponseWriter, verbose bool) {
+	id := uuid.Generate().String()
+	log.Printf("Internal error %s: %s", id, err)
+	detail := map[string]string{"id": id}
+	if verbose {
+		detail["error"] = err.Error()
 	}
+	writeOciErrorDetail("UNKNOWN", "internal server error", detail, w, 500)
 }
 
 func readFile(path string) (bytes.Buffer, error) {
@@ -352,6 +1162,7 @@ func readFile(path string) (bytes.Buffer, error) {
 	if err != nil {
 		return b, err
 	}
+	defer f.Close()
 	_, readE := b.ReadFrom(f)
 	if readE != nil {
 		return bytes.Buffer{}, readE
@@ -359,16 +1170,24 @@ func readFile(path string) (bytes.Buffer, error) {
 	return b, nil
 }
 
-func setupStorage() string {
-	dir, wdErr := os.Getwd()
-	if wdErr != nil {
-		log.Printf(wdErr.Error())
+// setupStorage resolves the storage root to an absolute path. A missing root
+// is created unless create is false, in which case it is an error.
+func setupStorage(root string, create bool, modes fileModes) (string, error) {
+	dir := root
+	if !path.IsAbs(dir) {
+		wd, wdErr := os.Getwd()
+		if wdErr != nil {
+			log.Printf(wdErr.Error())
+		}
+		dir = path.Join(wd, dir)
 	}
-	dir = path.Join(dir, "data")
 	_, readErr := os.ReadDir(dir)
 	if readErr != nil {
 		if errors.Is(readErr, fs.ErrNotExist) {
-			mkErr := os.MkdirAll(dir, 0755)
+			if !create {
+				return dir, fmt.Errorf("storage root %s does not exist", dir)
+			}
+			mkErr := makeDirs(dir, modes)
 			if mkErr != nil {
 				log.Printf(mkErr.Error())
 			}
@@ -376,7 +1195,7 @@ func setupStorage() string {
 			log.Printf(readErr.Error())
 		}
 	}
-	return dir
+	return dir, nil
 }
 
 func printInfo(r *http.Request) {
@@ -399,12 +1218,18 @@ func printInfo(r *http.Request) {
 }
 
 func writeOciError(code string, message string, w http.ResponseWriter, statusCode int) {
-	e := ErrorResponse{
-		Errors: []ErrorDetail{{
-			Code:    code,
-			Message: message,
-			Detail:  "{}",
-		}},
+	writeOciErrorDetail(code, message, "{}", w, statusCode)
+}
+
+func writeOciErrorDetail(code string, message string, detail interface{}, w http.ResponseWriter, statusCode int) {
+	writeOciErrors(ociErrors{{code, message, detail}}, w, statusCode)
+}
+
+// writeOciErrors reports several errors in one response.
+func writeOciErrors(errs ociErrors, w http.ResponseWriter, statusCode int) {
+	e := ErrorResponse{Errors: make([]ErrorDetail, 0, len(errs))}
+	for _, oe := range errs {
+		e.Errors = append(e.Errors, ErrorDetail{Code: oe.code, Message: oe.message, Detail: oe.detail})
 	}
 	out, err := json.Marshal(e)
 	if err != nil {
@@ -417,23 +1242,18 @@ func writeOciError(code string, message string, w http.ResponseWriter, statusCod
 func parseName(url string) (string, error) {
 	s := strings.TrimPrefix(url, "/v2/")
 	paths := strings.Count(s, "/")
-	var name = ""
-	if paths <= 1 {
+	if paths == 0 {
 		return "", errors.New(fmt.Sprintf("URL does not match any valid OCI endpoint: %s", url))
 	}
-	if paths == 2 {
-		name = strings.Split(s, "/")[0]
-	} else {
-		parts := make([]string, 0)
-		for _, p := range strings.Split(s, "/") {
-			if p == "blobs" || p == "manifests" || p == "tags" || p == "referrers" {
-				break
-			}
-			parts = append(parts, p)
+	parts := make([]string, 0)
+	for _, p := range strings.Split(s, "/") {
+		// Extension endpoints start with "_", which is never valid in a name.
+		if p == "blobs" || p == "manifests" || p == "tags" || p == "referrers" || strings.HasPrefix(p, "_") {
+			break
 		}
-		name = strings.Join(parts, "/")
+		parts = append(parts, p)
 	}
-	return name, nil
+	return strings.Join(parts, "/"), nil
 }
 
 func matches(pattern string, name string) bool {
@@ -445,7 +1265,7 @@ func matches(pattern string, name string) bool {
 }
 
 func fileExists(path string) (bool, error) {
-	_, err := os.Open(path)
+	_, err := os.Stat(path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return false, nil
@@ -459,24 +1279,19 @@ func fileExists(path string) (bool, error) {
 func findManifest(rootDir string, name string, digest string) (string, error) {
 	files, err := os.ReadDir(path.Join(rootDir, name))
 	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
 		return "", err
 	}
 	for _, de := range files {
-		if de.Name() == "_blobs" {
-			continue
-		}
-		if de.IsDir() {
-			manifestPath := path.Join(rootDir, name, de.Name(), "manifest.json")
-			f, fE := os.Open(manifestPath)
-			if fE != nil {
-				return "", fE
-			}
-			var buf bytes.Buffer
-			_, err := buf.ReadFrom(f)
+		if isTagDir(rootDir, name, de) {
+			manifestPath := tagManifestPath(rootDir, name, de.Name())
+			buf, err := readFile(manifestPath)
 			if err != nil {
 				return "", err
 			}
-			thisDigest := getDigest(buf.Bytes())
+			thisDigest := digestAs(digest, buf.Bytes())
 			if thisDigest == digest {
 				return manifestPath, nil
 			}
@@ -496,5 +1311,5 @@ func validateBlob(filePath string, fileLen int64, digest string) bool {
 		log.Print(e)
 		return false
 	}
-	return getDigest(b.Bytes()) == digest
+	return digestAs(digest, b.Bytes()) == digest
 }
@@ -1,10 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path"
 	"strings"
 	"testing"
 )
 
+func putTestBlob(t *testing.T, rootDir string, name string, content []byte) string {
+	t.Helper()
+	digest := getDigest(content)
+	p := blobPath(rootDir, defaultLayout, name, digest)
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
 func TestParseNameConformance(t *testing.T) {
 	cases := []string{
 		"/v2/test/image/manifests/tagtest0",
@@ -52,3 +74,296 @@ func TestMatchInvalidRef(t *testing.T) {
 		t.Errorf("Wanted false, got true: %s != %s", refRegex, "sha256:totallywrong")
 	}
 }
+
+func TestHeadBlobAcceptRanges(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	digest := putTestBlob(t, reg.rootDir, "test/image", []byte("layer"))
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("HEAD", "/v2/test/image/blobs/"+digest, nil))
+	if w.Code != 200 {
+		t.Fatalf("want 200, got %d", w.Code)
+	}
+	if got := w.Header().Get("Accept-Ranges"); got != "bytes" {
+		t.Errorf("want Accept-Ranges bytes, got %q", got)
+	}
+}
+
+func TestHeadBlobSHA512(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	content := []byte("layer")
+	sum := sha512.Sum512(content)
+	digest := "sha512:" + hex.EncodeToString(sum[:])
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/test/image/blobs/uploads/some-id?digest="+digest, bytes.NewReader(content)))
+	if w.Code != 201 {
+		t.Fatalf("push: want 201, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, method := range []string{"HEAD", "GET"} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest(method, "/v2/test/image/blobs/"+digest, nil))
+		if w.Code != 200 || w.Header().Get("Docker-Content-Digest") != digest {
+			t.Errorf("%s: want 200 with the sha512 digest, got %d %q", method, w.Code, w.Header().Get("Docker-Content-Digest"))
+		}
+	}
+	unknown := sha512.Sum512([]byte("unknown"))
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("HEAD", "/v2/test/image/blobs/sha512:"+hex.EncodeToString(unknown[:]), nil))
+	if w.Code != 404 {
+		t.Errorf("unknown sha512 blob: want 404, got %d", w.Code)
+	}
+}
+
+func TestGetBlobRange(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	digest := putTestBlob(t, reg.rootDir, "test/image", []byte("0123456789"))
+	req := httptest.NewRequest("GET", "/v2/test/image/blobs/"+digest, nil)
+	req.Header.Set("Range", "bytes=4-")
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	if w.Code != 206 {
+		t.Fatalf("want 206, got %d", w.Code)
+	}
+	if got := w.Body.String(); got != "456789" {
+		t.Errorf("want 456789, got %q", got)
+	}
+	if got := w.Header().Get("Accept-Ranges"); got != "bytes" {
+		t.Errorf("want Accept-Ranges bytes, got %q", got)
+	}
+}
+
+func TestGetBlobIfNoneMatch(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	digest := putTestBlob(t, reg.rootDir, "test/image", []byte("layer"))
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/blobs/"+digest, nil))
+	etag := w.Header().Get("ETag")
+	if etag != `"`+digest+`"` {
+		t.Fatalf("want the digest as ETag, got %q", etag)
+	}
+
+	req := httptest.NewRequest("GET", "/v2/test/image/blobs/"+digest, nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	if w.Code != 304 {
+		t.Fatalf("want 304, got %d", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("want no body, got %q", w.Body.String())
+	}
+}
+
+func TestParseNameExtension(t *testing.T) {
+	name, err := parseName("/v2/test/image/_export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "test/image" {
+		t.Errorf("want test/image, got %s", name)
+	}
+}
+
+func TestSetupStorageNoCreate(t *testing.T) {
+	missing := path.Join(t.TempDir(), "missing")
+	if _, err := setupStorage(missing, false, defaultModes); err == nil {
+		t.Fatal("want an error for a missing root")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("missing root must not be created")
+	}
+
+	dir, err := setupStorage(missing, true, defaultModes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("want root created by default: %s", err)
+	}
+}
+
+func TestUnknownEndpoint(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	for _, url := range []string{"/v2/foo/bar/baz", "/v2/foo"} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != 404 {
+			t.Errorf("GET %s: want 404, got %d", url, w.Code)
+		}
+		var er ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &er); err != nil {
+			t.Fatalf("GET %s: %s", url, err)
+		}
+		if len(er.Errors) != 1 || er.Errors[0].Code != "UNSUPPORTED" {
+			t.Errorf("GET %s: unexpected error body %s", url, w.Body.String())
+		}
+	}
+}
+
+func TestTagListPrefix(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	for _, tag := range []string{"latest", "v1.0", "v1.1", "v1.2", "v2.0"} {
+		putTestManifest(t, reg, "test/image", tag, []byte(testManifest))
+	}
+	list := func(query string) (TagList, string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/tags/list"+query, nil))
+		if w.Code != 200 {
+			t.Fatalf("GET tags/list%s: want 200, got %d", query, w.Code)
+		}
+		var tl TagList
+		if err := json.Unmarshal(w.Body.Bytes(), &tl); err != nil {
+			t.Fatal(err)
+		}
+		return tl, w.Header().Get("Link")
+	}
+
+	tl, link := list("?prefix=v1.")
+	if strings.Join(tl.TagList, ",") != "v1.0,v1.1,v1.2" || link != "" {
+		t.Errorf("want the v1. tags without a next page, got %v and %q", tl.TagList, link)
+	}
+	tl, link = list("?prefix=v1.&n=2")
+	if strings.Join(tl.TagList, ",") != "v1.0,v1.1" {
+		t.Errorf("want the first page of v1. tags, got %v", tl.TagList)
+	}
+	if want := `</v2/test/image/tags/list?last=v1.1&n=2&prefix=v1.>; rel="next"`; link != want {
+		t.Errorf("want Link %s, got %q", want, link)
+	}
+	tl, _ = list("?prefix=v1.&n=2&last=v1.1")
+	if strings.Join(tl.TagList, ",") != "v1.2" {
+		t.Errorf("want the second page of v1. tags, got %v", tl.TagList)
+	}
+}
+
+func TestPaginateZeroAndNegative(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	for _, name := range []string{"test/a", "test/b"} {
+		putTestManifest(t, reg, name, "v1", []byte(testManifest))
+	}
+	for _, c := range []struct {
+		path, body, link string
+	}{
+		{"/v2/test/a/tags/list?n=0", `"tags":[]`, `</v2/test/a/tags/list?n=0>; rel="next"`},
+		{"/v2/_catalog?n=0", `"repositories":[]`, `</v2/_catalog?n=0>; rel="next"`},
+		{"/v2/_catalog?n=0&last=test%2Fa", `"repositories":[]`, `</v2/_catalog?last=test%2Fa&n=0>; rel="next"`},
+		{"/v2/_catalog?n=0&last=test%2Fb", `"repositories":[]`, ""},
+	} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("GET", c.path, nil))
+		if w.Code != 200 || !strings.Contains(w.Body.String(), c.body) || w.Header().Get("Link") != c.link {
+			t.Errorf("GET %s: want 200 with %s and Link %q, got %d %s %q", c.path, c.body, c.link, w.Code, w.Body.String(), w.Header().Get("Link"))
+		}
+	}
+	for _, p := range []string{"/v2/test/a/tags/list?n=-1", "/v2/_catalog?n=-1"} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+		if w.Code != 400 || !strings.Contains(w.Body.String(), "PAGINATION_NUMBER_INVALID") {
+			t.Errorf("GET %s: want 400 PAGINATION_NUMBER_INVALID, got %d %s", p, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestUppercaseName(t *testing.T) {
+	content := []byte("layer")
+	reg := &registry{rootDir: t.TempDir(), config: Config{NameCase: "strict"}}
+	w := putTestBlobRequest(reg, "Test/MyImage", content)
+	if w.Code != 400 {
+		t.Fatalf("strict: want 400, got %d", w.Code)
+	}
+	var er ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &er); err != nil {
+		t.Fatal(err)
+	}
+	if len(er.Errors) != 1 || er.Errors[0].Code != "NAME_INVALID" || !strings.Contains(er.Errors[0].Detail.(string), `"TMI"`) {
+		t.Errorf("strict: want NAME_INVALID naming the uppercase letters, got %s", w.Body.String())
+	}
+
+	reg = &registry{rootDir: t.TempDir(), config: Config{NameCase: "lower"}}
+	if w := putTestBlobRequest(reg, "Test/MyImage", content); w.Code != 201 {
+		t.Fatalf("lower: want 201, got %d", w.Code)
+	}
+	if found, _ := blobExists(reg.rootDir, reg.config.layout(), "test/myimage", getDigest(content)); !found {
+		t.Error("lower: want the blob stored under the lowercased name")
+	}
+}
+
+func TestOptionsAllow(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	for _, c := range []struct {
+		path, allow string
+		deletes     bool
+	}{
+		{"/v2/test/image/manifests/latest", "GET, HEAD, PUT, OPTIONS", false},
+		{"/v2/test/image/manifests/latest", "GET, HEAD, PUT, DELETE, OPTIONS", true},
+		{"/v2/test/image/blobs/" + emptyJSONDigest, "GET, HEAD, OPTIONS", false},
+		{"/v2/test/image/blobs/uploads/", "POST, OPTIONS", false},
+		{"/v2/test/image/blobs/uploads/some-id", "GET, PATCH, PUT, DELETE, OPTIONS", false},
+		{"/v2/test/image/tags/list?n=1", "GET, HEAD, OPTIONS", false},
+		{"/v2/test/image/tags/v1", "HEAD, OPTIONS", false},
+		{"/v2/", "GET, OPTIONS", false},
+	} {
+		reg.config.AllowManifestDelete = c.deletes
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("OPTIONS", c.path, nil))
+		if w.Code != 200 || w.Header().Get("Allow") != c.allow {
+			t.Errorf("OPTIONS %s: want 200 with Allow %q, got %d %q", c.path, c.allow, w.Code, w.Header().Get("Allow"))
+		}
+	}
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/v2/test/image/unknown", nil))
+	if w.Code != 404 {
+		t.Errorf("OPTIONS on an unknown endpoint: want 404, got %d", w.Code)
+	}
+}
+
+func TestServerErrorHidesDetail(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	putTestManifest(t, reg, "test/image", "v1", []byte(testManifest))
+	defer func(orig func(string) ([]os.DirEntry, error)) { readDir = orig }(readDir)
+	readDir = func(p string) ([]os.DirEntry, error) {
+		return nil, &fs.PathError{Op: "open", Path: p, Err: fs.ErrPermission}
+	}
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+
+	for _, verbose := range []bool{false, true} {
+		reg.config.VerboseErrors = verbose
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/manifests/v2", nil))
+		var resp ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); w.Code != 500 || err != nil {
+			t.Fatalf("want a 500 error response, got %d %q", w.Code, w.Body.String())
+		}
+		detail := resp.Errors[0].Detail.(map[string]interface{})
+		id, _ := detail["id"].(string)
+		if id == "" || !strings.Contains(logs.String(), id) {
+			t.Errorf("want an ID that is logged, got %q with logs %q", id, logs.String())
+		}
+		if leaked := strings.Contains(w.Body.String(), reg.rootDir); leaked != verbose {
+			t.Errorf("verbose %v: storage path in the response is %v: %s", verbose, leaked, w.Body.String())
+		}
+	}
+}
+
+func TestHeadTag(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	body := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", "v1", body)
+	for _, c := range []struct {
+		path   string
+		code   int
+		digest string
+	}{
+		{"/v2/test/image/tags/v1", 200, getDigest(body)},
+		{"/v2/test/image/tags/v2", 404, ""},
+		{"/v2/test/other/tags/v1", 404, ""},
+		{"/v2/test/image/tags/-v1", 400, ""},
+	} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("HEAD", c.path, nil))
+		if w.Code != c.code || w.Header().Get("Docker-Content-Digest") != c.digest {
+			t.Errorf("HEAD %s: want %d with digest %q, got %d %q", c.path, c.code, c.digest, w.Code, w.Header().Get("Docker-Content-Digest"))
+		}
+	}
+}
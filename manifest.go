@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeArtifactManifest   = "application/vnd.oci.artifact.manifest.v1+json"
+
+	// emptyJSONDigest is the digest of the well-known empty config blob "{}"
+	// used by artifact manifests. It is always considered present.
+	emptyJSONDigest = "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+)
+
+var emptyJSON = []byte("{}")
+
+// tagManifestPath returns where the manifest for a tag is stored.
+func tagManifestPath(rootDir string, name string, tag string) string {
+	return path.Join(rootDir, name, tag, "manifest.json")
+}
+
+// digestManifestPath returns where a manifest pushed by digest is stored.
+// digest must already be validated against digestRegex.
+func digestManifestPath(rootDir string, name string, digest string) string {
+	alg, hex, _ := strings.Cut(digest, ":")
+	return path.Join(rootDir, name, "_manifests", alg, hex, "manifest.json")
+}
+
+// manifestReference returns the tag or digest that a /manifests/<reference>
+// endpoint refers to, or "" unless it is exactly one valid reference segment.
+// Any query string is ignored.
+func manifestReference(endpoint string) string {
+	_, ref, _ := strings.Cut(endpoint, "/manifests/")
+	ref, _, _ = strings.Cut(ref, "?")
+	if !matches(refRegex, ref) && !matches(digestRegex, ref) {
+		return ""
+	}
+	return ref
+}
+
+// shortManifestReference returns the short digest a /manifests/<reference>
+// endpoint refers to, or "" when the reference is not one.
+func shortManifestReference(endpoint string) string {
+	_, ref, _ := strings.Cut(endpoint, "/manifests/")
+	ref, _, _ = strings.Cut(ref, "?")
+	if !matches(shortDigestRegex, ref) {
+		return ""
+	}
+	return ref
+}
+
+// resolveManifest finds the stored manifest for a tag or digest reference.
+// Tags resolve only to their tag directory. Digests are looked up in the
+// digest store first, then in the repository index and finally among the
+// manifests of every tag. An empty path with a nil error means the manifest
+// is not known to the registry.
+func resolveManifest(rootDir string, name string, ref string, modes fileModes) (string, error) {
+	if matches(digestRegex, ref) {
+		p := digestManifestPath(rootDir, name, ref)
+		found, err := fileExists(p)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			return p, nil
+		}
+		if digestAlgorithm(ref) != "sha256" {
+			// The index only records sha256 digests.
+			return findManifest(rootDir, name, ref)
+		}
+		p, err = lookupIndex(rootDir, name, ref)
+		if err != nil || p != "" {
+			return p, err
+		}
+		// The index is missing or stale: fall back to a scan and rebuild it.
+		p, err = findManifest(rootDir, name, ref)
+		if err != nil || p == "" {
+			return p, err
+		}
+		return p, rebuildIndex(rootDir, name, modes)
+	}
+	p := tagManifestPath(rootDir, name, ref)
+	found, err := fileExists(p)
+	if err != nil || !found {
+		return "", err
+	}
+	return p, nil
+}
+
+// selectPlatform narrows a pull of an image index to one platform. When
+// platform, given as os/arch or os/arch/variant, is set and the manifest at
+// manifestPath is an index listing a stored manifest for that platform, the
+// path of that manifest is returned. Otherwise manifestPath is returned as is.
+func selectPlatform(rootDir string, name string, manifestPath string, platform string, modes fileModes) (string, error) {
+	if platform == "" {
+		return manifestPath, nil
+	}
+	b, err := os.ReadFile(manifestPath)
+	if err != nil || !isImageIndex(b) {
+		return manifestPath, err
+	}
+	var idx v1.Index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return manifestPath, nil
+	}
+	parts := strings.SplitN(platform, "/", 3)
+	for _, desc := range idx.Manifests {
+		p := desc.Platform
+		if p == nil || len(parts) < 2 || p.OS != parts[0] || p.Architecture != parts[1] {
+			continue
+		}
+		if len(parts) == 3 && p.Variant != parts[2] {
+			continue
+		}
+		if !matches(digestRegex, string(desc.Digest)) {
+			continue
+		}
+		child, err := resolveManifest(rootDir, name, string(desc.Digest), modes)
+		if err != nil {
+			return manifestPath, err
+		}
+		if child != "" {
+			return child, nil
+		}
+	}
+	return manifestPath, nil
+}
+
+// checkIndexDepth rejects an image index that nests more than max levels of
+// indexes, so a hostile chain of indexes cannot make walking it unbounded.
+// Children are read with load, which returns nil for manifests that are not
+// available; those are not followed.
+func checkIndexDepth(body []byte, max int, load func(digest string) ([]byte, error)) error {
+	// passed records the fewest remaining levels each index was accepted
+	// with, so shared children are not walked again at the same depth.
+	passed := make(map[string]int)
+	var check func(body []byte, remaining int) error
+	check = func(body []byte, remaining int) error {
+		if !isImageIndex(body) {
+			return nil
+		}
+		if remaining == 0 {
+			return &ociError{"MANIFEST_INVALID", "manifest invalid", fmt.Sprintf("image indexes nested more than %d deep", max)}
+		}
+		var idx v1.Index
+		if err := json.Unmarshal(body, &idx); err != nil {
+			return &ociError{"MANIFEST_INVALID", "manifest invalid", err.Error()}
+		}
+		for _, desc := range idx.Manifests {
+			d := string(desc.Digest)
+			if r, ok := passed[d]; ok && r <= remaining-1 {
+				continue
+			}
+			b, err := load(d)
+			if err != nil {
+				return err
+			}
+			if b == nil {
+				continue
+			}
+			if err := check(b, remaining-1); err != nil {
+				return err
+			}
+			passed[d] = remaining - 1
+		}
+		return nil
+	}
+	return check(body, max)
+}
+
+// checkIndexSize rejects an image index listing more than max manifests, so
+// that a hostile index cannot exhaust memory while it is walked. Manifests
+// that are not indexes pass.
+func checkIndexSize(body []byte, max int) error {
+	if !isImageIndex(body) {
+		return nil
+	}
+	var idx struct {
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(body, &idx); err != nil {
+		return &ociError{"MANIFEST_INVALID", "manifest invalid", err.Error()}
+	}
+	if len(idx.Manifests) > max {
+		return &ociError{"MANIFEST_INVALID", "manifest invalid", fmt.Sprintf("image index lists %d manifests, more than %d", len(idx.Manifests), max)}
+	}
+	return nil
+}
+
+// loadStoredManifest returns a manifest of the repository by digest, or nil
+// when it is not stored.
+func loadStoredManifest(rootDir string, name string, digest string, modes fileModes) ([]byte, error) {
+	if !matches(digestRegex, digest) {
+		return nil, nil
+	}
+	p, err := resolveManifest(rootDir, name, digest, modes)
+	if err != nil || p == "" {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+// validateManifest checks that the config and layers of an image manifest are
+// present in the repository. Problems with the manifest itself are returned
+// together as ociErrors, so that a client can fix them all at once; any other
+// error is a storage failure.
+func validateManifest(rootDir string, layout *pathTemplate, name string, body []byte) error {
+	var m v1.Manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return ociErrors{{"MANIFEST_INVALID", "manifest invalid", err.Error()}}
+	}
+	if m.MediaType != "" && m.MediaType != v1.MediaTypeImageManifest && m.MediaType != mediaTypeDockerManifest {
+		return nil
+	}
+	var problems ociErrors
+	check := func(d string, what string) error {
+		if !matches(digestRegex, d) {
+			problems = append(problems, &ociError{"MANIFEST_INVALID", "manifest invalid", "invalid " + what + " digest"})
+			return nil
+		}
+		found, err := blobExists(rootDir, layout, name, d)
+		if err == nil && !found {
+			problems = append(problems, &ociError{"MANIFEST_BLOB_UNKNOWN", what + " blob unknown to registry", map[string]string{"digest": d}})
+		}
+		return err
+	}
+	if err := check(string(m.Config.Digest), "config"); err != nil {
+		return err
+	}
+	for _, layer := range m.Layers {
+		if err := check(string(layer.Digest), "layer"); err != nil {
+			return err
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// listDigestManifests returns the digest of every manifest pushed by digest.
+func listDigestManifests(rootDir string, name string) ([]string, error) {
+	digests := make([]string, 0)
+	algs, err := os.ReadDir(path.Join(rootDir, name, "_manifests"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return digests, nil
+		}
+		return digests, err
+	}
+	for _, alg := range algs {
+		files, err := os.ReadDir(path.Join(rootDir, name, "_manifests", alg.Name()))
+		if err != nil {
+			return digests, err
+		}
+		for _, de := range files {
+			digest := alg.Name() + ":" + de.Name()
+			if matches(digestRegex, digest) {
+				digests = append(digests, digest)
+			}
+		}
+	}
+	return digests, nil
+}
+
+// isImageIndex reports whether a manifest is an OCI image index or a Docker
+// manifest list.
+func isImageIndex(body []byte) bool {
+	mt := manifestMediaType(body)
+	return mt == v1.MediaTypeImageIndex || mt == mediaTypeDockerManifestList
+}
+
+// mediaTypePath returns where the media types a manifest was pushed with are
+// kept, next to the manifest itself.
+func mediaTypePath(manifestPath string) string {
+	return path.Join(path.Dir(manifestPath), "mediatype")
+}
+
+// loadMediaTypes returns the media types recorded next to a manifest by
+// digest of the manifest they were pushed with. Registries before the record
+// was keyed kept a single media type, which is returned under the digest of
+// the manifest stored at manifestPath.
+func loadMediaTypes(manifestPath string) (map[string]string, error) {
+	b, err := os.ReadFile(mediaTypePath(manifestPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[string]string)
+	if bytes.HasPrefix(b, []byte("{")) {
+		return types, json.Unmarshal(b, &types)
+	}
+	body, err := os.ReadFile(manifestPath)
+	if err == nil && len(b) > 0 {
+		types[getDigest(body)] = string(b)
+	}
+	return types, nil
+}
+
+// writeMediaType records the Content-Type body was pushed with, so it is
+// served back unchanged. It must be called before body replaces the manifest
+// at manifestPath: the record keeps the media type of the manifest being
+// replaced too, so a concurrent pull of either gets the type that belongs to
+// it. Without a media type, only that of the manifest being replaced is kept.
+func writeMediaType(manifestPath string, body []byte, mediaType string, modes fileModes) error {
+	old, err := loadMediaTypes(manifestPath)
+	if err != nil {
+		return err
+	}
+	types := make(map[string]string)
+	if current, err := os.ReadFile(manifestPath); err == nil {
+		if t, ok := old[getDigest(current)]; ok {
+			types[getDigest(current)] = t
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if mediaType != "" {
+		types[getDigest(body)] = mediaType
+	} else {
+		delete(types, getDigest(body))
+	}
+	if len(types) == 0 {
+		err := os.Remove(mediaTypePath(manifestPath))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	b, err := json.Marshal(types)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(mediaTypePath(manifestPath), b, modes, false)
+}
+
+// dockerManifestTypes serves manifests that declare no media type as Docker
+// manifests and manifest lists.
+var dockerManifestTypes = map[string]string{
+	v1.MediaTypeImageManifest: mediaTypeDockerManifest,
+	v1.MediaTypeImageIndex:    mediaTypeDockerManifestList,
+}
+
+// readManifest reads a stored manifest along with the media type to serve it
+// with. When the manifest is replaced between reading it and its media types,
+// which then no longer record its own, it is read again. defaults are as for
+// declaredMediaType.
+func readManifest(manifestPath string, defaults map[string]string) ([]byte, string, error) {
+	for attempt := 1; ; attempt++ {
+		body, err := os.ReadFile(manifestPath)
+		if err != nil {
+			return nil, "", err
+		}
+		types, err := loadMediaTypes(manifestPath)
+		if err != nil {
+			return nil, "", err
+		}
+		if mediaType, ok := types[getDigest(body)]; ok || len(types) == 0 || attempt == 3 {
+			if !ok {
+				mediaType = declaredMediaType(body, defaults)
+			}
+			return body, mediaType, nil
+		}
+	}
+}
+
+// storedMediaType returns the media type to serve a manifest with: the one
+// it was pushed with, or else the one it declares. Legacy manifests with
+// neither are served with the default of -default-manifest-media-type, given
+// as defaults.
+func storedMediaType(manifestPath string, body []byte, defaults map[string]string) string {
+	if types, err := loadMediaTypes(manifestPath); err == nil && types[getDigest(body)] != "" {
+		return types[getDigest(body)]
+	}
+	return declaredMediaType(body, defaults)
+}
+
+// declaredMediaType is storedMediaType for a manifest pushed without a
+// Content-Type. defaults maps the OCI media types assumed for a manifest that
+// declares none to the ones it is served with.
+func declaredMediaType(body []byte, defaults map[string]string) string {
+	mediaType := manifestMediaType(body)
+	var m struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(body, &m); err == nil && m.MediaType != "" {
+		return mediaType
+	}
+	if d, ok := defaults[mediaType]; ok {
+		return d
+	}
+	return mediaType
+}
+
+// pushedMediaType returns the media type a manifest is pushed as: its
+// Content-Type without parameters, or else the type sniffed from the
+// manifest. It returns "" when a manifest without a Content-Type is not
+// recognised.
+func pushedMediaType(r *http.Request, body []byte) string {
+	mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	if mediaType = strings.TrimSpace(mediaType); mediaType != "" {
+		return mediaType
+	}
+	return sniffMediaType(body)
+}
+
+// sniffMediaType infers the media type of a manifest pushed without a
+// Content-Type. A declared mediaType wins; otherwise a list of manifests
+// makes an image index, a config with layers an image manifest and an
+// artifactType an artifact manifest. It returns "" for anything else.
+func sniffMediaType(body []byte) string {
+	var m struct {
+		MediaType    string          `json:"mediaType"`
+		Manifests    json.RawMessage `json:"manifests"`
+		Config       json.RawMessage `json:"config"`
+		Layers       json.RawMessage `json:"layers"`
+		ArtifactType string          `json:"artifactType"`
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return ""
+	}
+	switch {
+	case m.MediaType != "":
+		return m.MediaType
+	case m.Manifests != nil:
+		return v1.MediaTypeImageIndex
+	case m.Config != nil && m.Layers != nil:
+		return v1.MediaTypeImageManifest
+	case m.ArtifactType != "":
+		return mediaTypeArtifactManifest
+	}
+	return ""
+}
+
+// manifestMediaType returns the media type declared in a manifest. Without
+// one, a manifest listing other manifests is taken to be an OCI image index
+// and anything else an OCI image manifest.
+func manifestMediaType(body []byte) string {
+	var m struct {
+		MediaType string          `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return v1.MediaTypeImageManifest
+	}
+	if m.MediaType != "" {
+		return m.MediaType
+	}
+	if m.Manifests != nil {
+		return v1.MediaTypeImageIndex
+	}
+	return v1.MediaTypeImageManifest
+}
+
+// tagLatest tags a manifest pushed by digest as latest, unless the repository
+// already has a latest tag, which is never moved. It reports whether the tag
+// was created.
+func (reg *registry) tagLatest(name string, body []byte, mediaType string) (bool, error) {
+	unlock := reg.manifests.lock(name + ":latest")
+	defer unlock()
+	p := tagManifestPath(reg.rootDir, name, "latest")
+	exists, err := fileExists(p)
+	if err != nil || exists {
+		return false, err
+	}
+	if err := makeDirs(path.Dir(p), reg.config.modes()); err != nil {
+		return false, err
+	}
+	if err := writeMediaType(p, body, mediaType, reg.config.modes()); err != nil {
+		return false, err
+	}
+	if err := writeFileAtomic(p, body, reg.config.modes(), reg.config.Fsync); err != nil {
+		return false, err
+	}
+	reg.usage.add(int64(len(body)))
+	return true, indexTag(reg.rootDir, name, "latest", getDigest(body), reg.config.modes())
+}
+
+// pullWarning returns the Warning header for a pull of a manifest whose
+// annotation key is "true", flagging it for teams to migrate away from, or
+// "" when there is nothing to warn about.
+func pullWarning(body []byte, key string) string {
+	if key == "" {
+		return ""
+	}
+	var m struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(body, &m); err != nil || m.Annotations[key] != "true" {
+		return ""
+	}
+	return fmt.Sprintf(`299 - "manifest is annotated %s=true"`, key)
+}
+
+// verifyStored reads a manifest back from the temporary file it is written
+// to during a push and fails unless it holds exactly the pushed bytes, before
+// it replaces a stored manifest. Manifests are never reformatted, so their
+// digest is that of what the client sent.
+func verifyStored(tmp string, body []byte) error {
+	stored, err := os.ReadFile(tmp)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(stored, body) {
+		return fmt.Errorf("manifest was not stored verbatim: %s instead of %s", getDigest(stored), getDigest(body))
+	}
+	return nil
+}
@@ -0,0 +1,710 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const testManifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`
+
+func putTestManifest(t *testing.T, reg *registry, name string, ref string, body []byte) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/v2/"+name+"/manifests/"+ref, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+	reg.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Fatalf("push of %s:%s failed with %d: %s", name, ref, w.Code, w.Body.String())
+	}
+}
+
+func getTestManifest(reg *registry, name string, ref string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/"+name+"/manifests/"+ref, nil))
+	return w
+}
+
+func TestResolveManifestTagOnly(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	body := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", "v1", body)
+
+	for _, ref := range []string{"v1", getDigest(body)} {
+		w := getTestManifest(reg, "test/image", ref)
+		if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), body) {
+			t.Errorf("GET %s: want 200 with manifest, got %d %q", ref, w.Code, w.Body.String())
+		}
+	}
+	if w := getTestManifest(reg, "test/image", "latest"); w.Code != 404 {
+		t.Errorf("GET latest: want 404, got %d", w.Code)
+	}
+}
+
+func TestResolveManifestDigestOnly(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	body := []byte(testManifest)
+	digest := getDigest(body)
+	putTestManifest(t, reg, "test/image", digest, body)
+
+	w := getTestManifest(reg, "test/image", digest)
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), body) {
+		t.Errorf("GET by digest: want 200 with manifest, got %d %q", w.Code, w.Body.String())
+	}
+	w = getTestManifest(reg, "test/image", "latest")
+	if w.Code != 404 {
+		t.Errorf("GET latest: want 404, got %d", w.Code)
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte("MANIFEST_UNKNOWN")) {
+		t.Errorf("want MANIFEST_UNKNOWN, got %q", w.Body.String())
+	}
+	tags, err := getTags(reg.rootDir + "/test/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 0 {
+		t.Errorf("digest store must not show up as tags, got %v", tags)
+	}
+}
+
+func TestResolveManifestTagAndDigest(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	body := []byte(testManifest)
+	digest := getDigest(body)
+	putTestManifest(t, reg, "test/image", digest, body)
+	putTestManifest(t, reg, "test/image", "v1", body)
+
+	p, err := resolveManifest(reg.rootDir, "test/image", digest, reg.config.modes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != digestManifestPath(reg.rootDir, "test/image", digest) {
+		t.Errorf("want digest store to be preferred, got %s", p)
+	}
+	p, err = resolveManifest(reg.rootDir, "test/image", "v1", reg.config.modes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != tagManifestPath(reg.rootDir, "test/image", "v1") {
+		t.Errorf("want tag path, got %s", p)
+	}
+}
+
+func imageManifest(config string, layers ...string) []byte {
+	m := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageManifest,
+		"config":        map[string]interface{}{"mediaType": v1.MediaTypeImageConfig, "digest": config, "size": 2},
+	}
+	descs := make([]map[string]interface{}, 0)
+	for _, l := range layers {
+		descs = append(descs, map[string]interface{}{"mediaType": v1.MediaTypeImageLayerGzip, "digest": l, "size": 1})
+	}
+	m["layers"] = descs
+	b, _ := json.Marshal(m)
+	return b
+}
+
+func TestPutManifestMissingConfig(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{StrictManifests: true}}
+	layer := putTestBlob(t, reg.rootDir, "test/image", []byte("layer"))
+	config := getDigest([]byte("never uploaded"))
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/test/image/manifests/v1", bytes.NewReader(imageManifest(config, layer))))
+	if w.Code != 400 {
+		t.Fatalf("want 400, got %d", w.Code)
+	}
+	var er ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &er); err != nil {
+		t.Fatal(err)
+	}
+	e := er.Errors[0]
+	if e.Code != "MANIFEST_BLOB_UNKNOWN" || e.Message != "config blob unknown to registry" {
+		t.Errorf("unexpected error %+v", e)
+	}
+	if detail, ok := e.Detail.(map[string]interface{}); !ok || detail["digest"] != config {
+		t.Errorf("want missing config digest in detail, got %v", e.Detail)
+	}
+}
+
+func TestPutManifestMissingLayer(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{StrictManifests: true}}
+	config := putTestBlob(t, reg.rootDir, "test/image", []byte("{}"))
+	layer := getDigest([]byte("never uploaded"))
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/test/image/manifests/v1", bytes.NewReader(imageManifest(config, layer))))
+	if w.Code != 400 {
+		t.Fatalf("want 400, got %d", w.Code)
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte("layer blob unknown to registry")) {
+		t.Errorf("want missing layer error, got %q", w.Body.String())
+	}
+}
+
+func TestPutManifestReportsEveryProblem(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{StrictManifests: true, AllowedManifestTypes: stringList{v1.MediaTypeImageManifest}}}
+	config := getDigest([]byte("config never uploaded"))
+	layer := getDigest([]byte("layer never uploaded"))
+	for _, c := range []struct {
+		contentType string
+		status      int
+		want        []string
+	}{
+		{v1.MediaTypeImageManifest, 400, []string{"config blob unknown to registry", "layer blob unknown to registry"}},
+		{mediaTypeDockerManifest, 415, []string{"manifest media type not allowed", "config blob unknown to registry", "layer blob unknown to registry"}},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("PUT", "/v2/test/image/manifests/v1", bytes.NewReader(imageManifest(config, layer)))
+		req.Header.Set("Content-Type", c.contentType)
+		reg.ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Fatalf("%s: want %d, got %d", c.contentType, c.status, w.Code)
+		}
+		var er ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &er); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, 0, len(er.Errors))
+		for _, e := range er.Errors {
+			got = append(got, e.Message)
+		}
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("%s: want errors %q, got %q", c.contentType, c.want, got)
+		}
+	}
+}
+
+func TestPutIndexOverLimitsStopsEarly(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	image := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", getDigest(image), image)
+	inner := indexManifest(getDigest(image))
+	putTestManifest(t, reg, "test/image", getDigest(inner), inner)
+
+	// The outer index is both too large and too deep, but its children are
+	// never walked once its size is refused.
+	reg.config = Config{MaxIndexManifests: 1, MaxIndexDepth: 1, AllowedManifestTypes: stringList{v1.MediaTypeImageManifest}}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/v2/test/image/manifests/v1", bytes.NewReader(indexManifest(getDigest(inner), getDigest(image))))
+	req.Header.Set("Content-Type", v1.MediaTypeImageIndex)
+	reg.ServeHTTP(w, req)
+	if w.Code != 415 {
+		t.Fatalf("want 415, got %d: %s", w.Code, w.Body.String())
+	}
+	var er ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &er); err != nil {
+		t.Fatal(err)
+	}
+	if len(er.Errors) != 2 || er.Errors[0].Message != "manifest media type not allowed" || !strings.Contains(fmt.Sprint(er.Errors[1].Detail), "more than 1") {
+		t.Errorf("want the media type and size problems only, got %s", w.Body.String())
+	}
+}
+
+func TestPutArtifactWithEmptyConfig(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{StrictManifests: true}}
+	putTestManifest(t, reg, "test/artifact", "v1", imageManifest(emptyJSONDigest))
+
+	for _, method := range []string{"HEAD", "GET"} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest(method, "/v2/test/artifact/blobs/"+emptyJSONDigest, nil))
+		if w.Code != 200 {
+			t.Errorf("%s empty config: want 200, got %d", method, w.Code)
+		}
+		if method == "GET" && w.Body.String() != "{}" {
+			t.Errorf("want {}, got %q", w.Body.String())
+		}
+	}
+}
+
+func TestPutManifestWrongDigest(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	other := getDigest([]byte("something else"))
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/test/image/manifests/"+other, strings.NewReader(testManifest)))
+	if w.Code != 400 {
+		t.Fatalf("want 400, got %d", w.Code)
+	}
+	var er ErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&er); err != nil {
+		t.Fatal(err)
+	}
+	if len(er.Errors) != 1 || er.Errors[0].Code != "MANIFEST_INVALID" {
+		t.Errorf("unexpected error body: %+v", er)
+	}
+	if w := getTestManifest(reg, "test/image", other); w.Code != 404 {
+		t.Errorf("want the manifest not stored, got %d", w.Code)
+	}
+}
+
+func TestAllowedManifestTypes(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{AllowedManifestTypes: stringList{v1.MediaTypeImageManifest}}}
+	for contentType, want := range map[string]int{
+		v1.MediaTypeImageManifest: 201,
+		mediaTypeDockerManifest:   415,
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("PUT", "/v2/test/image/manifests/v1", strings.NewReader(testManifest))
+		req.Header.Set("Content-Type", contentType)
+		reg.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("%s: want %d, got %d", contentType, want, w.Code)
+		}
+	}
+}
+
+func TestSniffManifestMediaType(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	for body, want := range map[string]string{
+		`{"schemaVersion":2,"manifests":[]}`: v1.MediaTypeImageIndex,
+		`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"` + emptyJSONDigest + `","size":2},"layers":[]}`: v1.MediaTypeImageManifest,
+		`{"schemaVersion":2,"artifactType":"application/vnd.example.sbom","blobs":[]}`:                                                                  mediaTypeArtifactManifest,
+		`{"schemaVersion":2}`: "",
+	} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/test/image/manifests/"+getDigest([]byte(body)), strings.NewReader(body)))
+		if want == "" {
+			if w.Code != 400 || !strings.Contains(w.Body.String(), "MANIFEST_INVALID") {
+				t.Errorf("%s: want MANIFEST_INVALID, got %d: %s", body, w.Code, w.Body.String())
+			}
+			continue
+		}
+		if w.Code != 201 {
+			t.Fatalf("%s: want 201, got %d: %s", body, w.Code, w.Body.String())
+		}
+		if got := getTestManifest(reg, "test/image", getDigest([]byte(body))).Header().Get("Content-Type"); got != want {
+			t.Errorf("%s: want it served as %s, got %s", body, want, got)
+		}
+	}
+}
+
+func TestManifestDockerContentDigest(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	body := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", "v1", body)
+	sum := sha256.Sum256(body)
+	want := "sha256:" + hex.EncodeToString(sum[:])
+
+	for _, method := range []string{"HEAD", "GET"} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest(method, "/v2/test/image/manifests/v1", nil))
+		if w.Code != 200 {
+			t.Fatalf("%s: want 200, got %d", method, w.Code)
+		}
+		if got := w.Header().Get("Docker-Content-Digest"); got != want {
+			t.Errorf("%s: want digest %s, got %s", method, want, got)
+		}
+	}
+}
+
+func TestGetManifestInvalidReference(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	putTestManifest(t, reg, "test/image", "v1", []byte(testManifest))
+
+	for _, ref := range []string{"nested/v1", strings.Repeat("a", 200)} {
+		for _, method := range []string{"GET", "HEAD"} {
+			w := httptest.NewRecorder()
+			reg.ServeHTTP(w, httptest.NewRequest(method, "/v2/test/image/manifests/"+ref, nil))
+			if w.Code != 404 {
+				t.Errorf("%s %s: want 404, got %d", method, ref, w.Code)
+			}
+			if method == "GET" && !strings.Contains(w.Body.String(), "MANIFEST_INVALID") {
+				t.Errorf("%s %s: want MANIFEST_INVALID, got %s", method, ref, w.Body.String())
+			}
+		}
+	}
+}
+
+func indexManifest(manifests ...string) []byte {
+	descs := make([]map[string]interface{}, 0)
+	for _, m := range manifests {
+		descs = append(descs, map[string]interface{}{"mediaType": v1.MediaTypeImageIndex, "digest": m, "size": 1})
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageIndex,
+		"manifests":     descs,
+	})
+	return b
+}
+
+func TestPutIndexTooDeep(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{MaxIndexDepth: 2}}
+	image := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", getDigest(image), image)
+	inner := indexManifest(getDigest(image))
+	putTestManifest(t, reg, "test/image", getDigest(inner), inner)
+	middle := indexManifest(getDigest(inner))
+	putTestManifest(t, reg, "test/image", "v1", middle)
+
+	outer := indexManifest(getDigest(middle))
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/test/image/manifests/v2", bytes.NewReader(outer)))
+	if w.Code != 400 {
+		t.Fatalf("want 400 for an index nested 3 deep, got %d", w.Code)
+	}
+	var er ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &er); err != nil {
+		t.Fatal(err)
+	}
+	if len(er.Errors) != 1 || er.Errors[0].Code != "MANIFEST_INVALID" {
+		t.Errorf("unexpected error body: %s", w.Body.String())
+	}
+}
+
+func TestPutIndexTooLarge(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{MaxIndexManifests: 3}}
+	children := make([]string, 0)
+	for i := 0; i < 4; i++ {
+		children = append(children, getDigest([]byte(fmt.Sprint(i))))
+	}
+	putTestManifest(t, reg, "test/image", "v1", indexManifest(children[:3]...))
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/test/image/manifests/v2", bytes.NewReader(indexManifest(children...))))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), `"MANIFEST_INVALID"`) {
+		t.Errorf("want 400 MANIFEST_INVALID for an index of 4 manifests, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGetManifestBySha512(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	body := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", "v1", body)
+
+	sum := sha512.Sum512(body)
+	for _, ref := range []string{getDigest(body), "sha512:" + hex.EncodeToString(sum[:])} {
+		w := getTestManifest(reg, "test/image", ref)
+		if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), body) {
+			t.Errorf("GET %s: want 200 with manifest, got %d %q", ref, w.Code, w.Body.String())
+		}
+	}
+	unknown := sha512.Sum512([]byte("unknown"))
+	if w := getTestManifest(reg, "test/image", "sha512:"+hex.EncodeToString(unknown[:])); w.Code != 404 {
+		t.Errorf("want 404 for an unknown sha512 digest, got %d", w.Code)
+	}
+}
+
+func TestPullWarning(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{WarnAnnotation: "org.example.deprecated"}}
+	var m map[string]interface{}
+	_ = json.Unmarshal([]byte(testManifest), &m)
+	m["annotations"] = map[string]string{"org.example.deprecated": "true"}
+	flagged, _ := json.Marshal(m)
+	putTestManifest(t, reg, "test/image", "old", flagged)
+	putTestManifest(t, reg, "test/image", "new", []byte(testManifest))
+
+	w := getTestManifest(reg, "test/image", "old")
+	if w.Code != 200 || !strings.Contains(w.Header().Get("Warning"), "org.example.deprecated=true") {
+		t.Errorf("want 200 with a Warning, got %d %q", w.Code, w.Header().Get("Warning"))
+	}
+	if w := getTestManifest(reg, "test/image", "new"); w.Header().Get("Warning") != "" {
+		t.Errorf("want no Warning on an unflagged manifest, got %q", w.Header().Get("Warning"))
+	}
+	reg.config.WarnAnnotation = ""
+	if w := getTestManifest(reg, "test/image", "old"); w.Header().Get("Warning") != "" {
+		t.Errorf("want no Warning without -warn-annotation, got %q", w.Header().Get("Warning"))
+	}
+}
+
+func TestManifestStoredVerbatim(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{VerifyManifests: true}}
+	// Not canonical JSON: odd whitespace, key order and escaping must all
+	// survive, or the digest would change.
+	body := []byte("{\n  \"schemaVersion\" : 2,\t\"mediaType\":\"application/vnd.oci.image.manifest.v1+json\",\n" +
+		"  \"layers\": [], \"config\": {\"mediaType\": \"application/vnd.oci.empty.v1+json\", \"digest\": \"" + emptyJSONDigest + "\", \"size\": 2},\n" +
+		"  \"annotations\": {\"note\": \"caf\\u00e9\"}\n}\n")
+	putTestManifest(t, reg, "test/image", "v1", body)
+
+	for _, ref := range []string{"v1", getDigest(body)} {
+		w := getTestManifest(reg, "test/image", ref)
+		if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), body) {
+			t.Errorf("GET %s: want the pushed bytes back, got %d %q", ref, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Docker-Content-Digest"); got != getDigest(body) {
+			t.Errorf("GET %s: want digest %s, got %s", ref, getDigest(body), got)
+		}
+	}
+}
+
+func TestManifestNotStoredVerbatim(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{VerifyManifests: true, Fsync: true}}
+	putTestManifest(t, reg, "test/image", "v1", []byte(testManifest))
+
+	// A disk that corrupts what is written to it.
+	defer func(orig func(*os.File) error) { syncFile = orig }(syncFile)
+	syncFile = func(f *os.File) error {
+		if strings.HasPrefix(path.Base(f.Name()), "_tmp-") {
+			if _, err := f.WriteAt([]byte(" "), 0); err != nil {
+				return err
+			}
+		}
+		return f.Sync()
+	}
+	body := imageManifest(emptyJSONDigest)
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/test/image/manifests/v1", bytes.NewReader(body)))
+	if w.Code != 500 {
+		t.Fatalf("want 500, got %d", w.Code)
+	}
+	if w := getTestManifest(reg, "test/image", "v1"); w.Code != 200 || w.Body.String() != testManifest {
+		t.Errorf("want the previous manifest kept, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestDockerManifestList(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{MaxIndexDepth: 1}}
+	image := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", getDigest(image), image)
+	list, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeDockerManifestList,
+		"manifests": []map[string]interface{}{{
+			"mediaType": mediaTypeDockerManifest,
+			"digest":    getDigest(image),
+			"size":      len(image),
+			"platform":  map[string]string{"os": "linux", "architecture": "amd64"},
+		}},
+	})
+	req := httptest.NewRequest("PUT", "/v2/test/image/manifests/latest", bytes.NewReader(list))
+	req.Header.Set("Content-Type", mediaTypeDockerManifestList)
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Fatalf("push failed with %d: %s", w.Code, w.Body.String())
+	}
+	if !isImageIndex(list) {
+		t.Error("want a manifest list treated as an index")
+	}
+
+	for _, method := range []string{"GET", "HEAD"} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest(method, "/v2/test/image/manifests/latest", nil))
+		if w.Code != 200 {
+			t.Fatalf("%s: want 200, got %d", method, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != mediaTypeDockerManifestList {
+			t.Errorf("%s: want Content-Type %s, got %q", method, mediaTypeDockerManifestList, got)
+		}
+		if method == "GET" && !bytes.Equal(w.Body.Bytes(), list) {
+			t.Errorf("want the list back unchanged, got %s", w.Body.String())
+		}
+	}
+
+	nested, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeDockerManifestList,
+		"manifests":     []map[string]interface{}{{"mediaType": mediaTypeDockerManifestList, "digest": getDigest(list), "size": len(list)}},
+	})
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/test/image/manifests/nested", bytes.NewReader(nested)))
+	if w.Code != 400 {
+		t.Errorf("want nested manifest lists held to the index depth limit, got %d", w.Code)
+	}
+}
+
+func TestGetManifestPlatform(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	amd64 := imageManifest(emptyJSONDigest, getDigest([]byte("amd64")))
+	arm64 := imageManifest(emptyJSONDigest, getDigest([]byte("arm64")))
+	putTestManifest(t, reg, "test/image", getDigest(amd64), amd64)
+	putTestManifest(t, reg, "test/image", getDigest(arm64), arm64)
+	index, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageIndex,
+		"manifests": []map[string]interface{}{
+			{"mediaType": v1.MediaTypeImageManifest, "digest": getDigest(amd64), "size": len(amd64), "platform": map[string]string{"os": "linux", "architecture": "amd64"}},
+			{"mediaType": v1.MediaTypeImageManifest, "digest": getDigest(arm64), "size": len(arm64), "platform": map[string]string{"os": "linux", "architecture": "arm64"}},
+		},
+	})
+	putTestManifest(t, reg, "test/image", "latest", index)
+
+	w := getTestManifest(reg, "test/image", "latest?platform=linux/arm64")
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), arm64) {
+		t.Fatalf("want the arm64 manifest, got %d %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Docker-Content-Digest"); got != getDigest(arm64) {
+		t.Errorf("want the arm64 digest, got %s", got)
+	}
+	for _, ref := range []string{"latest", "latest?platform=windows/amd64"} {
+		if w := getTestManifest(reg, "test/image", ref); !bytes.Equal(w.Body.Bytes(), index) {
+			t.Errorf("GET %s: want the index, got %d %s", ref, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestConcurrentTagPushes(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	a := imageManifest(emptyJSONDigest, getDigest([]byte("a")))
+	b := imageManifest(emptyJSONDigest, getDigest([]byte("b")))
+	putTestManifest(t, reg, "test/image", "latest", a)
+	types := map[string]string{string(a): v1.MediaTypeImageManifest, string(b): mediaTypeDockerManifest}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for _, m := range [][]byte{a, b} {
+		wg.Add(1)
+		go func(m []byte) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest("PUT", "/v2/test/image/manifests/latest", bytes.NewReader(m))
+				req.Header.Set("Content-Type", types[string(m)])
+				reg.ServeHTTP(w, req)
+				if w.Code != 201 {
+					t.Errorf("push failed with %d", w.Code)
+					return
+				}
+			}
+		}(m)
+	}
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			w := getTestManifest(reg, "test/image", "latest")
+			if w.Code != 200 || !(bytes.Equal(w.Body.Bytes(), a) || bytes.Equal(w.Body.Bytes(), b)) {
+				t.Errorf("reader saw a partial tag: %d %q", w.Code, w.Body.String())
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != types[w.Body.String()] {
+				t.Errorf("reader got %q with the media type %s", w.Body.String(), ct)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+	<-readerDone
+
+	w := getTestManifest(reg, "test/image", "latest")
+	idx, err := loadIndex(reg.rootDir, "test/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := idx[getDigest(w.Body.Bytes())]; len(tags) != 1 || tags[0] != "latest" {
+		t.Errorf("index out of step with the tag: %v", idx)
+	}
+}
+
+func TestLegacyMediaTypeRecord(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	body := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", "v1", body)
+	p := tagManifestPath(reg.rootDir, "test/image", "v1")
+	if err := os.WriteFile(mediaTypePath(p), []byte(mediaTypeDockerManifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedMediaType(p, body, nil); got != mediaTypeDockerManifest {
+		t.Errorf("want %s, got %s", mediaTypeDockerManifest, got)
+	}
+}
+
+func TestManifestRewriteNoPartialReads(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{Fsync: true}}
+	bodies := [][]byte{
+		imageManifest(emptyJSONDigest, getDigest([]byte("one"))),
+		imageManifest(emptyJSONDigest, getDigest([]byte("one")), getDigest([]byte("two")), getDigest([]byte("three"))),
+	}
+	putTestManifest(t, reg, "test/image", "v1", bodies[0])
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			w := httptest.NewRecorder()
+			reg.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/test/image/manifests/v1", bytes.NewReader(bodies[i%2])))
+			if w.Code != 201 {
+				t.Errorf("rewrite %d failed with %d", i, w.Code)
+				return
+			}
+		}
+	}()
+	for reads := 0; ; reads++ {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		w := getTestManifest(reg, "test/image", "v1")
+		if w.Code != 200 {
+			t.Fatalf("read %d: want 200, got %d", reads, w.Code)
+		}
+		if got := w.Body.Bytes(); !bytes.Equal(got, bodies[0]) && !bytes.Equal(got, bodies[1]) {
+			t.Fatalf("read %d: partial manifest %q", reads, got)
+		}
+	}
+}
+
+func TestAutoLatest(t *testing.T) {
+	first := imageManifest(emptyJSONDigest)
+	second := imageManifest(emptyJSONDigest, getDigest([]byte("layer")))
+
+	reg := &registry{rootDir: t.TempDir()}
+	putTestManifest(t, reg, "test/image", getDigest(first), first)
+	if w := getTestManifest(reg, "test/image", "latest"); w.Code != 404 {
+		t.Errorf("without -auto-latest: want no latest tag, got %d", w.Code)
+	}
+
+	reg = &registry{rootDir: t.TempDir(), config: Config{AutoLatest: true}}
+	putTestManifest(t, reg, "test/image", getDigest(first), first)
+	putTestManifest(t, reg, "test/image", getDigest(second), second)
+	w := getTestManifest(reg, "test/image", "latest")
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), first) {
+		t.Errorf("want latest to resolve to the first manifest pushed by digest, got %d: %s", w.Code, w.Body.String())
+	}
+	tags, _ := getTags(path.Join(reg.rootDir, "test/image"))
+	if len(tags) != 1 || tags[0] != "latest" {
+		t.Errorf("want only the latest tag, got %v", tags)
+	}
+}
+
+func TestDefaultManifestMediaType(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	// Legacy data: stored without a recorded type and declaring none.
+	legacy := []byte(`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"` + emptyJSONDigest + `","size":2},"layers":[]}`)
+	p := tagManifestPath(reg.rootDir, "test/image", "legacy")
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+	declared := imageManifest(emptyJSONDigest)
+	putTestManifest(t, reg, "test/image", "declared", declared)
+
+	for _, c := range []struct {
+		defaults string
+		want     string
+	}{
+		{"oci", v1.MediaTypeImageManifest},
+		{"docker", mediaTypeDockerManifest},
+	} {
+		reg.config.DefaultManifestType = c.defaults
+		for _, method := range []string{"GET", "HEAD"} {
+			w := httptest.NewRecorder()
+			reg.ServeHTTP(w, httptest.NewRequest(method, "/v2/test/image/manifests/legacy", nil))
+			if got := w.Header().Get("Content-Type"); w.Code != 200 || got != c.want {
+				t.Errorf("%s: want %s, got %d %s", method, c.want, w.Code, got)
+			}
+		}
+		if got := getTestManifest(reg, "test/image", "declared").Header().Get("Content-Type"); got != v1.MediaTypeImageManifest {
+			t.Errorf("a manifest pushed with a type is served with it, got %s", got)
+		}
+	}
+}
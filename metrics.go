@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// repoStats is the storage used by one repository.
+type repoStats struct {
+	bytes     int64
+	blobs     int
+	manifests int
+	tags      int
+	// created and pushed are the oldest and newest modification times of
+	// the blobs and manifests.
+	created time.Time
+	pushed  time.Time
+}
+
+// touched widens the times of s to include t.
+func (s *repoStats) touched(t time.Time) {
+	if s.created.IsZero() || t.Before(s.created) {
+		s.created = t
+	}
+	if t.After(s.pushed) {
+		s.pushed = t
+	}
+}
+
+// metricsCache serves per-repository storage metrics in the Prometheus text
+// format. Walking the storage root is expensive, so the figures are gathered
+// at most once per refresh interval and served from memory in between.
+type metricsCache struct {
+	rootDir string
+	layout  *pathTemplate
+	refresh time.Duration
+	// breaker is reported on when -breaker-threshold is set; nil otherwise.
+	breaker *storageBreaker
+	// readOnly is reported on when -storage-readonly-fallback is set; nil
+	// otherwise.
+	readOnly *readOnlyFallback
+	// verboseErrors includes the underlying error in server errors, as set
+	// with -verbose-errors.
+	verboseErrors bool
+
+	mu      sync.Mutex
+	updated time.Time
+	stats   map[string]repoStats
+}
+
+func (c *metricsCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stats, err := c.get()
+	if err != nil {
+		writeInternalError(err, w, c.verboseErrors)
+		return
+	}
+	repos := make([]string, 0, len(stats))
+	for name := range stats {
+		repos = append(repos, name)
+	}
+	sort.Strings(repos)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP registry_repository_size_bytes Bytes stored for blobs and manifests of a repository.")
+	fmt.Fprintln(w, "# TYPE registry_repository_size_bytes gauge")
+	for _, name := range repos {
+		fmt.Fprintf(w, "registry_repository_size_bytes{repository=%q} %d\n", name, stats[name].bytes)
+	}
+	fmt.Fprintln(w, "# HELP registry_repository_blobs Number of blobs stored in a repository.")
+	fmt.Fprintln(w, "# TYPE registry_repository_blobs gauge")
+	for _, name := range repos {
+		fmt.Fprintf(w, "registry_repository_blobs{repository=%q} %d\n", name, stats[name].blobs)
+	}
+	fmt.Fprintln(w, "# HELP registry_repository_manifests Number of distinct manifests stored in a repository.")
+	fmt.Fprintln(w, "# TYPE registry_repository_manifests gauge")
+	for _, name := range repos {
+		fmt.Fprintf(w, "registry_repository_manifests{repository=%q} %d\n", name, stats[name].manifests)
+	}
+	if c.readOnly != nil {
+		fmt.Fprintln(w, "# HELP registry_storage_read_only Whether pushes are refused because storage was found read-only.")
+		fmt.Fprintln(w, "# TYPE registry_storage_read_only gauge")
+		if c.readOnly.readOnly() {
+			fmt.Fprintln(w, "registry_storage_read_only 1")
+		} else {
+			fmt.Fprintln(w, "registry_storage_read_only 0")
+		}
+	}
+	if c.breaker != nil {
+		open, failures := c.breaker.state()
+		fmt.Fprintln(w, "# HELP registry_storage_breaker_open Whether requests are refused because storage keeps failing.")
+		fmt.Fprintln(w, "# TYPE registry_storage_breaker_open gauge")
+		if open {
+			fmt.Fprintln(w, "registry_storage_breaker_open 1")
+		} else {
+			fmt.Fprintln(w, "registry_storage_breaker_open 0")
+		}
+		fmt.Fprintln(w, "# HELP registry_storage_consecutive_failures Storage failures since the last successful request.")
+		fmt.Fprintln(w, "# TYPE registry_storage_consecutive_failures gauge")
+		fmt.Fprintf(w, "registry_storage_consecutive_failures %d\n", failures)
+	}
+}
+
+// repo returns the cached statistics of one repository, collecting them
+// when the repository is newer than the cache. It is safe on a nil cache,
+// which collects them every time.
+func (c *metricsCache) repo(rootDir string, layout *pathTemplate, name string) (repoStats, error) {
+	if c != nil {
+		stats, err := c.get()
+		if err != nil {
+			return repoStats{}, err
+		}
+		if s, ok := stats[name]; ok {
+			return s, nil
+		}
+	}
+	return collectRepoStats(rootDir, layout, name)
+}
+
+// get returns the cached statistics, walking the storage root again once they
+// are older than the refresh interval.
+func (c *metricsCache) get() (map[string]repoStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stats != nil && time.Since(c.updated) < c.refresh {
+		return c.stats, nil
+	}
+	repos, err := listRepos(c.rootDir)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]repoStats, len(repos))
+	for _, name := range repos {
+		s, err := collectRepoStats(c.rootDir, c.layout, name)
+		if err != nil {
+			return nil, err
+		}
+		stats[name] = s
+	}
+	c.stats = stats
+	c.updated = time.Now()
+	return stats, nil
+}
+
+// collectRepoStats adds up the blobs and manifests of a repository. A manifest
+// that is both tagged and stored by digest is counted once.
+func collectRepoStats(rootDir string, layout *pathTemplate, name string) (repoStats, error) {
+	var s repoStats
+	blobs, err := listBlobs(rootDir, layout, name)
+	if err != nil {
+		return s, err
+	}
+	for _, d := range blobs {
+		fi, err := os.Stat(blobPath(rootDir, layout, name, d))
+		if err != nil {
+			return s, err
+		}
+		s.bytes += fi.Size()
+		s.blobs++
+		s.touched(fi.ModTime())
+	}
+
+	manifests := make(map[string]int64)
+	tags, err := getTags(path.Join(rootDir, name))
+	if err != nil {
+		return s, err
+	}
+	for _, tag := range tags {
+		p := tagManifestPath(rootDir, name, tag)
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return s, err
+		}
+		manifests[getDigest(b)] = int64(len(b))
+		if fi, err := os.Stat(p); err == nil {
+			s.touched(fi.ModTime())
+		}
+	}
+	s.tags = len(tags)
+	digests, err := listDigestManifests(rootDir, name)
+	if err != nil {
+		return s, err
+	}
+	for _, d := range digests {
+		fi, err := os.Stat(digestManifestPath(rootDir, name, d))
+		if err != nil {
+			return s, err
+		}
+		manifests[d] = fi.Size()
+		s.touched(fi.ModTime())
+	}
+	for _, size := range manifests {
+		s.bytes += size
+	}
+	s.manifests = len(manifests)
+	return s, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrapeTestMetrics(t *testing.T, c *metricsCache) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 200 {
+		t.Fatalf("want 200, got %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestMetricsRepoSize(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	putTestBlob(t, reg.rootDir, "test/image", []byte("layer one"))
+	putTestBlob(t, reg.rootDir, "test/image", []byte("layer two"))
+	putTestManifest(t, reg, "test/image", "v1", []byte(testManifest))
+
+	c := &metricsCache{rootDir: reg.rootDir, layout: reg.config.layout(), refresh: time.Hour}
+	body := scrapeTestMetrics(t, c)
+	size := len("layer one") + len("layer two") + len(testManifest)
+	for _, want := range []string{
+		fmt.Sprintf(`registry_repository_size_bytes{repository="test/image"} %d`, size),
+		`registry_repository_blobs{repository="test/image"} 2`,
+		`registry_repository_manifests{repository="test/image"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("want %q in:\n%s", want, body)
+		}
+	}
+
+	// Within the refresh interval the cached figures are served.
+	putTestBlob(t, reg.rootDir, "test/image", []byte("layer three"))
+	if body := scrapeTestMetrics(t, c); !strings.Contains(body, `registry_repository_blobs{repository="test/image"} 2`) {
+		t.Errorf("want cached blob count, got:\n%s", body)
+	}
+	c.refresh = 0
+	if body := scrapeTestMetrics(t, c); !strings.Contains(body, `registry_repository_blobs{repository="test/image"} 3`) {
+		t.Errorf("want refreshed blob count, got:\n%s", body)
+	}
+}
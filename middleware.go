@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// recoverPanics keeps a panicking handler from taking down the whole server.
+// The panic and its stack trace are logged and the client receives a 500.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+				log.Printf("Panic while serving %s %s: %v\n%s", r.Method, r.RequestURI, rec, debug.Stack())
+				writeOciError("UNKNOWN", "internal server error", w, 500)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// timeoutRequests bounds how long a request may take, answering 503 once the
+// timeout expires. Blob transfers and repository exports and imports can
+// legitimately run for a long time and are not subject to the limit.
+func timeoutRequests(next http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	limited := http.TimeoutHandler(next, timeout, `{"errors":[{"code":"UNAVAILABLE","message":"request timed out","detail":"{}"}]}`)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/") || strings.HasSuffix(r.URL.Path, "/_export") || strings.HasSuffix(r.URL.Path, "/_import") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limited.ServeHTTP(&timeoutWriter{ResponseWriter: w}, r)
+	})
+}
+
+// timeoutWriter labels the error body http.TimeoutHandler writes on timeout
+// as JSON. Responses of the handler itself keep their own Content-Type, which
+// http.TimeoutHandler copies over before writing the status.
+type timeoutWriter struct {
+	http.ResponseWriter
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	if status == 503 && tw.Header().Get("Content-Type") == "" {
+		tw.Header().Set("Content-Type", "application/json")
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+// proxyTrust tells which reverse proxies are trusted to report the client's
+// address, scheme and host in X-Forwarded-* headers. Those of other peers
+// could be spoofed by any client and are ignored.
+type proxyTrust struct {
+	// nets are the -trusted-proxies networks.
+	nets []*net.IPNet
+	// any trusts whichever peer connects, as the deprecated -trust-forwarded
+	// does, but not the hops it reports.
+	any bool
+}
+
+// contains reports whether ip is a trusted proxy.
+func (p proxyTrust) contains(ip net.IP) bool {
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwarded reports whether the X-Forwarded-* headers of r are honoured,
+// that is whether r comes straight from a trusted proxy.
+func (p proxyTrust) forwarded(r *http.Request) bool {
+	return p.any || p.contains(peerIP(r))
+}
+
+// filterClientIPs refuses requests from clients outside the allow networks,
+// when there are any, or inside the deny networks. Behind trusted proxies
+// the client is found in X-Forwarded-For as clientIP does.
+func filterClientIPs(next http.Handler, allow []*net.IPNet, deny []*net.IPNet, trust proxyTrust) http.Handler {
+	if len(allow) == 0 && len(deny) == 0 {
+		return next
+	}
+	contains := func(nets []*net.IPNet, ip net.IP) bool {
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, trust)
+		if ip == nil || contains(deny, ip) || (len(allow) > 0 && !contains(allow, ip)) {
+			writeOciError("DENIED", "client address not allowed", w, 403)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address of the client of a request, or nil when it
+// cannot be told. When the request comes from a trusted proxy, that is the
+// last address in X-Forwarded-For that is not a trusted proxy itself, so
+// that a chain of proxies can each append the address they were reached
+// from while entries added by the client are never believed.
+func clientIP(r *http.Request, trust proxyTrust) net.IP {
+	ip := peerIP(r)
+	if ip == nil || !trust.forwarded(r) {
+		return ip
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if ip = net.ParseIP(strings.TrimSpace(hops[i])); ip == nil || !trust.contains(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// peerIP returns the address the request was received from, or nil when it
+// cannot be told.
+func peerIP(r *http.Request) net.IP {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+// filterUserAgents refuses requests from clients whose User-Agent matches one
+// of the deny patterns, and, when requireUserAgent is set, requests without a
+// User-Agent at all.
+func filterUserAgents(next http.Handler, deny []*regexp.Regexp, requireUserAgent bool) http.Handler {
+	if len(deny) == 0 && !requireUserAgent {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ua := r.Header.Get("User-Agent")
+		if ua == "" && requireUserAgent {
+			writeOciError("DENIED", "a User-Agent header is required", w, 403)
+			return
+		}
+		for _, re := range deny {
+			if ua != "" && re.MatchString(ua) {
+				writeOciError("DENIED", "client not allowed", w, 403)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsHeaders lets browser based registry UIs call the API from the given
+// origins. Preflight requests are answered directly, with a max age so that
+// browsers can cache them, and the listed response headers are exposed.
+func corsHeaders(next http.Handler, origins []string, exposed []string, maxAge time.Duration) http.Handler {
+	if len(origins) == 0 {
+		return next
+	}
+	allowed := func(origin string) bool {
+		for _, o := range origins {
+			if o == "*" || o == origin {
+				return true
+			}
+		}
+		return false
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !allowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+		if len(exposed) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+		}
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+			if h := r.Header.Get("Access-Control-Request-Headers"); h != "" {
+				w.Header().Set("Access-Control-Allow-Headers", h)
+			}
+			w.Header().Set("Access-Control-Max-Age", fmt.Sprint(int(maxAge.Seconds())))
+			w.WriteHeader(204)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	h := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/panic" {
+			panic("boom")
+		}
+		w.WriteHeader(200)
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/v2/panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 500 {
+		t.Errorf("want 500, got %d", resp.StatusCode)
+	}
+	var er ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&er); err != nil {
+		t.Fatal(err)
+	}
+	if len(er.Errors) != 1 || er.Errors[0].Code != "UNKNOWN" {
+		t.Errorf("unexpected error body: %+v", er)
+	}
+
+	resp, err = http.Get(srv.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("server did not survive panic: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("want 200 after recovered panic, got %d", resp.StatusCode)
+	}
+}
+
+func TestTimeoutRequests(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(200)
+	})
+	h := timeoutRequests(slow, 10*time.Millisecond)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v2/_catalog", nil))
+	if w.Code != 503 {
+		t.Errorf("want 503 on timeout, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("want the timeout error labelled as JSON, got %q", ct)
+	}
+}
+
+func TestTimeoutRequestsExcludesBlobs(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(200)
+	})
+	h := timeoutRequests(slow, 10*time.Millisecond)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PATCH", "/v2/test/image/blobs/uploads/some-id", nil))
+	if w.Code != 200 {
+		t.Errorf("want blob transfers to be exempt from the timeout, got %d", w.Code)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := corsHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("preflight must not reach the registry")
+	}), []string{"https://ui.example.com"}, defaultConfig().CORSExposeHeaders, 5*time.Minute)
+
+	req := httptest.NewRequest("OPTIONS", "/v2/test/image/manifests/latest", nil)
+	req.Header.Set("Origin", "https://ui.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	req.Header.Set("Access-Control-Request-Headers", "Authorization")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 204 {
+		t.Fatalf("want 204, got %d", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Max-Age"); got != "300" {
+		t.Errorf("want max age 300, got %q", got)
+	}
+	exposed := w.Header().Get("Access-Control-Expose-Headers")
+	for _, header := range []string{"Docker-Content-Digest", "Location", "Range"} {
+		if !strings.Contains(exposed, header) {
+			t.Errorf("want %s exposed, got %q", header, exposed)
+		}
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://ui.example.com" {
+		t.Errorf("unexpected allowed origin %q", got)
+	}
+}
+
+func TestCORSUnknownOrigin(t *testing.T) {
+	h := corsHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}), []string{"https://ui.example.com"}, nil, time.Minute)
+	req := httptest.NewRequest("GET", "/v2/", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("want no CORS headers for unknown origin, got %q", got)
+	}
+}
+
+func TestFilterUserAgents(t *testing.T) {
+	h := filterUserAgents(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}), []*regexp.Regexp{regexp.MustCompile(`^buggy-client/1\.`)}, true)
+
+	for ua, want := range map[string]int{
+		"buggy-client/1.2":  403,
+		"buggy-client/2.0":  200,
+		"docker/24.0.7 go/": 200,
+		"":                  403,
+	} {
+		req := httptest.NewRequest("GET", "/v2/", nil)
+		req.Header.Set("User-Agent", ua)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("User-Agent %q: want %d, got %d", ua, want, w.Code)
+		}
+	}
+}
+
+func TestFilterClientIPs(t *testing.T) {
+	allow, _ := parseCIDRs("allow-cidr", []string{"10.0.0.0/8", "192.0.2.7"})
+	deny, _ := parseCIDRs("deny-cidr", []string{"10.1.0.0/16"})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+
+	h := filterClientIPs(ok, allow, deny, proxyTrust{})
+	for addr, want := range map[string]int{
+		"10.2.3.4:5000":   200,
+		"192.0.2.7:5000":  200,
+		"192.0.2.8:5000":  403,
+		"10.1.2.3:5000":   403,
+		"[2001:db8::1]:1": 403,
+	} {
+		req := httptest.NewRequest("GET", "/v2/", nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("client %s: want %d, got %d", addr, want, w.Code)
+		}
+	}
+
+	// With -trust-forwarded the client is the address the peer appended.
+	h = filterClientIPs(ok, allow, deny, proxyTrust{any: true})
+	for xff, want := range map[string]int{
+		"10.2.3.4":             200,
+		"10.2.3.4, 192.0.2.99": 403,
+		"192.0.2.99, 10.2.3.4": 200,
+	} {
+		req := httptest.NewRequest("GET", "/v2/", nil)
+		req.RemoteAddr = "127.0.0.1:5000"
+		req.Header.Set("X-Forwarded-For", xff)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("X-Forwarded-For %q: want %d, got %d", xff, want, w.Code)
+		}
+	}
+}
+
+func TestFilterClientIPsOutsideV2(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{AdminUsers: stringList{"alice"}, DenyCIDRs: stringList{"192.0.2.0/24"}}}
+	h := reg.routes(reg, testUsers(t))
+	for _, c := range []struct {
+		remoteAddr string
+		status     int
+	}{
+		{"192.0.2.7:1234", 403},
+		{"198.51.100.7:1234", 200},
+	} {
+		req := httptest.NewRequest("POST", "/admin/gc?dry-run=true", nil)
+		req.RemoteAddr = c.remoteAddr
+		req.SetBasicAuth("alice", "secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Errorf("%s: want %d, got %d", c.remoteAddr, c.status, w.Code)
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	nets, _ := parseCIDRs("trusted-proxies", []string{"127.0.0.1", "172.16.0.0/12"})
+	trust := proxyTrust{nets: nets}
+	for _, c := range []struct {
+		peer, xff, want string
+	}{
+		{"127.0.0.1:5000", "10.2.3.4", "10.2.3.4"},
+		// Hops through further trusted proxies are skipped, but not the
+		// addresses before them, which the client may have made up.
+		{"127.0.0.1:5000", "192.0.2.99, 10.2.3.4, 172.16.0.5", "10.2.3.4"},
+		{"127.0.0.1:5000", "", "127.0.0.1"},
+		{"127.0.0.1:5000", "not-an-address", ""},
+		// An untrusted peer is the client, whatever it claims.
+		{"192.0.2.7:5000", "10.2.3.4", "192.0.2.7"},
+	} {
+		req := httptest.NewRequest("GET", "/v2/", nil)
+		req.RemoteAddr = c.peer
+		if c.xff != "" {
+			req.Header.Set("X-Forwarded-For", c.xff)
+		}
+		got := ""
+		if ip := clientIP(req, trust); ip != nil {
+			got = ip.String()
+		}
+		if got != c.want {
+			t.Errorf("peer %s with X-Forwarded-For %q: want client %q, got %q", c.peer, c.xff, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// mirrorJob is a blob or manifest to copy to the mirror.
+type mirrorJob struct {
+	name string
+	// digest is set for blobs and ref for manifests.
+	digest string
+	ref    string
+}
+
+// mirror replicates pushes to a secondary registry for disaster recovery.
+// Jobs are handled one at a time in push order, so blobs reach the mirror
+// before the manifests that reference them. Failures are retried with
+// exponential backoff and then logged; they never fail the client's push.
+type mirror struct {
+	target  *url.URL
+	rootDir string
+	// config is that of the registry whose storage is replicated.
+	config  Config
+	client  *http.Client
+	jobs    chan mirrorJob
+	retries int
+	backoff time.Duration
+}
+
+func newMirror(target string, rootDir string, config Config) (*mirror, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	m := &mirror{
+		target:  u,
+		rootDir: rootDir,
+		config:  config,
+		client:  &http.Client{Timeout: 10 * time.Minute},
+		jobs:    make(chan mirrorJob, 1024),
+		retries: 5,
+		backoff: time.Second,
+	}
+	go m.run()
+	return m, nil
+}
+
+// blob queues a blob for replication. It is a no-op on a nil mirror.
+func (m *mirror) blob(name string, digest string) {
+	m.enqueue(mirrorJob{name: name, digest: digest})
+}
+
+// manifest queues a manifest for replication. It is a no-op on a nil mirror.
+func (m *mirror) manifest(name string, ref string) {
+	m.enqueue(mirrorJob{name: name, ref: ref})
+}
+
+func (m *mirror) enqueue(job mirrorJob) {
+	if m == nil {
+		return
+	}
+	select {
+	case m.jobs <- job:
+	default:
+		log.Printf("Mirror queue full, not replicating %s %s%s", job.name, job.digest, job.ref)
+	}
+}
+
+func (m *mirror) run() {
+	for job := range m.jobs {
+		err := retry(m.retries, m.backoff, func() error { return m.replicate(job) })
+		if err != nil {
+			log.Printf("Giving up replicating %s %s%s to %s: %s", job.name, job.digest, job.ref, m.target, err)
+		}
+	}
+}
+
+func (m *mirror) replicate(job mirrorJob) error {
+	if job.digest != "" {
+		return m.pushBlob(job.name, job.digest)
+	}
+	return m.pushManifest(job.name, job.ref)
+}
+
+func (m *mirror) pushBlob(name string, digest string) error {
+	resp, err := m.client.Head(m.url("/v2/%s/blobs/%s", name, digest).String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == 200 {
+		return nil
+	}
+
+	resp, err = m.client.Post(m.url("/v2/%s/blobs/uploads/", name).String(), "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 202 {
+		return fmt.Errorf("starting upload: %s", resp.Status)
+	}
+	loc, err := m.target.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+	q := loc.Query()
+	q.Set("digest", digest)
+	loc.RawQuery = q.Encode()
+
+	f, err := os.Open(blobPath(m.rootDir, m.config.layout(), name, digest))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", loc.String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return m.do(req, 201)
+}
+
+func (m *mirror) pushManifest(name string, ref string) error {
+	p, err := resolveManifest(m.rootDir, name, ref, m.config.modes())
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return fmt.Errorf("manifest %s:%s no longer stored", name, ref)
+	}
+	b, mediaType, err := readManifest(p, m.config.manifestTypeDefaults())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", m.url("/v2/%s/manifests/%s", name, ref).String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	return m.do(req, 201)
+}
+
+func (m *mirror) do(req *http.Request, want int) error {
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s %s", req.Method, req.URL.Path, resp.Status, body)
+	}
+	return nil
+}
+
+func (m *mirror) url(format string, args ...interface{}) *url.URL {
+	return m.target.ResolveReference(&url.URL{Path: fmt.Sprintf(format, args...)})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMirrorPush(t *testing.T) {
+	secondary := &registry{rootDir: t.TempDir()}
+	// Fail the first request to check that replication is retried.
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(503)
+			return
+		}
+		secondary.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	rootDir := t.TempDir()
+	m, err := newMirror(srv.URL, rootDir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.backoff = time.Millisecond
+	reg := &registry{rootDir: rootDir, mirror: m}
+
+	layer := []byte("layer")
+	if w := putTestBlobRequest(reg, "test/image", layer); w.Code != 201 {
+		t.Fatalf("blob push failed with %d", w.Code)
+	}
+	manifest := imageManifest(emptyJSONDigest, getDigest(layer))
+	putTestManifest(t, reg, "test/image", "v1", manifest)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := getTestManifest(secondary, "test/image", "v1")
+		if w.Code == 200 {
+			if !bytes.Equal(w.Body.Bytes(), manifest) {
+				t.Errorf("mirrored manifest differs: %s", w.Body.String())
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("manifest never reached the mirror, last status %d", w.Code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ok, _ := blobExists(secondary.rootDir, secondary.config.layout(), "test/image", getDigest(layer)); !ok {
+		t.Error("layer not mirrored ahead of its manifest")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pinsMu serialises read-modify-write updates of pins files.
+var pinsMu sync.Mutex
+
+func pinsPath(rootDir string, name string) string {
+	return path.Join(rootDir, name, "_pins.json")
+}
+
+// loadPins returns the digests of the pinned manifests of a repository.
+func loadPins(rootDir string, name string) (map[string]bool, error) {
+	pins := make(map[string]bool)
+	b, err := os.ReadFile(pinsPath(rootDir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return pins, nil
+	}
+	if err != nil {
+		return pins, err
+	}
+	var digests []string
+	if err := json.Unmarshal(b, &digests); err != nil {
+		return pins, err
+	}
+	for _, d := range digests {
+		pins[d] = true
+	}
+	return pins, nil
+}
+
+// setPin pins or unpins a manifest. Pinned manifests, and the blobs and
+// manifests they refer to, are never garbage collected.
+func setPin(rootDir string, name string, digest string, pinned bool, modes fileModes, fsync bool) error {
+	pinsMu.Lock()
+	defer pinsMu.Unlock()
+	pins, err := loadPins(rootDir, name)
+	if err != nil {
+		return err
+	}
+	if pins[digest] == pinned {
+		return nil
+	}
+	if pinned {
+		pins[digest] = true
+	} else {
+		delete(pins, digest)
+	}
+	digests := make([]string, 0, len(pins))
+	for d := range pins {
+		digests = append(digests, d)
+	}
+	sort.Strings(digests)
+	b, err := json.Marshal(digests)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(pinsPath(rootDir, name), b, modes, fsync)
+}
+
+// storedDigest returns the digest a manifest is kept under, which is the one
+// garbage collection looks pins up by. A manifest pushed by tag is kept under
+// its sha256 digest whatever the algorithm of the digest it is asked for by.
+// It returns "" when the manifest is not stored.
+func storedDigest(rootDir string, name string, digest string, modes fileModes) (string, error) {
+	p, err := resolveManifest(rootDir, name, digest, modes)
+	if err != nil || p == "" {
+		return "", err
+	}
+	if p == digestManifestPath(rootDir, name, digest) {
+		return digest, nil
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	return getDigest(b), nil
+}
+
+// servePin handles POST /v2/<name>/_pin/<digest>, which pins a stored
+// manifest, and DELETE, which unpins it.
+func (reg *registry) servePin(w http.ResponseWriter, r *http.Request, name string, endpoint string) {
+	digest := strings.TrimPrefix(endpoint, "/_pin/")
+	if !matches(digestRegex, digest) {
+		writeOciError("DIGEST_INVALID", "invalid digest", w, 400)
+		return
+	}
+	stored, err := storedDigest(reg.rootDir, name, digest, reg.config.modes())
+	if err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	if r.Method == "POST" {
+		if stored == "" {
+			reg.writeNotFound(w, name, "MANIFEST_UNKNOWN", "manifest unknown to registry")
+			return
+		}
+		digest = stored
+	} else {
+		found, err := repoExists(reg.rootDir, name)
+		if err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		if !found {
+			writeOciError("NAME_UNKNOWN", "repository name not known to registry", w, 404)
+			return
+		}
+		if stored != "" {
+			digest = stored
+		}
+	}
+	if err := setPin(reg.rootDir, name, digest, r.Method == "POST", reg.config.modes(), reg.config.Fsync); err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	if r.Method == "POST" {
+		w.WriteHeader(201)
+	} else {
+		w.WriteHeader(202)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPinnedManifestSurvivesGC(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	name := "test/image"
+	layer := putTestBlob(t, reg.rootDir, name, []byte("pinned layer"))
+	putTestBlob(t, reg.rootDir, name, emptyJSON)
+	m := imageManifest(emptyJSONDigest, layer)
+	putTestManifest(t, reg, name, getDigest(m), m)
+
+	pin := func(method string, digest string) int {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest(method, "/v2/"+name+"/_pin/"+digest, nil))
+		return w.Code
+	}
+	if code := pin("POST", getDigest(m)); code != 201 {
+		t.Fatalf("want 201, got %d", code)
+	}
+	if code := pin("POST", getDigest([]byte("missing"))); code != 404 {
+		t.Errorf("pinning an unknown manifest: want 404, got %d", code)
+	}
+
+	res, err := collectGarbage(reg.rootDir, reg.config.layout(), gcOptions{deleteUntagged: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Manifests) != 0 || len(res.Blobs) != 0 {
+		t.Errorf("want nothing collected, got %+v", res)
+	}
+	if found, _ := blobExists(reg.rootDir, reg.config.layout(), name, layer); !found {
+		t.Error("layer of the pinned manifest was collected")
+	}
+
+	if code := pin("DELETE", getDigest(m)); code != 202 {
+		t.Fatalf("want 202, got %d", code)
+	}
+	res, err = collectGarbage(reg.rootDir, reg.config.layout(), gcOptions{deleteUntagged: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Manifests) != 1 || len(res.Blobs) != 2 {
+		t.Errorf("want the unpinned manifest and its blobs collected, got %+v", res)
+	}
+}
+
+func TestPinByOtherAlgorithm(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	name := "test/image"
+	m := []byte(testManifest)
+	putTestManifest(t, reg, name, "v1", m)
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("POST", "/v2/"+name+"/_pin/"+digestAs("sha512:", m), nil))
+	if w.Code != 201 {
+		t.Fatalf("want 201, got %d", w.Code)
+	}
+	pins, err := loadPins(reg.rootDir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 1 || !pins[getDigest(m)] {
+		t.Errorf("want the pin recorded under the stored digest, got %v", pins)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+)
+
+// readOnlyFallback, set up with -storage-readonly-fallback, switches the
+// registry to serving pulls only once storage turns out to be read-only,
+// as when a volume is remounted read-only, instead of answering every push
+// with a 500.
+type readOnlyFallback struct {
+	// active is set once a write has failed because storage is read-only.
+	// It stays set until the registry is restarted.
+	active atomic.Bool
+}
+
+// check reports whether err means that storage is read-only and switches to
+// serving pulls only if so. It is false for a nil fallback.
+func (f *readOnlyFallback) check(err error) bool {
+	if f == nil || !errors.Is(err, syscall.EROFS) {
+		return false
+	}
+	if !f.active.Swap(true) {
+		log.Printf("Storage is read-only, serving pulls only until restarted: %s", err)
+	}
+	return true
+}
+
+// readOnly reports whether storage has been found read-only.
+func (f *readOnlyFallback) readOnly() bool {
+	return f != nil && f.active.Load()
+}
+
+// writeReadOnly refuses a request that would write to read-only storage.
+func writeReadOnly(w http.ResponseWriter) {
+	writeOciErrorDetail("UNAVAILABLE", "storage is read-only", "pulls are served, but pushes are refused until storage is writable and the registry restarted", w, 503)
+}
+
+// refuseWritesWhenReadOnly answers any request other than a pull with
+// writeReadOnly once f has found storage read-only.
+func refuseWritesWhenReadOnly(next http.Handler, f *readOnlyFallback) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.readOnly() && r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" {
+			writeReadOnly(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
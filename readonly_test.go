@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestReadOnlyFallback(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{Fsync: true}}
+	putTestManifest(t, reg, "test/image", "v1", []byte(testManifest))
+
+	// The volume flips to read-only: every write now fails.
+	defer func(orig func(*os.File) error) { syncFile = orig }(syncFile)
+	syncFile = func(f *os.File) error {
+		return &os.PathError{Op: "fsync", Path: f.Name(), Err: syscall.EROFS}
+	}
+	reg.readOnly = &readOnlyFallback{}
+	h := refuseWritesWhenReadOnly(reg, reg.readOnly)
+	push := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("PUT", "/v2/test/image/manifests/v2", bytes.NewReader([]byte(testManifest)))
+		req.Header.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := push(); w.Code != 503 || !strings.Contains(w.Body.String(), "storage is read-only") {
+		t.Fatalf("push to read-only storage: want 503, got %d: %s", w.Code, w.Body.String())
+	}
+	if !reg.readOnly.readOnly() {
+		t.Fatal("want the registry switched to read-only")
+	}
+	syncFile = func(f *os.File) error {
+		t.Error("storage written to after switching to read-only")
+		return nil
+	}
+	if w := push(); w.Code != 503 {
+		t.Errorf("later push: want 503, got %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/manifests/v1", nil))
+	if w.Code != 200 {
+		t.Errorf("pull: want 200, got %d", w.Code)
+	}
+}
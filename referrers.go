@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// referrerDescriptor describes a manifest that refers to another through its
+// subject field. The vendored image-spec predates artifactType, hence the
+// local type.
+type referrerDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// referrersIndex maps subject digests to the manifests referring to them.
+type referrersIndex map[string][]referrerDescriptor
+
+// referrersMu serialises read-modify-write updates of referrers files.
+var referrersMu sync.Mutex
+
+func referrersPath(rootDir string, name string) string {
+	return path.Join(rootDir, name, "_referrers.json")
+}
+
+func loadReferrers(rootDir string, name string) (referrersIndex, error) {
+	idx := make(referrersIndex)
+	b, err := os.ReadFile(referrersPath(rootDir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return idx, err
+	}
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return make(referrersIndex), nil
+	}
+	return idx, nil
+}
+
+// manifestSubject returns the digest of the subject a manifest refers to, or
+// "" when it has none.
+func manifestSubject(body []byte) string {
+	var m struct {
+		Subject *v1.Descriptor `json:"subject"`
+	}
+	if err := json.Unmarshal(body, &m); err != nil || m.Subject == nil {
+		return ""
+	}
+	if !matches(digestRegex, string(m.Subject.Digest)) {
+		return ""
+	}
+	return string(m.Subject.Digest)
+}
+
+// newReferrerDescriptor describes a pushed manifest for the referrers list.
+// Its artifact type is the one it declares, or else its config media type.
+func newReferrerDescriptor(body []byte, digest string, mediaType string) referrerDescriptor {
+	var m struct {
+		ArtifactType string            `json:"artifactType"`
+		Config       *v1.Descriptor    `json:"config"`
+		Annotations  map[string]string `json:"annotations"`
+	}
+	_ = json.Unmarshal(body, &m)
+	desc := referrerDescriptor{MediaType: mediaType, ArtifactType: m.ArtifactType, Digest: digest, Size: int64(len(body)), Annotations: m.Annotations}
+	if desc.ArtifactType == "" && m.Config != nil {
+		desc.ArtifactType = m.Config.MediaType
+	}
+	return desc
+}
+
+// addReferrer records that the manifest described by desc refers to subject.
+// The file is replaced atomically, so readers see either the old or the new
+// list.
+func addReferrer(rootDir string, name string, subject string, desc referrerDescriptor, modes fileModes) error {
+	referrersMu.Lock()
+	defer referrersMu.Unlock()
+	idx, err := loadReferrers(rootDir, name)
+	if err != nil {
+		return err
+	}
+	descs := make([]referrerDescriptor, 0, len(idx[subject])+1)
+	for _, d := range idx[subject] {
+		if d.Digest != desc.Digest {
+			descs = append(descs, d)
+		}
+	}
+	idx[subject] = append(descs, desc)
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(referrersPath(rootDir, name), b, modes, false)
+}
+
+// listReferrers returns the manifests referring to subject, optionally only
+// those of one artifact type. Each is described from the manifest as stored,
+// so that its media type, artifact type, size and annotations are complete
+// even when the referrers file, such as one written by an older version,
+// only records its digest. Manifests that are no longer stored are left out.
+func listReferrers(rootDir string, name string, subject string, artifactType string, config Config) ([]referrerDescriptor, error) {
+	referrersMu.Lock()
+	idx, err := loadReferrers(rootDir, name)
+	referrersMu.Unlock()
+	descs := make([]referrerDescriptor, 0)
+	if err != nil {
+		return descs, err
+	}
+	for _, d := range idx[subject] {
+		p, err := resolveManifest(rootDir, name, d.Digest, config.modes())
+		if err != nil {
+			return descs, err
+		}
+		if p == "" {
+			continue
+		}
+		body, err := os.ReadFile(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return descs, err
+		}
+		desc := newReferrerDescriptor(body, d.Digest, storedMediaType(p, body, config.manifestTypeDefaults()))
+		if artifactType != "" && desc.ArtifactType != artifactType {
+			continue
+		}
+		descs = append(descs, desc)
+	}
+	return descs, nil
+}
+
+// serveReferrers answers GET /v2/<name>/referrers/<digest> with an image
+// index of the manifests whose subject is digest.
+func (reg *registry) serveReferrers(w http.ResponseWriter, r *http.Request, name string) {
+	_, subject, _ := strings.Cut(r.URL.Path, "/referrers/")
+	if !matches(digestRegex, subject) {
+		writeOciError("DIGEST_INVALID", "invalid digest", w, 400)
+		return
+	}
+	artifactType := r.URL.Query().Get("artifactType")
+	descs, err := listReferrers(reg.rootDir, name, subject, artifactType, reg.config)
+	if err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	if artifactType != "" {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	w.Header().Set("Content-Type", v1.MediaTypeImageIndex)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageIndex,
+		"manifests":     descs,
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// referrerManifest returns an artifact manifest whose subject is body.
+func referrerManifest(artifactType string, body []byte) []byte {
+	b, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageManifest,
+		"artifactType":  artifactType,
+		"config":        v1.Descriptor{MediaType: "application/vnd.oci.empty.v1+json", Digest: emptyJSONDigest, Size: 2},
+		"layers":        []v1.Descriptor{},
+		"subject":       v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: digest.Digest(getDigest(body)), Size: int64(len(body))},
+	})
+	return b
+}
+
+func TestPutManifestWithSubject(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	image := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", "v1", image)
+
+	sig := referrerManifest("application/vnd.example.signature", image)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/v2/test/image/manifests/"+getDigest(sig), bytes.NewReader(sig))
+	req.Header.Set("Content-Type", v1.MediaTypeImageManifest)
+	reg.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Fatalf("want 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("OCI-Subject"); got != getDigest(image) {
+		t.Errorf("want OCI-Subject %s, got %q", getDigest(image), got)
+	}
+	sbom := referrerManifest("application/vnd.example.sbom", image)
+	putTestManifest(t, reg, "test/image", getDigest(sbom), sbom)
+
+	for artifactType, want := range map[string][]string{
+		"":                                  {getDigest(sig), getDigest(sbom)},
+		"application/vnd.example.signature": {getDigest(sig)},
+	} {
+		w = httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/referrers/"+getDigest(image)+"?artifactType="+artifactType, nil))
+		if w.Code != 200 {
+			t.Fatalf("want 200, got %d", w.Code)
+		}
+		var idx struct {
+			Manifests []referrerDescriptor `json:"manifests"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&idx); err != nil {
+			t.Fatal(err)
+		}
+		if len(idx.Manifests) != len(want) {
+			t.Fatalf("artifactType %q: want %d referrers, got %+v", artifactType, len(want), idx.Manifests)
+		}
+		for i, d := range want {
+			if idx.Manifests[i].Digest != d {
+				t.Errorf("artifactType %q: want referrer %s, got %s", artifactType, d, idx.Manifests[i].Digest)
+			}
+		}
+	}
+}
+
+func TestReferrersDescribeManifests(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	image := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", "v1", image)
+	sig, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageManifest,
+		"config":        v1.Descriptor{MediaType: "application/vnd.example.signature.config", Digest: emptyJSONDigest, Size: 2},
+		"layers":        []v1.Descriptor{},
+		"subject":       v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: digest.Digest(getDigest(image)), Size: int64(len(image))},
+		"annotations":   map[string]string{"org.example.signer": "ci"},
+	})
+	putTestManifest(t, reg, "test/image", getDigest(sig), sig)
+	// A referrers file that only records digests is described all the same.
+	b, _ := json.Marshal(referrersIndex{getDigest(image): {{Digest: getDigest(sig)}}})
+	if err := os.WriteFile(referrersPath(reg.rootDir, "test/image"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/referrers/"+getDigest(image), nil))
+	if w.Code != 200 {
+		t.Fatalf("want 200, got %d", w.Code)
+	}
+	var idx struct {
+		Manifests []referrerDescriptor `json:"manifests"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&idx); err != nil {
+		t.Fatal(err)
+	}
+	want := referrerDescriptor{
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.example.signature.config",
+		Digest:       getDigest(sig),
+		Size:         int64(len(sig)),
+		Annotations:  map[string]string{"org.example.signer": "ci"},
+	}
+	if len(idx.Manifests) != 1 || !reflect.DeepEqual(idx.Manifests[0], want) {
+		t.Errorf("want %+v, got %+v", want, idx.Manifests)
+	}
+}
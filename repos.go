@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// repoTracker records when each repository was last accessed so that the
+// number of repositories can be capped with -max-repos.
+type repoTracker struct {
+	mu         sync.Mutex
+	lastAccess map[string]time.Time
+	// pending counts the admitted pushes to each repository not stored yet,
+	// so that concurrent first pushes cannot go past the cap together.
+	pending map[string]int
+	// usage is told about evicted repositories; nil without
+	// -max-total-storage.
+	usage *storageUsage
+}
+
+// load seeds the tracker from the repositories already on disk, using their
+// modification time as the last access. Callers must hold t.mu.
+func (t *repoTracker) load(rootDir string) error {
+	if t.lastAccess != nil {
+		return nil
+	}
+	repos, err := listRepos(rootDir)
+	if err != nil {
+		return err
+	}
+	t.lastAccess = make(map[string]time.Time, len(repos))
+	for _, name := range repos {
+		fi, err := os.Stat(path.Join(rootDir, name))
+		if err != nil {
+			return err
+		}
+		t.lastAccess[name] = fi.ModTime()
+	}
+	return nil
+}
+
+// touch marks a known repository as accessed now.
+func (t *repoTracker) touch(rootDir string, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.load(rootDir); err != nil {
+		log.Printf("Unable to load repositories: %s", err)
+		return
+	}
+	if _, ok := t.lastAccess[name]; ok {
+		t.lastAccess[name] = time.Now()
+	}
+}
+
+// admit decides whether a push to name may go ahead. Pushes to existing
+// repositories are always admitted. Under "lru" every push is admitted, and
+// committed evicts other repositories once the push has stored content.
+// Under "reject" a push that would create a new repository is admitted while
+// fewer than max repositories are stored or being created, and reserves a
+// slot for name until release is called once the request is over.
+// Repositories are counted from disk, so failed or abandoned pushes do not
+// use up the limit.
+func (t *repoTracker) admit(rootDir string, name string, max int, policy string) (release func(), admitted bool, err error) {
+	release = func() {}
+	found, err := repoExists(rootDir, name)
+	if err != nil || found || policy == "lru" {
+		return release, err == nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending[name] == 0 {
+		repos, err := listRepos(rootDir)
+		if err != nil {
+			return release, false, err
+		}
+		count := len(repos)
+		for _, repo := range repos {
+			if t.pending[repo] > 0 {
+				count--
+			}
+		}
+		if count+len(t.pending) >= max {
+			return release, false, nil
+		}
+	}
+	if t.pending == nil {
+		t.pending = make(map[string]int)
+	}
+	t.pending[name]++
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.pending[name]--; t.pending[name] == 0 {
+			delete(t.pending, name)
+		}
+	}, true, nil
+}
+
+// committed marks name as accessed now that a push stored a blob or manifest
+// in it. With policy "lru" it then evicts the least recently used other
+// repositories until no more than max remain.
+func (t *repoTracker) committed(rootDir string, name string, max int, policy string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.load(rootDir); err != nil {
+		return err
+	}
+	t.lastAccess[name] = time.Now()
+	if policy != "lru" {
+		return nil
+	}
+	repos, err := listRepos(rootDir)
+	if err != nil {
+		return err
+	}
+	for len(repos) > max {
+		oldest := -1
+		for i, repo := range repos {
+			if repo != name && (oldest < 0 || t.accessed(rootDir, repo).Before(t.accessed(rootDir, repos[oldest]))) {
+				oldest = i
+			}
+		}
+		if oldest < 0 {
+			return nil
+		}
+		log.Printf("Repository limit of %d reached, evicting %s", max, repos[oldest])
+		err := removeRepo(rootDir, repos[oldest])
+		t.usage.invalidate()
+		if err != nil {
+			return err
+		}
+		delete(t.lastAccess, repos[oldest])
+		repos = append(repos[:oldest], repos[oldest+1:]...)
+	}
+	return nil
+}
+
+// accessed returns when repo was last accessed, falling back to the
+// modification time of its directory for a repository not seen yet, such as
+// one imported. Callers must hold t.mu.
+func (t *repoTracker) accessed(rootDir string, repo string) time.Time {
+	if accessed, ok := t.lastAccess[repo]; ok {
+		return accessed
+	}
+	fi, err := os.Stat(path.Join(rootDir, repo))
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// repoCommitted is called once a push has stored a blob or manifest in name,
+// to enforce -max-repos. Errors are only logged, as the push has succeeded.
+func (reg *registry) repoCommitted(name string) {
+	if reg.config.MaxRepos <= 0 {
+		return
+	}
+	if err := reg.repos.committed(reg.rootDir, name, reg.config.MaxRepos, reg.config.RepoEviction); err != nil {
+		log.Printf("Unable to enforce the repository limit: %s", err)
+	}
+}
+
+// rename follows a repository that was moved to a new name.
+func (t *repoTracker) rename(from string, to string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if accessed, ok := t.lastAccess[from]; ok {
+		delete(t.lastAccess, from)
+		t.lastAccess[to] = accessed
+	}
+}
+
+// readDir lists a directory of the storage root. Tests replace it to make
+// a repository unreadable.
+var readDir = os.ReadDir
+
+// listRepos walks the storage root and returns the name of every repository.
+// Each directory is read once, and whether it is a repository is told from
+// that same listing, so the result is a point-in-time view: a repository
+// pushed or deleted during the walk is either listed or not, but never fails
+// it. A directory that cannot be read is logged and skipped, so one bad
+// repository does not hide all the others.
+func listRepos(rootDir string) ([]string, error) {
+	repos := make([]string, 0)
+	files, err := readDir(rootDir)
+	if err != nil {
+		return repos, err
+	}
+	var walk func(name string, files []os.DirEntry)
+	walk = func(name string, files []os.DirEntry) {
+		if name != "" && holdsRepo(rootDir, name, files) {
+			repos = append(repos, name)
+		}
+		for _, de := range files {
+			if !de.IsDir() || strings.HasPrefix(de.Name(), "_") {
+				continue
+			}
+			child := path.Join(name, de.Name())
+			children, err := readDir(path.Join(rootDir, child))
+			if errors.Is(err, fs.ErrNotExist) {
+				// Deleted since its parent was read.
+				continue
+			}
+			if err != nil {
+				log.Printf("Skipping unreadable repository %s: %s", child, err)
+				continue
+			}
+			walk(child, children)
+		}
+	}
+	walk("", files)
+	return repos, nil
+}
+
+// isRepo reports whether the directory for name holds blobs or manifests of
+// its own, rather than only being the parent of nested repositories.
+func isRepo(rootDir string, name string) (bool, error) {
+	files, err := readDir(path.Join(rootDir, name))
+	if err != nil {
+		return false, err
+	}
+	return holdsRepo(rootDir, name, files), nil
+}
+
+// holdsRepo is isRepo for the files already read from the directory.
+func holdsRepo(rootDir string, name string, files []os.DirEntry) bool {
+	for _, de := range files {
+		if de.IsDir() && (de.Name() == "_blobs" || de.Name() == "_manifests") {
+			return true
+		}
+		if isTagDir(rootDir, name, de) {
+			return true
+		}
+	}
+	return false
+}
+
+// repoExists is isRepo for a name that may not exist on disk at all.
+func repoExists(rootDir string, name string) (bool, error) {
+	ok, err := isRepo(rootDir, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return ok, err
+}
+
+// moveRepo renames a repository by moving its blobs, manifests, tags and
+// internal files, such as the digest index, to a new name. As with removeRepo,
+// nested repositories stay where they are. When an entry cannot be moved, the
+// entries already moved are put back, so the repository is not left split
+// across both names. to must not be nested under from.
+func moveRepo(rootDir string, from string, to string, modes fileModes) error {
+	src := path.Join(rootDir, from)
+	dest := path.Join(rootDir, to)
+	files, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	defer storageGeneration.Add(1)
+	if err := makeDirs(dest, modes); err != nil {
+		return err
+	}
+	moved := make([]string, 0, len(files))
+	for _, de := range files {
+		if !strings.HasPrefix(de.Name(), "_") && !isTagDir(rootDir, from, de) {
+			continue
+		}
+		if err := os.Rename(path.Join(src, de.Name()), path.Join(dest, de.Name())); err != nil {
+			for _, entry := range moved {
+				if err := os.Rename(path.Join(dest, entry), path.Join(src, entry)); err != nil {
+					log.Printf("Unable to move %s back to %s: %s", entry, from, err)
+				}
+			}
+			// Only succeeds when the target was created for the move.
+			_ = os.Remove(dest)
+			return err
+		}
+		moved = append(moved, de.Name())
+	}
+	// Only succeeds once no nested repositories remain.
+	_ = os.Remove(src)
+	return nil
+}
+
+// removeRepo deletes the blobs, manifests and tags of a repository while
+// leaving any nested repositories in place.
+func removeRepo(rootDir string, name string) error {
+	dir := path.Join(rootDir, name)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	defer storageGeneration.Add(1)
+	for _, de := range files {
+		if strings.HasPrefix(de.Name(), "_") || isTagDir(rootDir, name, de) {
+			if err := os.RemoveAll(path.Join(dir, de.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	// Only succeeds once no nested repositories remain.
+	_ = os.Remove(dir)
+	return nil
+}
+
+// writeNotFound answers 404 for content missing from a repository. When the
+// repository itself does not exist the error is NAME_UNKNOWN instead of code,
+// so clients can tell a wrong name from missing content.
+func (reg *registry) writeNotFound(w http.ResponseWriter, name string, code string, message string) {
+	found, err := repoExists(reg.rootDir, name)
+	if err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	if !found {
+		writeOciError("NAME_UNKNOWN", "repository name not known to registry", w, 404)
+		return
+	}
+	writeOciError(code, message, w, 404)
+}
+
+// Catalog is the response to GET /v2/_catalog.
+type Catalog struct {
+	Repositories []string `json:"repositories"`
+}
+
+// serveCatalog lists the repositories of the registry. Unreadable
+// repositories are left out rather than failing the whole listing.
+func (reg *registry) serveCatalog(w http.ResponseWriter, r *http.Request) {
+	repos, err := listRepos(reg.rootDir)
+	if err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	repos, ok := paginate(w, r, repos)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Catalog{Repositories: repos})
+}
+
+// RepoInfo is the response to GET /v2/<name>/_info.
+type RepoInfo struct {
+	Name      string    `json:"name"`
+	Created   time.Time `json:"created"`
+	LastPush  time.Time `json:"lastPush"`
+	Tags      int       `json:"tags"`
+	Manifests int       `json:"manifests"`
+	SizeBytes int64     `json:"sizeBytes"`
+	Storage   string    `json:"storage"`
+	// ConfigMediaTypes are the distinct config media types of the
+	// manifests, such as application/vnd.oci.image.config.v1+json for
+	// images or application/vnd.cncf.helm.config.v1+json for Helm charts.
+	ConfigMediaTypes []string `json:"configMediaTypes"`
+}
+
+// serveRepoInfo describes a repository for dashboards. With -metrics the
+// figures come from the metrics cache, so they may be as old as
+// -metrics-refresh. The config media types are always read afresh, which
+// keeps the metrics refresh from parsing every manifest.
+func (reg *registry) serveRepoInfo(w http.ResponseWriter, name string) {
+	found, err := repoExists(reg.rootDir, name)
+	if err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	if !found {
+		writeOciError("NAME_UNKNOWN", "repository name not known to registry", w, 404)
+		return
+	}
+	s, err := reg.stats.repo(reg.rootDir, reg.config.layout(), name)
+	if err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	configTypes, err := configMediaTypes(reg.rootDir, name)
+	if err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RepoInfo{
+		Name:             name,
+		Created:          s.created.UTC(),
+		LastPush:         s.pushed.UTC(),
+		Tags:             s.tags,
+		Manifests:        s.manifests,
+		SizeBytes:        s.bytes,
+		Storage:          "filesystem",
+		ConfigMediaTypes: configTypes,
+	})
+}
+
+// configMediaTypes returns the distinct config media types of the manifests
+// of a repository, sorted.
+func configMediaTypes(rootDir string, name string) ([]string, error) {
+	types := make([]string, 0)
+	tags, err := getTags(path.Join(rootDir, name))
+	if err != nil {
+		return types, err
+	}
+	digests, err := listDigestManifests(rootDir, name)
+	if err != nil {
+		return types, err
+	}
+	paths := make([]string, 0, len(tags)+len(digests))
+	for _, tag := range tags {
+		paths = append(paths, tagManifestPath(rootDir, name, tag))
+	}
+	for _, d := range digests {
+		paths = append(paths, digestManifestPath(rootDir, name, d))
+	}
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return types, err
+		}
+		if c := parseManifestRefs(b).Config; c != nil && c.MediaType != "" && !seen[c.MediaType] {
+			seen[c.MediaType] = true
+			types = append(types, c.MediaType)
+		}
+	}
+	sort.Strings(types)
+	return types, nil
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func putTestBlobRequest(reg *registry, name string, content []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	url := "/v2/" + name + "/blobs/uploads/some-id?digest=" + getDigest(content)
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", url, bytes.NewReader(content)))
+	return w
+}
+
+func TestMaxReposReject(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{MaxRepos: 1, RepoEviction: "reject"}}
+	if w := putTestBlobRequest(reg, "first", []byte("a")); w.Code != 201 {
+		t.Fatalf("want 201, got %d", w.Code)
+	}
+	if w := putTestBlobRequest(reg, "first", []byte("b")); w.Code != 201 {
+		t.Fatalf("push to existing repo: want 201, got %d", w.Code)
+	}
+	w := putTestBlobRequest(reg, "second", []byte("c"))
+	if w.Code != 403 {
+		t.Fatalf("want 403 at the repository cap, got %d", w.Code)
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte("DENIED")) {
+		t.Errorf("want DENIED, got %q", w.Body.String())
+	}
+}
+
+// gatedReader reports its first read on ready, then waits for gate to be
+// closed before reading content.
+type gatedReader struct {
+	content io.Reader
+	ready   chan<- struct{}
+	gate    <-chan struct{}
+	once    sync.Once
+}
+
+func (r *gatedReader) Read(p []byte) (int, error) {
+	r.once.Do(func() {
+		r.ready <- struct{}{}
+		<-r.gate
+	})
+	return r.content.Read(p)
+}
+
+func TestMaxReposRejectConcurrent(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{MaxRepos: 2, RepoEviction: "reject"}}
+	if w := putTestBlobRequest(reg, "first", []byte("first")); w.Code != 201 {
+		t.Fatalf("want 201, got %d", w.Code)
+	}
+
+	// Every push is either refused or reading its blob before any is stored.
+	const pushes = 4
+	ready := make(chan struct{}, pushes)
+	gate := make(chan struct{})
+	codes := make(chan int, pushes)
+	for i := 0; i < pushes; i++ {
+		content := []byte(fmt.Sprint("layer ", i))
+		body := &gatedReader{content: bytes.NewReader(content), ready: ready, gate: gate}
+		url := fmt.Sprintf("/v2/new-%d/blobs/uploads/some-id?digest=%s", i, getDigest(content))
+		go func() {
+			w := httptest.NewRecorder()
+			reg.ServeHTTP(w, httptest.NewRequest("PUT", url, body))
+			if w.Code != 201 {
+				ready <- struct{}{}
+			}
+			codes <- w.Code
+		}()
+	}
+	for i := 0; i < pushes; i++ {
+		<-ready
+	}
+	close(gate)
+	created := 0
+	for i := 0; i < pushes; i++ {
+		if <-codes == 201 {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Errorf("want one new repository admitted at the cap, got %d", created)
+	}
+	if repos, err := listRepos(reg.rootDir); err != nil || len(repos) != 2 {
+		t.Errorf("want 2 repositories stored, got %v (%v)", repos, err)
+	}
+}
+
+func TestMaxReposEvictLRU(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{MaxRepos: 2, RepoEviction: "lru"}}
+	first := []byte("first")
+	putTestBlobRequest(reg, "first", first)
+	putTestBlobRequest(reg, "second", []byte("second"))
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("HEAD", "/v2/first/blobs/"+getDigest(first), nil))
+	if w.Code != 200 {
+		t.Fatalf("want 200, got %d", w.Code)
+	}
+
+	if w := putTestBlobRequest(reg, "third", []byte("third")); w.Code != 201 {
+		t.Fatalf("want 201 with LRU eviction, got %d", w.Code)
+	}
+	if _, err := os.Stat(path.Join(reg.rootDir, "second")); !os.IsNotExist(err) {
+		t.Errorf("least recently used repository was not evicted")
+	}
+	repos, err := listRepos(reg.rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 2 || repos[0] != "first" || repos[1] != "third" {
+		t.Errorf("want [first third], got %v", repos)
+	}
+}
+
+func TestMaxReposEvictOnImport(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{MaxRepos: 1, RepoEviction: "lru"}}
+	pushTestImage(t, reg, "test/image", "v1", []byte("layer"))
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/_export", nil))
+	archive := w.Body.Bytes()
+
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("POST", "/v2/test/copy/_import", bytes.NewReader(archive)))
+	if w.Code != 201 {
+		t.Fatalf("want 201, got %d: %s", w.Code, w.Body.String())
+	}
+	repos, err := listRepos(reg.rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 1 || repos[0] != "test/copy" {
+		t.Errorf("want the import to evict test/image, got %v", repos)
+	}
+}
+
+func putMismatchedTestBlob(reg *registry, name string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	url := "/v2/" + name + "/blobs/uploads/some-id?digest=" + getDigest([]byte("expected"))
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", url, strings.NewReader("actual")))
+	return w
+}
+
+func TestMaxReposIgnoresFailedPushes(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{MaxRepos: 1, RepoEviction: "reject"}}
+	if w := putMismatchedTestBlob(reg, "failed"); w.Code != 400 {
+		t.Fatalf("want 400 for a mismatched blob, got %d", w.Code)
+	}
+	if w := putTestBlobRequest(reg, "first", []byte("a")); w.Code != 201 {
+		t.Errorf("a failed push must not use up a repository slot, got %d", w.Code)
+	}
+
+	reg = &registry{rootDir: t.TempDir(), config: Config{MaxRepos: 1, RepoEviction: "lru"}}
+	first := []byte("first")
+	putTestBlobRequest(reg, "first", first)
+	if w := putMismatchedTestBlob(reg, "second"); w.Code != 400 {
+		t.Fatalf("want 400 for a mismatched blob, got %d", w.Code)
+	}
+	if ok, err := blobExists(reg.rootDir, reg.config.layout(), "first", getDigest(first)); err != nil || !ok {
+		t.Errorf("a failed push must not evict a repository")
+	}
+}
+
+func TestMoveRepo(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{AllowMove: true}}
+	layer := []byte("layer")
+	m := pushTestImage(t, reg, "test/image", "v1", layer)
+	pushTestImage(t, reg, "test/image/nested", "v1", []byte("nested"))
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("POST", "/v2/test/image/_move?to=team/image", nil))
+	if w.Code != 202 {
+		t.Fatalf("want 202, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := getTestManifest(reg, "team/image", "v1"); w.Code != 200 || !bytes.Equal(w.Body.Bytes(), m) {
+		t.Fatalf("want manifest pullable from the new name, got %d", w.Code)
+	}
+	if w := getTestManifest(reg, "team/image", getDigest(m)); w.Code != 200 {
+		t.Errorf("want manifest pullable by digest from the new name, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/team/image/blobs/"+getDigest(layer), nil))
+	if w.Code != 200 {
+		t.Errorf("want layer pullable from the new name, got %d", w.Code)
+	}
+	if w := getTestManifest(reg, "test/image", "v1"); w.Code != 404 {
+		t.Errorf("want old name gone, got %d", w.Code)
+	}
+	if w := getTestManifest(reg, "test/image/nested", "v1"); w.Code != 200 {
+		t.Errorf("want nested repository left in place, got %d", w.Code)
+	}
+}
+
+func TestMoveRepoRefused(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	pushTestImage(t, reg, "test/image", "v1", []byte("layer"))
+	pushTestImage(t, reg, "test/other", "v1", []byte("other"))
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("POST", "/v2/test/image/_move?to=team/image", nil))
+	if w.Code != 405 {
+		t.Errorf("want 405 while moves are disabled, got %d", w.Code)
+	}
+
+	reg.config.AllowMove = true
+	for target, want := range map[string]int{"test/other": 409, "Invalid": 400, "test/image": 400, "test/image/sub": 400} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("POST", "/v2/test/image/_move?to="+target, nil))
+		if w.Code != want {
+			t.Errorf("move to %s: want %d, got %d", target, want, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("POST", "/v2/test/missing/_move?to=team/missing", nil))
+	if w.Code != 404 {
+		t.Errorf("want 404 for an unknown repository, got %d", w.Code)
+	}
+}
+
+func TestMoveRepoRollsBack(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	m := pushTestImage(t, reg, "test/image", "v1", []byte("layer"))
+	// The tag is moved last and cannot replace this non-empty directory.
+	if err := os.MkdirAll(path.Join(reg.rootDir, "team/image/v1/keep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveRepo(reg.rootDir, "test/image", "team/image", reg.config.modes()); err == nil {
+		t.Fatal("want the move to fail")
+	}
+	if w := getTestManifest(reg, "test/image", "v1"); w.Code != 200 || !bytes.Equal(w.Body.Bytes(), m) {
+		t.Errorf("want the repository intact under its old name, got %d", w.Code)
+	}
+	if w := getTestManifest(reg, "test/image", getDigest(m)); w.Code != 200 {
+		t.Errorf("want the manifest pullable by digest under the old name, got %d", w.Code)
+	}
+	if _, err := os.Stat(path.Join(reg.rootDir, "team/image/_blobs")); !os.IsNotExist(err) {
+		t.Errorf("want no blobs left under the new name")
+	}
+}
+
+func TestUnknownRepoErrors(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	putTestManifest(t, reg, "test/image", "v1", []byte(testManifest))
+	missing := getDigest([]byte("missing"))
+	for _, c := range []struct {
+		method, path, code string
+	}{
+		{"GET", "/v2/test/other/tags/list", "NAME_UNKNOWN"},
+		{"GET", "/v2/test/other/manifests/v1", "NAME_UNKNOWN"},
+		{"GET", "/v2/test/other/blobs/" + missing, "NAME_UNKNOWN"},
+		{"GET", "/v2/test/image/manifests/v2", "MANIFEST_UNKNOWN"},
+		{"GET", "/v2/test/image/blobs/" + missing, "BLOB_UNKNOWN"},
+		// The empty JSON blob is always present, but not in a missing repository.
+		{"GET", "/v2/test/other/blobs/" + emptyJSONDigest, "NAME_UNKNOWN"},
+		// A parent of repositories is not a repository itself.
+		{"GET", "/v2/test/tags/list", "NAME_UNKNOWN"},
+	} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		if w.Code != 404 || !strings.Contains(w.Body.String(), `"`+c.code+`"`) {
+			t.Errorf("%s %s: want 404 %s, got %d: %s", c.method, c.path, c.code, w.Code, w.Body.String())
+		}
+	}
+	for _, p := range []string{"/v2/test/other/manifests/v1", "/v2/test/other/blobs/" + missing, "/v2/test/other/blobs/" + emptyJSONDigest} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("HEAD", p, nil))
+		if w.Code != 404 {
+			t.Errorf("HEAD %s: want 404, got %d", p, w.Code)
+		}
+	}
+}
+
+func TestEmptyJSONBlobUnreadableRepo(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	putTestManifest(t, reg, "test/image", "v1", []byte(testManifest))
+	// The repository cannot be read once, which must not pass for the blob
+	// being missing.
+	failed := false
+	defer func(orig func(string) ([]os.DirEntry, error)) { readDir = orig }(readDir)
+	readDir = func(p string) ([]os.DirEntry, error) {
+		if p == path.Join(reg.rootDir, "test/image") && !failed {
+			failed = true
+			return nil, os.ErrPermission
+		}
+		return os.ReadDir(p)
+	}
+	for _, method := range []string{"GET", "HEAD"} {
+		failed = false
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest(method, "/v2/test/image/blobs/"+emptyJSONDigest, nil))
+		if w.Code != 500 {
+			t.Errorf("%s: want 500, got %d", method, w.Code)
+		}
+	}
+}
+
+func TestCatalogSkipsUnreadableRepo(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	for _, name := range []string{"test/a", "test/b", "test/c"} {
+		putTestManifest(t, reg, name, "v1", []byte(testManifest))
+	}
+	defer func(orig func(string) ([]os.DirEntry, error)) { readDir = orig }(readDir)
+	readDir = func(p string) ([]os.DirEntry, error) {
+		if p == path.Join(reg.rootDir, "test/b") {
+			return nil, os.ErrPermission
+		}
+		return os.ReadDir(p)
+	}
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/_catalog", nil))
+	if w.Code != 200 {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var c Catalog
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(c.Repositories, ",") != "test/a,test/c" {
+		t.Errorf("want test/a and test/c listed, got %v", c.Repositories)
+	}
+
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/_catalog?n=1", nil))
+	if !strings.Contains(w.Body.String(), `"test/a"`) || !strings.Contains(w.Header().Get("Link"), "last=test%2Fa") {
+		t.Errorf("want the first page with a Link to the next, got %s (%s)", w.Body.String(), w.Header().Get("Link"))
+	}
+}
+
+func TestRepoInfo(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	before := time.Now().Add(-time.Second)
+	layer := []byte("layer")
+	if w := putTestBlobRequest(reg, "test/image", layer); w.Code != 201 {
+		t.Fatalf("blob push failed with %d", w.Code)
+	}
+	manifest := imageManifest(emptyJSONDigest, getDigest(layer))
+	putTestManifest(t, reg, "test/image", "v1", manifest)
+	putTestManifest(t, reg, "test/image", "v2", manifest)
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/_info", nil))
+	if w.Code != 200 {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var info RepoInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "test/image" || info.Tags != 2 || info.Manifests != 1 || info.Storage != "filesystem" {
+		t.Errorf("unexpected info %+v", info)
+	}
+	if want := int64(len(layer) + len(manifest)); info.SizeBytes != want {
+		t.Errorf("want %d bytes, got %d", want, info.SizeBytes)
+	}
+	if info.Created.Before(before) || info.LastPush.Before(info.Created) {
+		t.Errorf("want push times since the test started, got created %s and last push %s", info.Created, info.LastPush)
+	}
+	if len(info.ConfigMediaTypes) != 1 || info.ConfigMediaTypes[0] != v1.MediaTypeImageConfig {
+		t.Errorf("want the image config media type, got %v", info.ConfigMediaTypes)
+	}
+
+	// A Helm chart pushed by digest alongside the image.
+	chart := []byte(strings.Replace(string(manifest), v1.MediaTypeImageConfig, "application/vnd.cncf.helm.config.v1+json", 1))
+	putTestManifest(t, reg, "test/image", getDigest(chart), chart)
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/_info", nil))
+	info = RepoInfo{}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"application/vnd.cncf.helm.config.v1+json", v1.MediaTypeImageConfig}; strings.Join(info.ConfigMediaTypes, ",") != strings.Join(want, ",") {
+		t.Errorf("want config media types %v, got %v", want, info.ConfigMediaTypes)
+	}
+
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/other/_info", nil))
+	if w.Code != 404 {
+		t.Errorf("unknown repository: want 404, got %d", w.Code)
+	}
+}
+
+func TestCatalogWhilePushing(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	putTestManifest(t, reg, "test/image", "v1", []byte(testManifest))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			name := fmt.Sprintf("test/new/image-%d", i)
+			if w := putTestBlobRequest(reg, name, []byte(name)); w.Code != 201 {
+				t.Errorf("push to %s failed with %d", name, w.Code)
+			}
+		}
+	}()
+	for pushing := true; pushing; {
+		select {
+		case <-done:
+			pushing = false
+		default:
+		}
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/_catalog", nil))
+		if w.Code != 200 {
+			t.Fatalf("want 200 while pushing, got %d: %s", w.Code, w.Body.String())
+		}
+		var c Catalog
+		if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Repositories) == 0 || c.Repositories[0] != "test/image" {
+			t.Fatalf("want test/image listed first, got %v", c.Repositories)
+		}
+		if !pushing && len(c.Repositories) != 51 {
+			t.Errorf("want every repository once pushes are done, got %d", len(c.Repositories))
+		}
+	}
+}
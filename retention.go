@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// retainedTag is a tag considered by the retention policy.
+type retainedTag struct {
+	tag    string
+	digest string
+	pushed time.Time
+}
+
+// pruneTags applies the tag retention policy to a repository after tag was
+// pushed with r. A tag is kept while it is among the -keep-last-n most
+// recently pushed tags or was pushed within -keep-max-age; with both set,
+// meeting either is enough. Other tags are deleted, leaving their blobs to
+// garbage collection. Tags of pinned manifests are never deleted and do not
+// count towards -keep-last-n, and the tag just pushed is always kept.
+// Failures are logged since the push itself has succeeded.
+func (reg *registry) pruneTags(r *http.Request, name string, tag string) {
+	tags, err := reg.listRetainedTags(name)
+	if err != nil {
+		log.Printf("Unable to apply tag retention to %s: %s", name, err)
+		return
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if (tags[i].tag == tag) != (tags[j].tag == tag) {
+			return tags[i].tag == tag
+		}
+		return tags[i].pushed.After(tags[j].pushed)
+	})
+	lastN, maxAge := reg.config.KeepLastN, time.Duration(reg.config.KeepMaxAge)
+	for i, t := range tags {
+		if t.tag == tag || (lastN > 0 && i < lastN) || (maxAge > 0 && time.Since(t.pushed) < maxAge) {
+			continue
+		}
+		// The digest guards against deleting a tag pushed again meanwhile.
+		d, err := reg.deleteTag(name, t.tag, t.digest)
+		if err != nil {
+			log.Printf("Unable to apply tag retention to %s: %s", name, err)
+			return
+		}
+		if d != "" {
+			log.Printf("Tag retention deleted %s:%s", name, t.tag)
+			reg.usage.invalidate()
+			reg.notifier.manifest(r, "delete", name, t.tag, d, "", 0)
+		}
+	}
+}
+
+// listRetainedTags returns the tags of a repository that retention may
+// delete, that is all but those of pinned manifests.
+func (reg *registry) listRetainedTags(name string) ([]retainedTag, error) {
+	tags, err := getTags(path.Join(reg.rootDir, name))
+	if err != nil {
+		return nil, err
+	}
+	pins, err := loadPins(reg.rootDir, name)
+	if err != nil {
+		return nil, err
+	}
+	retained := make([]retainedTag, 0, len(tags))
+	for _, tag := range tags {
+		p := tagManifestPath(reg.rootDir, name, tag)
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		d := getDigest(b)
+		if pins[d] {
+			continue
+		}
+		retained = append(retained, retainedTag{tag: tag, digest: d, pushed: fi.ModTime()})
+	}
+	return retained, nil
+}
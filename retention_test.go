@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// pushAgedTags pushes tags v1 to vN, each an hour older than the next.
+func pushAgedTags(t *testing.T, reg *registry, name string, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		tag := fmt.Sprintf("v%d", i)
+		putTestManifest(t, reg, name, tag, imageManifest(emptyJSONDigest, getDigest([]byte(tag))))
+		pushed := time.Now().Add(time.Duration(i-n-1) * time.Hour)
+		if err := os.Chtimes(tagManifestPath(reg.rootDir, name, tag), pushed, pushed); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKeepLastN(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{KeepLastN: 3}}
+	pushAgedTags(t, reg, "test/image", 3)
+	for _, tag := range []string{"v4", "v5"} {
+		putTestManifest(t, reg, "test/image", tag, imageManifest(emptyJSONDigest, getDigest([]byte(tag))))
+	}
+	for tag, want := range map[string]int{"v1": 404, "v2": 404, "v3": 200, "v4": 200, "v5": 200} {
+		if w := getTestManifest(reg, "test/image", tag); w.Code != want {
+			t.Errorf("%s: want %d, got %d", tag, want, w.Code)
+		}
+	}
+}
+
+func TestKeepLastNSkipsPinned(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{KeepLastN: 1}}
+	v1 := imageManifest(emptyJSONDigest, getDigest([]byte("v1")))
+	putTestManifest(t, reg, "test/image", "v1", v1)
+	if err := setPin(reg.rootDir, "test/image", getDigest(v1), true, reg.config.modes(), false); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"v2", "v3"} {
+		putTestManifest(t, reg, "test/image", tag, imageManifest(emptyJSONDigest, getDigest([]byte(tag))))
+	}
+	for tag, want := range map[string]int{"v1": 200, "v2": 404, "v3": 200} {
+		if w := getTestManifest(reg, "test/image", tag); w.Code != want {
+			t.Errorf("%s: want %d, got %d", tag, want, w.Code)
+		}
+	}
+}
+
+func TestKeepMaxAge(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	pushAgedTags(t, reg, "test/image", 3)
+	reg.config.KeepMaxAge = Duration(150 * time.Minute)
+	putTestManifest(t, reg, "test/image", "v4", imageManifest(emptyJSONDigest, getDigest([]byte("v4"))))
+	for tag, want := range map[string]int{"v1": 404, "v2": 200, "v3": 200, "v4": 200} {
+		if w := getTestManifest(reg, "test/image", tag); w.Code != want {
+			t.Errorf("%s: want %d, got %d", tag, want, w.Code)
+		}
+	}
+}
+
+func TestKeepLastNOrMaxAge(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	pushAgedTags(t, reg, "test/image", 3)
+	// v3 is kept by count and v2 by age, but v1 by neither.
+	reg.config.KeepLastN = 2
+	reg.config.KeepMaxAge = Duration(150 * time.Minute)
+	putTestManifest(t, reg, "test/image", "v4", imageManifest(emptyJSONDigest, getDigest([]byte("v4"))))
+	for tag, want := range map[string]int{"v1": 404, "v2": 200, "v3": 200, "v4": 200} {
+		if w := getTestManifest(reg, "test/image", tag); w.Code != want {
+			t.Errorf("%s: want %d, got %d", tag, want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import "time"
+
+// retry calls fn until it succeeds or has been called attempts times, waiting
+// backoff after the first failure and twice as long after each one since. It
+// returns the last error.
+func retry(attempts int, backoff time.Duration, fn func() error) error {
+	wait := backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= attempts {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
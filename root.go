@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// version, commit and buildDate describe the build. They are set when
+// building with -ldflags, for example:
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// buildInfo is the response to GET /v2/_version.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+}
+
+func currentBuild() buildInfo {
+	return buildInfo{Version: version, Commit: commit, BuildDate: buildDate}
+}
+
+func (b buildInfo) String() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", b.Version, b.Commit, b.BuildDate)
+}
+
+// serveVersion answers GET /v2/_version with the build of the registry, so
+// that operators can confirm what is deployed.
+func serveVersion(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentBuild())
+}
+
+// rootInfo is the response to GET /.
+type rootInfo struct {
+	Service string `json:"service"`
+	Version string `json:"version"`
+	API     string `json:"api"`
+}
+
+// rootHandler answers requests for the root path, such as a person or a
+// health check hitting the base URL, with what is served there. Other paths
+// outside the API get the usual unknown endpoint error.
+type rootHandler struct {
+	service string
+}
+
+func (h *rootHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeUnknownEndpoint(r, w)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeOciError("UNSUPPORTED", "the root path only serves GET", w, 405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rootInfo{Service: h.service, Version: version, API: "/v2/"})
+}
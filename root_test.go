@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRootInfo(t *testing.T) {
+	h := &rootHandler{service: "example-registry"}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("want 200 JSON, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var info rootInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if want := (rootInfo{Service: "example-registry", Version: version, API: "/v2/"}); info != want {
+		t.Errorf("want %+v, got %+v", want, info)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/favicon.ico", nil))
+	if w.Code != 404 {
+		t.Errorf("want 404 for other paths, got %d", w.Code)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "v1.2.0", "0123abc", "2024-05-01T12:00:00Z"
+	reg := &registry{rootDir: t.TempDir()}
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/_version", nil))
+	if w.Code != 200 {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var info buildInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if want := (buildInfo{Version: "v1.2.0", Commit: "0123abc", BuildDate: "2024-05-01T12:00:00Z"}); info != want {
+		t.Errorf("want %+v, got %+v", want, info)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// scrubBatch is how many blobs are re-hashed on each scrub cycle.
+	scrubBatch = 100
+	// scrubRate caps the bytes per second the scrubber reads from disk so that
+	// it does not starve requests being served.
+	scrubRate = 32 << 20
+)
+
+// scrubber periodically re-hashes stored blobs to detect bit-rot before a
+// client pulls a corrupt layer. Each cycle checks the next batch of blobs in
+// a fixed order, so the whole store is covered over successive cycles.
+// Corrupt blobs are moved to <name>/_quarantine, after which the registry
+// reports them as unknown and clients can push them again.
+type scrubber struct {
+	rootDir string
+	layout  *pathTemplate
+	modes   fileModes
+	batch   int
+	rate    int64
+	// cache skips blobs verified recently and unchanged since; nil to always
+	// hash them.
+	cache *digestCache
+	// next is the path of the first blob to check in the next cycle.
+	next string
+}
+
+func (s *scrubber) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := s.scrubOnce(); err != nil {
+			log.Printf("Blob scrub failed: %s", err)
+		}
+	}
+}
+
+type scrubTarget struct {
+	name   string
+	digest string
+	path   string
+}
+
+// scrubOnce checks one batch of blobs and returns the paths of the blobs it
+// quarantined.
+func (s *scrubber) scrubOnce() ([]string, error) {
+	repos, err := listRepos(s.rootDir)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]scrubTarget, 0)
+	for _, name := range repos {
+		digests, err := listBlobs(s.rootDir, s.layout, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range digests {
+			targets = append(targets, scrubTarget{name, d, blobPath(s.rootDir, s.layout, name, d)})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].path < targets[j].path })
+	start := sort.Search(len(targets), func(i int) bool { return targets[i].path >= s.next })
+	n := s.batch
+	if n <= 0 || n > len(targets) {
+		n = len(targets)
+	}
+
+	quarantined := make([]string, 0)
+	for i := 0; i < n; i++ {
+		t := targets[(start+i)%len(targets)]
+		fi, err := os.Stat(t.path)
+		if err != nil {
+			log.Printf("Unable to scrub %s: %s", t.path, err)
+			continue
+		}
+		if s.cache.verified(t.path, t.digest, fi) {
+			continue
+		}
+		ok, err := s.verify(t.path, t.digest)
+		if err != nil {
+			log.Printf("Unable to scrub %s: %s", t.path, err)
+			continue
+		}
+		if ok {
+			s.cache.add(t.path, t.digest, fi)
+		} else {
+			log.Printf("Blob %s in %s does not match its digest, quarantining", t.digest, t.name)
+			if err := quarantineBlob(s.rootDir, s.layout, t.name, t.digest, s.modes); err != nil {
+				log.Printf("Unable to quarantine %s: %s", t.path, err)
+				continue
+			}
+			quarantined = append(quarantined, t.path)
+		}
+	}
+	s.next = ""
+	if end := start + n; end < len(targets) {
+		s.next = targets[end].path
+	}
+	paths := make([]string, 0, len(targets))
+	for _, t := range targets {
+		paths = append(paths, t.path)
+	}
+	if err := s.cache.save(paths); err != nil {
+		log.Printf("Unable to save the digest cache: %s", err)
+	}
+	return quarantined, nil
+}
+
+// verify re-hashes a blob at no more than s.rate bytes per second.
+func (s *scrubber) verify(p string, digest string) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if s.rate > 0 {
+		r = &throttledReader{r: f, rate: s.rate, start: time.Now()}
+	}
+	h := algorithmFor(digest)
+	if _, err := io.Copy(h, r); err != nil {
+		return false, err
+	}
+	return sumDigest(h, digest) == digest, nil
+}
+
+// quarantineBlob moves a blob out of the blob store, keeping it for
+// inspection.
+func quarantineBlob(rootDir string, layout *pathTemplate, name string, digest string, modes fileModes) error {
+	dest := path.Join(rootDir, name, "_quarantine", strings.Replace(digest, ":", "-", 1))
+	if err := makeDirs(path.Dir(dest), modes); err != nil {
+		return err
+	}
+	defer storageGeneration.Add(1)
+	return os.Rename(blobPath(rootDir, layout, name, digest), dest)
+}
+
+// throttledReader sleeps as needed to keep reads at no more than rate bytes
+// per second on average.
+type throttledReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	due := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+	if wait := due - time.Since(t.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
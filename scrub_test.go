@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestScrubQuarantinesCorruptBlob(t *testing.T) {
+	rootDir := t.TempDir()
+	good := putTestBlob(t, rootDir, "test/image", []byte("good"))
+	bad := putTestBlob(t, rootDir, "test/image", []byte("original"))
+	if err := os.WriteFile(blobPath(rootDir, defaultLayout, "test/image", bad), []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &scrubber{rootDir: rootDir, layout: defaultLayout}
+	quarantined, err := s.scrubOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 1 || quarantined[0] != blobPath(rootDir, defaultLayout, "test/image", bad) {
+		t.Fatalf("want the corrupt blob flagged, got %v", quarantined)
+	}
+	if ok, _ := blobExists(rootDir, defaultLayout, "test/image", bad); ok {
+		t.Error("corrupt blob still in the blob store")
+	}
+	if ok, _ := blobExists(rootDir, defaultLayout, "test/image", good); !ok {
+		t.Error("intact blob was quarantined")
+	}
+	if _, err := os.Stat(path.Join(rootDir, "test/image", "_quarantine")); err != nil {
+		t.Errorf("corrupt blob not kept in quarantine: %s", err)
+	}
+}
+
+func TestScrubRotatesBatches(t *testing.T) {
+	rootDir := t.TempDir()
+	for _, content := range []string{"one", "two", "three"} {
+		d := putTestBlob(t, rootDir, "test/image", []byte(content))
+		if err := os.WriteFile(blobPath(rootDir, defaultLayout, "test/image", d), []byte("corrupt"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &scrubber{rootDir: rootDir, layout: defaultLayout, batch: 2}
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		quarantined, err := s.scrubOnce()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(quarantined) > 2 {
+			t.Errorf("cycle %d checked more than a batch: %v", i, quarantined)
+		}
+		for _, p := range quarantined {
+			seen[p] = true
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("want every blob checked over two cycles, got %v", seen)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// shortDigestRegex matches an abbreviated digest, like git's short hashes.
+const shortDigestRegex string = "^(sha256:[a-f0-9]{4,63}|sha512:[a-f0-9]{4,127})$"
+
+// expandBlobDigest resolves a short digest to the one stored blob it
+// abbreviates. Otherwise it writes a 404, or a 300 listing the candidates
+// when the prefix is ambiguous, and returns false.
+func (reg *registry) expandBlobDigest(w http.ResponseWriter, name string, prefix string) (string, bool) {
+	digests, err := listBlobs(reg.rootDir, reg.config.layout(), name)
+	if err != nil {
+		reg.writeServerError(err, w)
+		return "", false
+	}
+	digests = append(digests, emptyJSONDigest)
+	return expandDigest(w, prefix, digests, "BLOB_UNKNOWN", "blob unknown to registry")
+}
+
+// expandManifestDigest is expandBlobDigest for the manifests of a repository,
+// whether tagged or pushed by digest.
+func (reg *registry) expandManifestDigest(w http.ResponseWriter, name string, prefix string) (string, bool) {
+	digests, err := listDigestManifests(reg.rootDir, name)
+	if err != nil {
+		reg.writeServerError(err, w)
+		return "", false
+	}
+	tags, err := getTags(path.Join(reg.rootDir, name))
+	if err != nil {
+		reg.writeServerError(err, w)
+		return "", false
+	}
+	for _, tag := range tags {
+		b, err := readFile(tagManifestPath(reg.rootDir, name, tag))
+		if err != nil {
+			reg.writeServerError(err, w)
+			return "", false
+		}
+		digests = append(digests, getDigest(b.Bytes()))
+	}
+	return expandDigest(w, prefix, digests, "MANIFEST_UNKNOWN", "manifest unknown to registry")
+}
+
+func expandDigest(w http.ResponseWriter, prefix string, digests []string, unknownCode string, unknownMessage string) (string, bool) {
+	found := make(map[string]bool)
+	for _, d := range digests {
+		if strings.HasPrefix(d, prefix) {
+			found[d] = true
+		}
+	}
+	switch len(found) {
+	case 0:
+		writeOciError(unknownCode, unknownMessage, w, 404)
+		return "", false
+	case 1:
+		for d := range found {
+			return d, true
+		}
+	}
+	matches := make([]string, 0, len(found))
+	for d := range found {
+		matches = append(matches, d)
+	}
+	sort.Strings(matches)
+	writeOciErrorDetail("DIGEST_INVALID", "digest prefix is ambiguous", map[string][]string{"matches": matches}, w, 300)
+	return "", false
+}
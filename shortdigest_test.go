@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestShortDigestUnique(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{AllowShortDigests: true}}
+	layer := putTestBlob(t, reg.rootDir, "test/image", []byte("layer"))
+	body := []byte(testManifest)
+	putTestManifest(t, reg, "test/image", "v1", body)
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/blobs/"+layer[:19], nil))
+	if w.Code != 200 || w.Body.String() != "layer" {
+		t.Errorf("blob by prefix: want 200 with the layer, got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Docker-Content-Digest"); got != layer {
+		t.Errorf("want the full digest %s, got %q", layer, got)
+	}
+	w = getTestManifest(reg, "test/image", getDigest(body)[:19])
+	if w.Code != 200 || w.Body.String() != testManifest {
+		t.Errorf("manifest by prefix: want 200 with the manifest, got %d %q", w.Code, w.Body.String())
+	}
+
+	reg.config.AllowShortDigests = false
+	if w := getTestManifest(reg, "test/image", getDigest(body)[:19]); w.Code == 200 {
+		t.Error("want short digests refused unless enabled")
+	}
+}
+
+func TestShortDigestAmbiguous(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{AllowShortDigests: true}}
+	// Store blobs until two share the shortest accepted prefix.
+	seen := make(map[string]string)
+	var prefix string
+	for i := 0; prefix == ""; i++ {
+		d := putTestBlob(t, reg.rootDir, "test/image", []byte(fmt.Sprintf("blob %d", i)))
+		if _, ok := seen[d[:11]]; ok {
+			prefix = d[:11]
+		}
+		seen[d[:11]] = d
+	}
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/blobs/"+prefix, nil))
+	if w.Code != 300 {
+		t.Fatalf("want 300 for an ambiguous prefix, got %d", w.Code)
+	}
+	var er struct {
+		Errors []struct {
+			Code   string
+			Detail struct{ Matches []string }
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &er); err != nil {
+		t.Fatal(err)
+	}
+	if len(er.Errors) != 1 || len(er.Errors[0].Detail.Matches) != 2 {
+		t.Errorf("want both candidates listed, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("HEAD", "/v2/test/image/blobs/sha256:ffffffffff", nil))
+	if w.Code != 404 {
+		t.Errorf("want 404 for an unknown prefix, got %d", w.Code)
+	}
+}
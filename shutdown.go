@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// inFlight keeps track of the requests being served, so that those still
+// running when the shutdown grace expires can be logged.
+type inFlight struct {
+	mu   sync.Mutex
+	next uint64
+	reqs map[uint64]flight
+}
+
+// flight is a request being served.
+type flight struct {
+	method  string
+	uri     string
+	remote  string
+	started time.Time
+}
+
+// track records every request served by next while it runs.
+func (f *inFlight) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		if f.reqs == nil {
+			f.reqs = make(map[uint64]flight)
+		}
+		id := f.next
+		f.next++
+		f.reqs[id] = flight{method: r.Method, uri: r.RequestURI, remote: r.RemoteAddr, started: time.Now()}
+		f.mu.Unlock()
+		defer func() {
+			f.mu.Lock()
+			delete(f.reqs, id)
+			f.mu.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// list returns the requests being served, oldest first.
+func (f *inFlight) list() []flight {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	flights := make([]flight, 0, len(f.reqs))
+	for _, fl := range f.reqs {
+		flights = append(flights, fl)
+	}
+	sort.Slice(flights, func(i, j int) bool { return flights[i].started.Before(flights[j].started) })
+	return flights
+}
+
+// serve runs srv on ln until it fails or the process is asked to stop with
+// SIGINT or SIGTERM, in which case it is shut down with shutdown.
+func serve(srv *http.Server, ln net.Listener, grace time.Duration, reqs *inFlight) error {
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	select {
+	case err := <-errc:
+		return err
+	case s := <-sig:
+		log.Printf("Received %s, shutting down", s)
+	}
+	return shutdown(srv, grace, reqs)
+}
+
+// shutdown stops accepting connections and waits up to grace for the
+// requests in flight, such as long blob transfers, to finish. Requests still
+// running after that are logged and their connections closed.
+func shutdown(srv *http.Server, grace time.Duration, reqs *inFlight) error {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	for _, fl := range reqs.list() {
+		log.Printf("Shutdown grace of %s expired, terminating %s %s from %s after %s", grace, fl.method, fl.uri, fl.remote, time.Since(fl.started).Round(time.Millisecond))
+	}
+	return srv.Close()
+}
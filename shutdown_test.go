@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownTerminatesLongDownload(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A blob download that trickles out far longer than the grace.
+	download := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		for {
+			if _, err := w.Write([]byte("x")); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	})
+	reqs := &inFlight{}
+	srv := &http.Server{Handler: reqs.track(download)}
+	go srv.Serve(ln)
+
+	blob := "/v2/test/image/blobs/" + getDigest([]byte("large"))
+	resp, err := http.Get("http://" + ln.Addr().String() + blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+	start := time.Now()
+	if err := shutdown(srv, 50*time.Millisecond, reqs); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("shutdown took %s", elapsed)
+	}
+	if !strings.Contains(logs.String(), "terminating GET "+blob) {
+		t.Errorf("want the download logged as terminated, got %q", logs.String())
+	}
+}
+
+func TestShutdownWaitsForRequests(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, done := make(chan struct{}), make(chan struct{})
+	reqs := &inFlight{}
+	srv := &http.Server{Handler: reqs.track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(200)
+	}))}
+	go srv.Serve(ln)
+	go func() {
+		defer close(done)
+		resp, err := http.Get("http://" + ln.Addr().String() + "/v2/")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("want 200, got %d", resp.StatusCode)
+		}
+	}()
+	<-started
+
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+	if err := shutdown(srv, 5*time.Second, reqs); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if logs.Len() > 0 {
+		t.Errorf("want nothing terminated, got %q", logs.String())
+	}
+}
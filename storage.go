@@ -0,0 +1,401 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// defaultBlobLayout shards blobs by the first two hex characters of their
+// digest, following Docker's layout.
+const defaultBlobLayout = "{alg}/{h2}/{hex}"
+
+// legacyBlobLayouts are layouts blobs may have been stored in before, which
+// migrateBlobLayout moves them out of.
+var legacyBlobLayouts = []string{"{alg}:{hex}", defaultBlobLayout}
+
+// defaultLayout is defaultBlobLayout, parsed.
+var defaultLayout, _ = parseBlobLayout(defaultBlobLayout)
+
+// blobLayoutFile records in the storage root the blob layout that blobs are
+// stored in, so that changing -blob-layout moves them rather than losing
+// track of them.
+const blobLayoutFile = "_blob-layout"
+
+// fileModes are the permissions of the directories and files created in the
+// storage root, as set with -dir-mode and -file-mode.
+type fileModes struct {
+	dir  os.FileMode
+	file os.FileMode
+}
+
+// defaultModes are the permissions used unless -dir-mode or -file-mode say
+// otherwise.
+var defaultModes = fileModes{dir: 0755, file: 0644}
+
+// makeDirs creates the directory p along with any missing parents. Unlike
+// os.MkdirAll it gives each directory it creates modes.dir whatever the umask.
+func makeDirs(p string, modes fileModes) error {
+	var missing []string
+	for d := p; ; d = path.Dir(d) {
+		if _, err := os.Stat(d); !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		missing = append(missing, d)
+		if d == path.Dir(d) {
+			break
+		}
+	}
+	if err := os.MkdirAll(p, modes.dir); err != nil {
+		return err
+	}
+	for _, d := range missing {
+		if err := os.Chmod(d, modes.dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pathTemplate lays out content addressed files. {alg} is replaced with the
+// digest algorithm, {hex} with the hex encoded digest and {h2} with its first
+// two characters.
+type pathTemplate struct {
+	template string
+	pattern  *regexp.Regexp
+}
+
+// parseBlobLayout checks that a template names every blob uniquely and keeps
+// it within the directory it is rendered in.
+func parseBlobLayout(template string) (*pathTemplate, error) {
+	if !strings.Contains(template, "{alg}") || !strings.Contains(template, "{hex}") {
+		return nil, fmt.Errorf("blob layout %q must contain {alg} and {hex}", template)
+	}
+	// The first {alg} and {hex} are captured; digestOf checks that any later
+	// ones agree.
+	captured := make(map[string]bool)
+	var expr strings.Builder
+	expr.WriteString("^")
+	for rest := template; rest != ""; {
+		i := strings.IndexByte(rest, '{')
+		if i < 0 {
+			expr.WriteString(regexp.QuoteMeta(rest))
+			break
+		}
+		expr.WriteString(regexp.QuoteMeta(rest[:i]))
+		placeholder, after, ok := strings.Cut(rest[i:], "}")
+		switch placeholder + "}" {
+		case "{alg}":
+			expr.WriteString(captureOnce(captured, "alg", "sha256|sha512"))
+		case "{hex}":
+			expr.WriteString(captureOnce(captured, "hex", "[a-f0-9]+"))
+		case "{h2}":
+			expr.WriteString("[a-f0-9]{2}")
+		default:
+			ok = false
+		}
+		if !ok {
+			return nil, fmt.Errorf("blob layout %q has an unknown placeholder %s", template, placeholder)
+		}
+		rest = after
+	}
+	expr.WriteString("$")
+	t := &pathTemplate{template: template, pattern: regexp.MustCompile(expr.String())}
+	sample := t.render("sha256:" + strings.Repeat("0", 64))
+	if path.IsAbs(sample) || path.Clean(sample) != sample || sample == ".." || strings.HasPrefix(sample, "../") {
+		return nil, fmt.Errorf("blob layout %q must be a relative path without . or .. elements", template)
+	}
+	return t, nil
+}
+
+// captureOnce returns a named group for the first occurrence of a
+// placeholder and a plain group for any later one.
+func captureOnce(captured map[string]bool, name string, expr string) string {
+	if captured[name] {
+		return "(?:" + expr + ")"
+	}
+	captured[name] = true
+	return "(?P<" + name + ">" + expr + ")"
+}
+
+// render returns the path of a blob. digest must already be validated
+// against digestRegex.
+func (t *pathTemplate) render(digest string) string {
+	alg, hex, _ := strings.Cut(digest, ":")
+	return strings.NewReplacer("{alg}", alg, "{hex}", hex, "{h2}", hex[:2]).Replace(t.template)
+}
+
+// digestOf returns the digest of the blob at a rendered path, or "" when the
+// path is not one the template renders.
+func (t *pathTemplate) digestOf(p string) string {
+	m := t.pattern.FindStringSubmatch(p)
+	if m == nil {
+		return ""
+	}
+	digest := m[t.pattern.SubexpIndex("alg")] + ":" + m[t.pattern.SubexpIndex("hex")]
+	if !matches(digestRegex, digest) || t.render(digest) != p {
+		return ""
+	}
+	return digest
+}
+
+// blobPath returns where a blob is stored on disk, by default
+//
+//	<root>/<name>/_blobs/sha256/ab/abcdef...
+//
+// digest must already be validated against digestRegex.
+func blobPath(rootDir string, layout *pathTemplate, name string, digest string) string {
+	return path.Join(rootDir, name, "_blobs", layout.render(digest))
+}
+
+// blobExists reports whether a blob is stored in the repository. The empty
+// JSON blob is always present, whether or not it was ever uploaded.
+func blobExists(rootDir string, layout *pathTemplate, name string, digest string) (bool, error) {
+	if digest == emptyJSONDigest {
+		return true, nil
+	}
+	return fileExists(blobPath(rootDir, layout, name, digest))
+}
+
+// syncFile flushes a file to stable storage. Tests replace it to observe
+// whether -fsync is honoured.
+var syncFile = func(f *os.File) error {
+	return f.Sync()
+}
+
+// writeFileAtomic replaces the file at p with b through a rename, so readers
+// see either the old or the new content and never a partial write. With
+// fsync, both the file and the rename are on stable storage when it returns.
+func writeFileAtomic(p string, b []byte, modes fileModes, fsync bool) error {
+	return replaceFile(p, b, modes, fsync, nil)
+}
+
+// replaceFile is writeFileAtomic, calling check, when set, on the written
+// temporary file before it replaces p. p is left untouched when check fails.
+func replaceFile(p string, b []byte, modes fileModes, fsync bool, check func(tmp string) error) error {
+	f, err := os.CreateTemp(path.Dir(p), "_tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if err == nil && fsync {
+		err = syncFile(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), modes.file); err != nil {
+		return err
+	}
+	if check != nil {
+		if err := check(f.Name()); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(f.Name(), p); err != nil || !fsync {
+		return err
+	}
+	// The rename itself is only durable once the directory is flushed too.
+	d, err := os.Open(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return syncFile(d)
+}
+
+// keyedLocks hands out a mutex per key, such as a tag, dropping it again
+// once nobody holds or waits for it.
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock blocks until key is free and returns the function that unlocks it.
+func (k *keyedLocks) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(k.locks, key)
+		}
+	}
+}
+
+// storeBlob streams r into the blob store, hashing it on the way so that the
+// blob is only committed under digest once its content is known to match.
+// It returns the size of the blob, and reports false, leaving nothing behind,
+// when the content does not match. When fsync is set the blob is flushed to
+// stable storage before it is committed. check, when set, is run on the
+// temporary file once the content is known to match, and its error leaves
+// nothing behind either.
+func storeBlob(rootDir string, layout *pathTemplate, name string, digest string, r io.Reader, modes fileModes, fsync bool, check func(tmp string) error) (int64, bool, error) {
+	dest := blobPath(rootDir, layout, name, digest)
+	if err := makeDirs(path.Dir(dest), modes); err != nil {
+		return 0, false, err
+	}
+	f, err := os.CreateTemp(path.Dir(dest), "_tmp-")
+	if err != nil {
+		return 0, false, err
+	}
+	defer os.Remove(f.Name())
+	h := algorithmFor(digest)
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err == nil && fsync {
+		err = syncFile(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return size, false, err
+	}
+	if sumDigest(h, digest) != digest {
+		return size, false, nil
+	}
+	if check != nil {
+		if err := check(f.Name()); err != nil {
+			return size, false, err
+		}
+	}
+	if err := os.Chmod(f.Name(), modes.file); err != nil {
+		return size, false, err
+	}
+	return size, true, os.Rename(f.Name(), dest)
+}
+
+// migrateBlobLayout moves blobs to where layout puts them from the layout
+// recorded in the storage root, or from a legacy layout, such as the old flat
+// _blobs/<digest> one, when none is recorded yet. It then records layout. It
+// is safe to run on every startup.
+func migrateBlobLayout(rootDir string, layout *pathTemplate, modes fileModes) error {
+	recorded, err := os.ReadFile(path.Join(rootDir, blobLayoutFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if string(recorded) == layout.template {
+		return nil
+	}
+	from := legacyBlobLayouts
+	if len(recorded) > 0 {
+		from = []string{string(recorded)}
+	}
+	legacy := make([]*pathTemplate, 0, len(from))
+	for _, l := range from {
+		t, err := parseBlobLayout(l)
+		if err != nil {
+			return fmt.Errorf("recorded in %s: %w", blobLayoutFile, err)
+		}
+		if l != layout.template {
+			legacy = append(legacy, t)
+		}
+	}
+	if err := moveBlobs(rootDir, layout, legacy, modes); err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(rootDir, blobLayoutFile), []byte(layout.template), modes, false)
+}
+
+// moveBlobs moves blobs stored in any of the layouts in from to where layout
+// puts them.
+func moveBlobs(rootDir string, layout *pathTemplate, from []*pathTemplate, modes fileModes) error {
+	moved := 0
+	err := filepath.WalkDir(rootDir, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !de.IsDir() || de.Name() != "_blobs" {
+			return nil
+		}
+		name := strings.TrimPrefix(filepath.Dir(p), rootDir)
+		var blobs []string
+		err = filepath.WalkDir(p, func(f string, de fs.DirEntry, err error) error {
+			if err != nil || de.IsDir() {
+				return err
+			}
+			blobs = append(blobs, strings.TrimPrefix(f, p+"/"))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, rel := range blobs {
+			if layout.digestOf(rel) != "" {
+				continue
+			}
+			for _, t := range from {
+				digest := t.digestOf(rel)
+				if digest == "" {
+					continue
+				}
+				dest := blobPath(rootDir, layout, name, digest)
+				if err := makeDirs(path.Dir(dest), modes); err != nil {
+					return err
+				}
+				if err := os.Rename(path.Join(p, rel), dest); err != nil {
+					return err
+				}
+				moved++
+				break
+			}
+		}
+		return fs.SkipDir
+	})
+	if moved > 0 {
+		log.Printf("Migrated %d blobs to the blob layout %s", moved, layout.template)
+	}
+	return err
+}
+
+// listBlobs returns the digest of every blob stored in a repository.
+func listBlobs(rootDir string, layout *pathTemplate, name string) ([]string, error) {
+	digests := make([]string, 0)
+	dir := path.Join(rootDir, name, "_blobs")
+	err := filepath.WalkDir(dir, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && p == dir {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if de.IsDir() {
+			return nil
+		}
+		if digest := layout.digestOf(strings.TrimPrefix(p, dir+"/")); digest != "" {
+			digests = append(digests, digest)
+		}
+		return nil
+	})
+	return digests, err
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestBlobStoredSharded(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	content := []byte("sharded layer")
+	digest := getDigest(content)
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/test/image/blobs/uploads/some-id?digest="+digest, bytes.NewReader(content)))
+	if w.Code != 201 {
+		t.Fatalf("want 201, got %d", w.Code)
+	}
+	sharded := path.Join(reg.rootDir, "test/image", "_blobs", "sha256", digest[7:9], digest[7:])
+	if _, err := os.Stat(sharded); err != nil {
+		t.Fatalf("blob not stored at sharded path: %s", err)
+	}
+
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/blobs/"+digest, nil))
+	if w.Code != 200 {
+		t.Fatalf("want 200, got %d", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), content) {
+		t.Errorf("want %q, got %q", content, w.Body.Bytes())
+	}
+}
+
+func TestMigrateBlobLayout(t *testing.T) {
+	rootDir := t.TempDir()
+	content := []byte("flat layer")
+	digest := getDigest(content)
+	flat := path.Join(rootDir, "test/image", "_blobs", digest)
+	if err := os.MkdirAll(path.Dir(flat), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(flat, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateBlobLayout(rootDir, defaultLayout, defaultModes); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(flat); !os.IsNotExist(err) {
+		t.Errorf("flat blob still present after migration")
+	}
+	b, err := os.ReadFile(blobPath(rootDir, defaultLayout, "test/image", digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Errorf("want %q, got %q", content, b)
+	}
+	if recorded, _ := os.ReadFile(path.Join(rootDir, blobLayoutFile)); string(recorded) != defaultBlobLayout {
+		t.Errorf("want %q recorded, got %q", defaultBlobLayout, recorded)
+	}
+}
+
+func TestMigrateBetweenCustomLayouts(t *testing.T) {
+	rootDir := t.TempDir()
+	content := []byte("custom layer")
+	digest := getDigest(content)
+	_, hex, _ := strings.Cut(digest, ":")
+	first, err := parseBlobLayout("{alg}/{hex}/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := parseBlobLayout("{h2}/{alg}-{hex}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateBlobLayout(rootDir, first, defaultModes); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := storeBlob(rootDir, first, "test/image", digest, bytes.NewReader(content), defaultModes, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateBlobLayout(rootDir, second, defaultModes); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path.Join(rootDir, "test/image", "_blobs", hex[:2], "sha256-"+hex))
+	if err != nil {
+		t.Fatalf("blob not moved to the new layout: %s", err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Errorf("want %q, got %q", content, b)
+	}
+	if recorded, _ := os.ReadFile(path.Join(rootDir, blobLayoutFile)); string(recorded) != "{h2}/{alg}-{hex}" {
+		t.Errorf("want the new layout recorded, got %q", recorded)
+	}
+}
+
+func TestBlobLayouts(t *testing.T) {
+	content := []byte("laid out layer")
+	digest := getDigest(content)
+	_, hex, _ := strings.Cut(digest, ":")
+	for template, want := range map[string]string{
+		"{alg}:{hex}":      digest,
+		"{alg}/{hex}/data": "sha256/" + hex + "/data",
+		"{h2}/{alg}-{hex}": hex[:2] + "/sha256-" + hex,
+	} {
+		if _, err := parseBlobLayout(template); err != nil {
+			t.Fatalf("%s: %s", template, err)
+		}
+		reg := &registry{rootDir: t.TempDir(), config: Config{BlobLayout: template}}
+		if w := putTestBlobRequest(reg, "test/image", content); w.Code != 201 {
+			t.Fatalf("%s: push failed with %d", template, w.Code)
+		}
+		if _, err := os.Stat(path.Join(reg.rootDir, "test/image", "_blobs", want)); err != nil {
+			t.Errorf("%s: want the blob at %s: %s", template, want, err)
+		}
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/blobs/"+digest, nil))
+		if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), content) {
+			t.Errorf("%s: want the blob served back, got %d", template, w.Code)
+		}
+		if digests, err := listBlobs(reg.rootDir, reg.config.layout(), "test/image"); err != nil || len(digests) != 1 || digests[0] != digest {
+			t.Errorf("%s: want the blob listed, got %v (%v)", template, digests, err)
+		}
+	}
+}
+
+func TestParseBlobLayoutInvalid(t *testing.T) {
+	for _, template := range []string{
+		"{hex}",
+		"{alg}/{digest}",
+		"../{alg}/{hex}",
+		"/srv/{alg}/{hex}",
+		"{alg}/../../{hex}",
+		"{alg}//{hex}",
+	} {
+		if _, err := parseBlobLayout(template); err == nil {
+			t.Errorf("want %q rejected", template)
+		}
+	}
+}
+
+func TestMonolithicUploadVerified(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	content := []byte("layer")
+	digest := getDigest(content)
+	for method, url := range map[string]string{
+		"POST": "/v2/test/image/blobs/uploads/?digest=" + digest,
+		"PUT":  "/v2/test/image/blobs/uploads/some-id?digest=" + digest,
+	} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest(method, url, bytes.NewReader([]byte("corrupt"))))
+		if w.Code != 400 {
+			t.Errorf("%s corrupt: want 400, got %d", method, w.Code)
+		}
+		if blobs, _ := listBlobs(reg.rootDir, reg.config.layout(), "test/image"); len(blobs) != 0 {
+			t.Errorf("%s corrupt: want nothing stored, got %v", method, blobs)
+		}
+		if files, _ := os.ReadDir(path.Dir(blobPath(reg.rootDir, reg.config.layout(), "test/image", digest))); len(files) != 0 {
+			t.Errorf("%s corrupt: want no leftover files, got %d", method, len(files))
+		}
+
+		w = httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest(method, url, bytes.NewReader(content)))
+		if w.Code != 201 {
+			t.Fatalf("%s: want 201, got %d: %s", method, w.Code, w.Body.String())
+		}
+		stored, err := os.ReadFile(blobPath(reg.rootDir, reg.config.layout(), "test/image", digest))
+		if err != nil || !bytes.Equal(stored, content) {
+			t.Errorf("%s: blob not committed: %v", method, err)
+		}
+		os.RemoveAll(path.Join(reg.rootDir, "test/image"))
+	}
+}
+
+func TestFsync(t *testing.T) {
+	synced := make(map[string]int)
+	defer func(orig func(*os.File) error) { syncFile = orig }(syncFile)
+	syncFile = func(f *os.File) error {
+		synced[path.Base(path.Dir(f.Name()))]++
+		return f.Sync()
+	}
+
+	for _, fsync := range []bool{false, true} {
+		for k := range synced {
+			delete(synced, k)
+		}
+		reg := &registry{rootDir: t.TempDir(), config: Config{Fsync: fsync}}
+		if w := putTestBlobRequest(reg, "test/image", []byte("layer")); w.Code != 201 {
+			t.Fatalf("blob push failed with %d", w.Code)
+		}
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("POST", "/v2/test/image/blobs/uploads/?digest="+getDigest([]byte("other")), bytes.NewReader([]byte("other"))))
+		if w.Code != 201 {
+			t.Fatalf("monolithic POST failed with %d", w.Code)
+		}
+		putTestManifest(t, reg, "test/image", "v1", []byte(testManifest))
+
+		want := 0
+		if fsync {
+			want = 1
+		}
+		for _, dir := range []string{"_uploads", getDigest([]byte("other"))[7:9], "v1"} {
+			if synced[dir] != want {
+				t.Errorf("fsync=%v: want %d syncs in %s, got %d", fsync, want, dir, synced[dir])
+			}
+		}
+	}
+}
+
+func TestStorageModes(t *testing.T) {
+	// Group writable, which the usual umask of 022 would take away.
+	reg := &registry{rootDir: t.TempDir(), config: Config{DirMode: "0770", FileMode: "0660"}}
+	monolithic := []byte("monolithic layer")
+	if w := putTestBlobRequest(reg, "test/image", monolithic); w.Code != 201 {
+		t.Fatalf("want 201, got %d", w.Code)
+	}
+	location := startTestUpload(t, reg, "test/image")
+	chunked := []byte("chunked layer")
+	patchTestUpload(t, reg, location, chunked, "")
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", location+"?digest="+getDigest(chunked), nil))
+	if w.Code != 201 {
+		t.Fatalf("want 201, got %d: %s", w.Code, w.Body.String())
+	}
+	putTestManifest(t, reg, "test/image", "v1", []byte(testManifest))
+
+	for p, want := range map[string]os.FileMode{
+		blobPath(reg.rootDir, reg.config.layout(), "test/image", getDigest(monolithic)):        0660,
+		blobPath(reg.rootDir, reg.config.layout(), "test/image", getDigest(chunked)):           0660,
+		tagManifestPath(reg.rootDir, "test/image", "v1"):                                       0660,
+		indexPath(reg.rootDir, "test/image"):                                                   0660,
+		path.Dir(blobPath(reg.rootDir, reg.config.layout(), "test/image", getDigest(chunked))): 0770,
+		path.Dir(tagManifestPath(reg.rootDir, "test/image", "v1")):                             0770,
+		path.Join(reg.rootDir, "test"):                                                         0770,
+	} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); got != want {
+			t.Errorf("%s: want mode %#o, got %#o", strings.TrimPrefix(p, reg.rootDir), want, got)
+		}
+	}
+}
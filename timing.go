@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type timingKey struct{}
+
+// serverTiming accumulates how long a request spent in each phase, reported
+// in a Server-Timing header when DEBUG is set. A nil *serverTiming ignores
+// everything, so handlers can record phases unconditionally.
+type serverTiming struct {
+	start time.Time
+
+	mu     sync.Mutex
+	phases []string
+	total  map[string]time.Duration
+}
+
+// timingFrom returns the request's timing, or nil outside debug mode.
+func timingFrom(ctx context.Context) *serverTiming {
+	st, _ := ctx.Value(timingKey{}).(*serverTiming)
+	return st
+}
+
+// since adds the time elapsed since start to a phase.
+func (st *serverTiming) since(phase string, start time.Time) {
+	if st == nil {
+		return
+	}
+	d := time.Since(start)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.total[phase]; !ok {
+		st.phases = append(st.phases, phase)
+	}
+	st.total[phase] += d
+}
+
+func (st *serverTiming) header() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	metrics := make([]string, 0, len(st.phases)+1)
+	for _, phase := range st.phases {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", phase, st.total[phase].Seconds()*1000))
+	}
+	metrics = append(metrics, fmt.Sprintf("total;dur=%.3f", time.Since(st.start).Seconds()*1000))
+	return strings.Join(metrics, ", ")
+}
+
+// serverTimings adds a Server-Timing header breaking a request down into
+// routing, storage I/O and hashing, so slow pulls and pushes can be profiled
+// without a profiler. It only does so when DEBUG is set, to avoid exposing
+// internals.
+func serverTimings(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if os.Getenv("DEBUG") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		st := &serverTiming{start: time.Now(), total: make(map[string]time.Duration)}
+		tw := &timingWriter{ResponseWriter: w, timing: st}
+		next.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), timingKey{}, st)))
+	})
+}
+
+// timingWriter sets the Server-Timing header just before the response
+// headers are sent.
+type timingWriter struct {
+	http.ResponseWriter
+	timing      *serverTiming
+	wroteHeader bool
+}
+
+func (tw *timingWriter) WriteHeader(status int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		tw.Header().Set("Server-Timing", tw.timing.header())
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timingWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(200)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses, such as upload events, working.
+func (tw *timingWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		if !tw.wroteHeader {
+			tw.WriteHeader(200)
+		}
+		f.Flush()
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServerTimingUnderDebug(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	putTestManifest(t, reg, "test/image", "v1", []byte(testManifest))
+	h := serverTimings(reg)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/manifests/v1", nil))
+	if got := w.Header().Get("Server-Timing"); got != "" {
+		t.Errorf("want no Server-Timing without DEBUG, got %q", got)
+	}
+
+	t.Setenv("DEBUG", "1")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/manifests/v1", nil))
+	if w.Code != 200 {
+		t.Fatalf("want 200, got %d", w.Code)
+	}
+	got := w.Header().Get("Server-Timing")
+	for _, phase := range []string{"route;dur=", "storage;dur=", "hash;dur=", "total;dur="} {
+		if !strings.Contains(got, phase) {
+			t.Errorf("want %s in Server-Timing, got %q", phase, got)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tombstone records a manifest deleted with -soft-delete-window. Until the
+// window has passed, the manifest can be restored with POST /admin/restore
+// and garbage collection keeps what it refers to; after that, garbage
+// collection purges it.
+type tombstone struct {
+	Digest string `json:"digest"`
+	// Tags are the deleted tags that pointed at the manifest.
+	Tags []string `json:"tags"`
+	// ByDigest is set when the manifest itself was deleted, and not only
+	// tags pointing at it.
+	ByDigest bool      `json:"byDigest"`
+	Deleted  time.Time `json:"deleted"`
+}
+
+// expired reports whether the tombstone is past the soft delete window.
+func (t *tombstone) expired(window time.Duration) bool {
+	return time.Since(t.Deleted) >= window
+}
+
+// tombstonesMu serialises read-modify-write updates of tombstones.
+var tombstonesMu sync.Mutex
+
+// tombstoneDir returns where a deleted manifest is kept along with its
+// tombstone. digest must already be validated against digestRegex.
+func tombstoneDir(rootDir string, name string, digest string) string {
+	alg, hex, _ := strings.Cut(digest, ":")
+	return path.Join(rootDir, name, "_tombstones", alg, hex)
+}
+
+// loadTombstone returns the tombstone of a deleted manifest, or nil when
+// there is none.
+func loadTombstone(rootDir string, name string, digest string) (*tombstone, error) {
+	b, err := os.ReadFile(path.Join(tombstoneDir(rootDir, name, digest), "tombstone.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t tombstone
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// listTombstones returns the tombstones of a repository.
+func listTombstones(rootDir string, name string) ([]tombstone, error) {
+	files, err := filepath.Glob(path.Join(rootDir, name, "_tombstones", "*", "*", "tombstone.json"))
+	if err != nil {
+		return nil, err
+	}
+	tombstones := make([]tombstone, 0, len(files))
+	for _, p := range files {
+		dir := path.Dir(p)
+		t, err := loadTombstone(rootDir, name, path.Base(path.Dir(dir))+":"+path.Base(dir))
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			tombstones = append(tombstones, *t)
+		}
+	}
+	return tombstones, nil
+}
+
+// buryManifest keeps a copy of the manifest at manifestPath, about to be
+// deleted, under a tombstone. tag is the tag being deleted, or "" when the
+// manifest is deleted by digest. Deleting more tags of the same manifest
+// adds them to its tombstone and restarts the window.
+func buryManifest(rootDir string, name string, digest string, manifestPath string, tag string, modes fileModes) error {
+	tombstonesMu.Lock()
+	defer tombstonesMu.Unlock()
+	t, err := loadTombstone(rootDir, name, digest)
+	if err != nil {
+		return err
+	}
+	dir := tombstoneDir(rootDir, name, digest)
+	if t == nil {
+		t = &tombstone{Digest: digest, Tags: make([]string, 0)}
+		if err := copyManifest(manifestPath, path.Join(dir, "manifest.json"), modes); err != nil {
+			return err
+		}
+	}
+	if tag == "" {
+		t.ByDigest = true
+	} else if !containsString(t.Tags, tag) {
+		t.Tags = append(t.Tags, tag)
+	}
+	t.Deleted = time.Now().UTC()
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(dir, "tombstone.json"), b, modes, false)
+}
+
+// copyManifest copies a stored manifest, and the media types it was pushed
+// with, to dest.
+func copyManifest(src string, dest string, modes fileModes) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := makeDirs(path.Dir(dest), modes); err != nil {
+		return err
+	}
+	types, err := loadMediaTypes(src)
+	if err != nil {
+		return err
+	}
+	if err := writeMediaType(dest, b, types[getDigest(b)], modes); err != nil {
+		return err
+	}
+	return writeFileAtomic(dest, b, modes, false)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreManifest brings back a manifest deleted within the soft delete
+// window, along with its deleted tags, and removes its tombstone. A tag
+// that was pushed again since is left alone. It returns the tombstone with
+// the tags that were restored, or nil when there is nothing to restore.
+func (reg *registry) restoreManifest(name string, digest string) (*tombstone, error) {
+	tombstonesMu.Lock()
+	defer tombstonesMu.Unlock()
+	t, err := loadTombstone(reg.rootDir, name, digest)
+	if err != nil || t == nil || t.expired(time.Duration(reg.config.SoftDeleteWindow)) {
+		return nil, err
+	}
+	dir := tombstoneDir(reg.rootDir, name, digest)
+	buried := path.Join(dir, "manifest.json")
+	if t.ByDigest {
+		unlock := reg.manifests.lock(name + ":" + digest)
+		err := copyManifest(buried, digestManifestPath(reg.rootDir, name, digest), reg.config.modes())
+		unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	body, err := os.ReadFile(buried)
+	if err != nil {
+		return nil, err
+	}
+	restored := make([]string, 0, len(t.Tags))
+	for _, tag := range t.Tags {
+		ok, err := reg.restoreTag(name, tag, getDigest(body), buried)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			restored = append(restored, tag)
+		}
+	}
+	t.Tags = restored
+	reg.usage.invalidate()
+	return t, os.RemoveAll(dir)
+}
+
+// restoreTag points tag at the buried manifest again, unless the tag was
+// pushed again since it was deleted, reporting whether it did. digest is the
+// sha256 digest of the manifest, as the manifest index records.
+func (reg *registry) restoreTag(name string, tag string, digest string, buried string) (bool, error) {
+	unlock := reg.manifests.lock(name + ":" + tag)
+	defer unlock()
+	p := tagManifestPath(reg.rootDir, name, tag)
+	exists, err := fileExists(p)
+	if err != nil || exists {
+		return false, err
+	}
+	if err := copyManifest(buried, p, reg.config.modes()); err != nil {
+		return false, err
+	}
+	return true, indexTag(reg.rootDir, name, tag, digest, reg.config.modes())
+}
+
+// restoreHandler serves POST /admin/restore?repo=<name>&digest=<digest>,
+// which undoes the deletion of a manifest within -soft-delete-window.
+type restoreHandler struct {
+	reg *registry
+}
+
+func (h *restoreHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeOciError("UNSUPPORTED", "restoring is started with POST", w, 405)
+		return
+	}
+	name, digest := r.URL.Query().Get("repo"), r.URL.Query().Get("digest")
+	if !matches(nameRegex, name) {
+		writeOciError("NAME_INVALID", "invalid repository name", w, 400)
+		return
+	}
+	if !matches(digestRegex, digest) {
+		writeOciError("DIGEST_INVALID", "invalid digest", w, 400)
+		return
+	}
+	t, err := h.reg.restoreManifest(name, digest)
+	if err != nil {
+		h.reg.writeServerError(err, w)
+		return
+	}
+	if t == nil {
+		writeOciError("MANIFEST_UNKNOWN", "no deleted manifest to restore", w, 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
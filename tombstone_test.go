@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func deleteTestManifest(t *testing.T, reg *registry, name string, ref string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("DELETE", "/v2/"+name+"/manifests/"+ref, nil))
+	if w.Code != 202 {
+		t.Fatalf("delete of %s:%s failed with %d: %s", name, ref, w.Code, w.Body.String())
+	}
+}
+
+func restoreTestManifest(reg *registry, name string, digest string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h := &restoreHandler{reg: reg}
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/admin/restore?repo="+name+"&digest="+digest, nil))
+	return w
+}
+
+func TestSoftDeleteRestore(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{AllowManifestDelete: true, SoftDeleteWindow: Duration(time.Hour)}}
+	layer := []byte("layer")
+	m := pushTestImage(t, reg, "test/image", "v1", layer)
+	putTestManifest(t, reg, "test/image", "v2", []byte(testManifest))
+
+	deleteTestManifest(t, reg, "test/image", "v1")
+	if w := getTestManifest(reg, "test/image", "v1"); w.Code != 404 {
+		t.Errorf("want the deleted tag not pullable, got %d", w.Code)
+	}
+	if w := getTestManifest(reg, "test/image", getDigest(m)); w.Code != 404 {
+		t.Errorf("want the deleted manifest not pullable by digest, got %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/tags/list", nil))
+	var tags TagList
+	if err := json.Unmarshal(w.Body.Bytes(), &tags); err != nil {
+		t.Fatal(err)
+	}
+	if len(tags.TagList) != 1 || tags.TagList[0] != "v2" {
+		t.Errorf("want only v2 listed, got %v", tags.TagList)
+	}
+
+	// Garbage collection keeps what the deleted manifest refers to.
+	if _, err := collectGarbage(reg.rootDir, reg.config.layout(), gcOptions{deleteUntagged: true, softDeleteWindow: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := blobExists(reg.rootDir, reg.config.layout(), "test/image", getDigest(layer)); !found {
+		t.Fatal("want the layer of the deleted manifest kept within the window")
+	}
+
+	w = restoreTestManifest(reg, "test/image", getDigest(m))
+	if w.Code != 200 {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var restored tombstone
+	if err := json.Unmarshal(w.Body.Bytes(), &restored); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.Tags) != 1 || restored.Tags[0] != "v1" {
+		t.Errorf("want v1 restored, got %+v", restored)
+	}
+	if w := getTestManifest(reg, "test/image", "v1"); w.Code != 200 || !bytes.Equal(w.Body.Bytes(), m) {
+		t.Errorf("want the restored tag pullable, got %d", w.Code)
+	}
+	if w := getTestManifest(reg, "test/image", getDigest(m)); w.Code != 200 {
+		t.Errorf("want the restored manifest pullable by digest, got %d", w.Code)
+	}
+	if w := restoreTestManifest(reg, "test/image", getDigest(m)); w.Code != 404 {
+		t.Errorf("want nothing left to restore, got %d", w.Code)
+	}
+}
+
+func TestSoftDeleteByDigestRestore(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{AllowManifestDelete: true, SoftDeleteWindow: Duration(time.Hour)}}
+	m := pushTestImage(t, reg, "test/image", "v1", []byte("layer"))
+	putTestManifest(t, reg, "test/image", "latest", m)
+	putTestManifest(t, reg, "test/image", getDigest(m), m)
+
+	deleteTestManifest(t, reg, "test/image", getDigest(m))
+	for _, ref := range []string{"v1", "latest", getDigest(m)} {
+		if w := getTestManifest(reg, "test/image", ref); w.Code != 404 {
+			t.Errorf("%s: want 404 once deleted, got %d", ref, w.Code)
+		}
+	}
+	// A tag pushed again since the deletion is left alone.
+	putTestManifest(t, reg, "test/image", "latest", []byte(testManifest))
+
+	if w := restoreTestManifest(reg, "test/image", getDigest(m)); w.Code != 200 {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+	}
+	for ref, want := range map[string][]byte{"v1": m, getDigest(m): m, "latest": []byte(testManifest)} {
+		if w := getTestManifest(reg, "test/image", ref); w.Code != 200 || !bytes.Equal(w.Body.Bytes(), want) {
+			t.Errorf("%s: want %s after the restore, got %d: %s", ref, want, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSoftDeleteExpires(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{AllowManifestDelete: true, SoftDeleteWindow: Duration(time.Hour)}}
+	layer := []byte("layer")
+	m := pushTestImage(t, reg, "test/image", "v1", layer)
+	deleteTestManifest(t, reg, "test/image", "v1")
+
+	// Age the tombstone past the window.
+	p := path.Join(tombstoneDir(reg.rootDir, "test/image", getDigest(m)), "tombstone.json")
+	tomb, err := loadTombstone(reg.rootDir, "test/image", getDigest(m))
+	if err != nil || tomb == nil {
+		t.Fatalf("want a tombstone, got %v (%v)", tomb, err)
+	}
+	tomb.Deleted = tomb.Deleted.Add(-2 * time.Hour)
+	b, _ := json.Marshal(tomb)
+	if err := os.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := restoreTestManifest(reg, "test/image", getDigest(m)); w.Code != 404 {
+		t.Errorf("want no restore past the window, got %d", w.Code)
+	}
+	// A buried manifest modified too recently to collect is neither purged
+	// nor reported.
+	res, err := collectGarbage(reg.rootDir, reg.config.layout(), gcOptions{softDeleteWindow: time.Hour, minAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Manifests) != 0 || len(res.Blobs) != 0 {
+		t.Errorf("want nothing collected under the minimum age, got %+v", res)
+	}
+	if _, err := os.Stat(path.Dir(p)); err != nil {
+		t.Errorf("want the tombstone kept, got %v", err)
+	}
+
+	res, err = collectGarbage(reg.rootDir, reg.config.layout(), gcOptions{softDeleteWindow: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Manifests) != 1 || res.Manifests[0] != "test/image@"+getDigest(m) {
+		t.Errorf("want the tombstone purged, got %+v", res)
+	}
+	if _, err := os.Stat(path.Dir(p)); !os.IsNotExist(err) {
+		t.Errorf("want the tombstone gone, got %v", err)
+	}
+	if found, _ := blobExists(reg.rootDir, reg.config.layout(), "test/image", getDigest(layer)); found {
+		t.Error("want the layer collected with the purged tombstone")
+	}
+}
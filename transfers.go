@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// transferBudget caps the bytes of blob uploads and downloads in flight with
+// -max-in-flight-bytes, so that a burst of large transfers cannot exhaust
+// memory. Transfers that do not fit are refused with a 503 and retried by
+// the client. A single transfer larger than the whole budget is still let
+// through when nothing else is in flight, or it could never be served.
+type transferBudget struct {
+	max int64
+
+	mu   sync.Mutex
+	used int64
+}
+
+// acquire reserves n bytes, reporting whether they fit in the budget. It
+// always succeeds on a nil budget.
+func (b *transferBudget) acquire(n int64) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used > 0 && b.used+n > b.max {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// release returns n bytes reserved with acquire once the transfer is over.
+func (b *transferBudget) release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
+
+// writeTransfersBusy refuses a transfer that does not fit in the budget.
+func writeTransfersBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	writeOciError("UNAVAILABLE", "too many bytes in flight", w, 503)
+}
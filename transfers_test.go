@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTransferBudget(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), transfers: &transferBudget{max: 100}}
+	large := putTestBlob(t, reg.rootDir, "test/image", bytes.Repeat([]byte("l"), 50))
+	small := putTestBlob(t, reg.rootDir, "test/image", []byte("small"))
+	get := func(digest string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/image/blobs/"+digest, nil))
+		return w
+	}
+
+	// A long transfer already holds most of the budget.
+	if !reg.transfers.acquire(80) {
+		t.Fatal("first transfer refused")
+	}
+	if w := get(large); w.Code != 503 || w.Header().Get("Retry-After") == "" {
+		t.Errorf("large download: want 503 with Retry-After, got %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("POST", "/v2/test/image/blobs/uploads/?digest="+getDigest([]byte(strings.Repeat("u", 50))), strings.NewReader(strings.Repeat("u", 50))))
+	if w.Code != 503 {
+		t.Errorf("large upload: want 503, got %d", w.Code)
+	}
+	if w := get(small); w.Code != 200 {
+		t.Errorf("small download: want 200, got %d", w.Code)
+	}
+
+	reg.transfers.release(80)
+	if w := get(large); w.Code != 200 {
+		t.Errorf("large download once the budget is free: want 200, got %d", w.Code)
+	}
+	if reg.transfers.used != 0 {
+		t.Errorf("want the whole budget released, %d bytes still held", reg.transfers.used)
+	}
+}
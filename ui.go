@@ -0,0 +1,20 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// uiFiles is the single-page web UI, served at / with -ui. It only calls the
+// /v2/ API, so it sees what the browser's credentials allow.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// serveUI registers the web UI at / on mux. Paths that no other handler of
+// mux serves and that are not UI files are answered with 404.
+func serveUI(mux *http.ServeMux) {
+	files, _ := fs.Sub(uiFiles, "ui")
+	mux.Handle("/", http.FileServer(http.FS(files)))
+}
@@ -0,0 +1,125 @@
+// A minimal browser for the registry, built only on the /v2/ API and the
+// /v2/<name>/_info extension. Routes are kept in the URL fragment:
+//   #                       repositories
+//   #/<name>                tags and details of a repository
+//   #/<name>@<reference>    a manifest
+"use strict";
+
+const manifestTypes = [
+  "application/vnd.oci.image.index.v1+json",
+  "application/vnd.oci.image.manifest.v1+json",
+  "application/vnd.docker.distribution.manifest.list.v2+json",
+  "application/vnd.docker.distribution.manifest.v2+json",
+].join(", ");
+
+const view = document.getElementById("view");
+const crumbs = document.getElementById("crumbs");
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  Object.assign(e, attrs);
+  e.append(...children);
+  return e;
+}
+
+function link(text, hash) {
+  return el("a", { href: "#" + hash }, text);
+}
+
+async function get(path, headers) {
+  const res = await fetch(path, { headers: headers || {} });
+  if (!res.ok) {
+    let msg = res.status + " " + res.statusText;
+    try {
+      const body = await res.json();
+      msg = body.errors.map((e) => e.code + ": " + e.message).join(", ");
+    } catch (e) {}
+    throw new Error(msg);
+  }
+  return res;
+}
+
+// getAll follows the Link headers of a paginated list.
+async function getAll(path, key) {
+  const items = [];
+  while (path) {
+    const res = await get(path);
+    items.push(...((await res.json())[key] || []));
+    const next = /<([^>]+)>;\s*rel="next"/.exec(res.headers.get("Link") || "");
+    path = next ? next[1] : null;
+  }
+  return items;
+}
+
+async function showRepos() {
+  crumbs.textContent = "";
+  const repos = await getAll("/v2/_catalog?n=100", "repositories");
+  if (repos.length === 0) {
+    return el("p", {}, "No repositories.");
+  }
+  return el("ul", {}, ...repos.map((r) => el("li", {}, link(r, "/" + r))));
+}
+
+async function showRepo(name) {
+  crumbs.textContent = " / " + name;
+  const [info, tags] = await Promise.all([
+    get("/v2/" + name + "/_info").then((r) => r.json()),
+    getAll("/v2/" + name + "/tags/list?n=100", "tags"),
+  ]);
+  const rows = [
+    ["Tags", info.tags],
+    ["Manifests", info.manifests],
+    ["Size", info.sizeBytes + " bytes"],
+    ["Created", info.created],
+    ["Last push", info.lastPush],
+    ["Config types", (info.configMediaTypes || []).join(", ")],
+  ];
+  return el("div", {},
+    el("table", {}, ...rows.map(([k, v]) => el("tr", {}, el("th", {}, k), el("td", {}, String(v))))),
+    el("h3", {}, "Tags"),
+    el("ul", {}, ...tags.map((t) => el("li", {}, link(t, "/" + name + "@" + t)))));
+}
+
+async function showManifest(name, ref) {
+  crumbs.textContent = "";
+  crumbs.append(" / ", link(name, "/" + name), " / " + ref);
+  const res = await get("/v2/" + name + "/manifests/" + ref, { Accept: manifestTypes });
+  const manifest = await res.json();
+  const out = el("div", {},
+    el("p", {}, "Digest: ", el("code", {}, res.headers.get("Docker-Content-Digest") || "")),
+    el("p", {}, "Media type: ", el("code", {}, res.headers.get("Content-Type") || "")));
+  if (manifest.manifests) {
+    out.append(el("h3", {}, "Manifests"), el("ul", {}, ...manifest.manifests.map((m) => {
+      const p = m.platform ? " (" + m.platform.os + "/" + m.platform.architecture + ")" : "";
+      return el("li", {}, link(m.digest, "/" + name + "@" + m.digest), p);
+    })));
+  }
+  if (manifest.layers) {
+    const size = manifest.layers.reduce((n, l) => n + l.size, 0);
+    out.append(el("p", {}, manifest.layers.length + " layers, " + size + " bytes"));
+  }
+  out.append(el("pre", {}, JSON.stringify(manifest, null, 2)));
+  return out;
+}
+
+async function route() {
+  const hash = decodeURIComponent(location.hash.slice(1));
+  view.textContent = "Loading…";
+  try {
+    let content;
+    if (hash.startsWith("/") && hash.includes("@")) {
+      const i = hash.lastIndexOf("@");
+      content = await showManifest(hash.slice(1, i), hash.slice(i + 1));
+    } else if (hash.startsWith("/")) {
+      content = await showRepo(hash.slice(1));
+    } else {
+      content = await showRepos();
+    }
+    view.replaceChildren(content);
+  } catch (e) {
+    view.replaceChildren(el("p", { className: "error" }, e.message));
+  }
+}
+
+window.addEventListener("hashchange", route);
+route();
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeUI(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	for _, enabled := range []bool{false, true} {
+		mux := http.NewServeMux()
+		mux.Handle("/v2/", reg)
+		if enabled {
+			serveUI(mux)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if !enabled {
+			if w.Code != 404 {
+				t.Errorf("want 404 without -ui, got %d", w.Code)
+			}
+			continue
+		}
+		if w.Code != 200 || !strings.Contains(w.Body.String(), "app.js") {
+			t.Fatalf("want the UI index, got %d: %s", w.Code, w.Body.String())
+		}
+		for _, p := range []string{"/app.js", "/style.css"} {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+			if w.Code != 200 {
+				t.Errorf("%s: want 200, got %d", p, w.Code)
+			}
+		}
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/missing.js", nil))
+		if w.Code != 404 {
+			t.Errorf("want 404 for a file not in the UI, got %d", w.Code)
+		}
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/v2/", nil))
+		if w.Code != 200 {
+			t.Errorf("want the API still served at /v2/, got %d", w.Code)
+		}
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/uuid"
+)
+
+const uploadIDRegex string = "^[a-zA-Z0-9-]+$"
+
+// uploadPath returns where the bytes received so far for an upload session
+// are kept until the upload is completed.
+func uploadPath(rootDir string, name string, id string) string {
+	return path.Join(rootDir, name, "_uploads", id)
+}
+
+// uploadID extracts the session ID from a /blobs/uploads/<id>[/...] path.
+func uploadID(urlPath string) string {
+	_, rest, _ := strings.Cut(urlPath, "/blobs/uploads/")
+	id, _, _ := strings.Cut(rest, "/")
+	if !matches(uploadIDRegex, id) {
+		return ""
+	}
+	return id
+}
+
+// uploadRange formats the Range header reporting the bytes received so far.
+func uploadRange(size int64) string {
+	if size > 0 {
+		size--
+	}
+	return fmt.Sprintf("0-%d", size)
+}
+
+// uploadEvent reports the state of an upload session to event stream
+// subscribers. Type is one of "progress", "complete" or "canceled".
+type uploadEvent struct {
+	Type     string `json:"-"`
+	Received int64  `json:"received"`
+	Digest   string `json:"digest,omitempty"`
+}
+
+// uploadTracker fans out upload events to the clients following a session.
+type uploadTracker struct {
+	mu          sync.Mutex
+	subscribers map[string][]chan uploadEvent
+}
+
+func (t *uploadTracker) subscribe(id string) (<-chan uploadEvent, func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.subscribers == nil {
+		t.subscribers = make(map[string][]chan uploadEvent)
+	}
+	ch := make(chan uploadEvent, 16)
+	t.subscribers[id] = append(t.subscribers[id], ch)
+	return ch, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		subs := t.subscribers[id]
+		for i, s := range subs {
+			if s == ch {
+				t.subscribers[id] = append(subs[:i], subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+		if len(t.subscribers[id]) == 0 {
+			delete(t.subscribers, id)
+		}
+	}
+}
+
+// publish delivers an event without blocking the upload; slow subscribers
+// may miss progress events. Completion and cancelation end every stream.
+func (t *uploadTracker) publish(id string, ev uploadEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ch := range t.subscribers[id] {
+		select {
+		case ch <- ev:
+		default:
+		}
+		if ev.Type != "progress" {
+			close(ch)
+		}
+	}
+	if ev.Type != "progress" {
+		delete(t.subscribers, id)
+	}
+}
+
+// progressWriter publishes the running total of an upload as bytes arrive.
+type progressWriter struct {
+	tracker  *uploadTracker
+	id       string
+	received int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.received += int64(len(b))
+	p.tracker.publish(p.id, uploadEvent{Type: "progress", Received: p.received})
+	return len(b), nil
+}
+
+func (reg *registry) startUpload(w http.ResponseWriter, r *http.Request, name string) {
+	id := uuid.Generate().String()
+	p := uploadPath(reg.rootDir, name, id)
+	if err := makeDirs(path.Dir(p), reg.config.modes()); err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	if err := os.WriteFile(p, nil, reg.config.modes().file); err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	reg.journal.record(name, id, 0, false)
+	// Some clients resolve a relative Location wrongly, so the session URL
+	// is given in full.
+	w.Header().Set("Location", absoluteURL(r, fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id), reg.config.proxyTrust()))
+	w.Header().Set("Range", uploadRange(0))
+	// Docker clients read the session ID from here as well.
+	w.Header().Set("Docker-Upload-UUID", id)
+	if reg.config.MaxChunkSize > 0 {
+		w.Header().Set("OCI-Chunk-Max-Length", fmt.Sprint(reg.config.MaxChunkSize))
+	}
+	w.WriteHeader(202)
+}
+
+func (reg *registry) uploadStatus(w http.ResponseWriter, r *http.Request, name string) {
+	id := uploadID(r.URL.Path)
+	fi, err := os.Stat(uploadPath(reg.rootDir, name, id))
+	if id == "" || errors.Is(err, fs.ErrNotExist) {
+		writeOciError("BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry", w, 404)
+		return
+	}
+	if err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	w.Header().Set("Location", r.URL.Path)
+	w.Header().Set("Range", uploadRange(fi.Size()))
+	w.Header().Set("Docker-Upload-UUID", id)
+	w.WriteHeader(204)
+}
+
+// patchUpload appends a chunk to an upload session. When the client sends a
+// Content-Range it must start exactly where the previous chunk ended.
+func (reg *registry) patchUpload(w http.ResponseWriter, r *http.Request, name string) {
+	id := uploadID(r.URL.Path)
+	p := uploadPath(reg.rootDir, name, id)
+	fi, err := os.Stat(p)
+	if id == "" || errors.Is(err, fs.ErrNotExist) {
+		writeOciError("BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry", w, 404)
+		return
+	}
+	if err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	if !checkUploadUUID(w, r, id) || !checkContentRange(w, r, fi.Size()) {
+		return
+	}
+	max := reg.config.MaxChunkSize
+	if max > 0 && r.ContentLength > max {
+		writeChunkTooLarge(w, max)
+		return
+	}
+	var body io.Reader = r.Body
+	if max > 0 {
+		// A chunk sent without a Content-Length is cut off just past the
+		// limit and rolled back.
+		body = io.LimitReader(r.Body, max+1)
+	}
+	h, err := resumeUploadDigest(p, fi.Size())
+	if err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	size, err := reg.appendUpload(p, id, fi.Size(), body, h)
+	if err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	if max > 0 && size-fi.Size() > max {
+		if err := os.Truncate(p, fi.Size()); err != nil {
+			reg.writeServerError(err, w)
+			return
+		}
+		writeChunkTooLarge(w, max)
+		return
+	}
+	if err := saveUploadDigest(p, size, h, reg.config.modes()); err != nil {
+		log.Printf("Unable to save the running digest of upload %s: %s", p, err)
+	}
+	reg.journal.record(name, id, size, false)
+	w.Header().Set("Location", r.URL.Path)
+	w.Header().Set("Range", uploadRange(size))
+	w.Header().Set("Docker-Upload-UUID", id)
+	w.Header().Set("OCI-Content-Digest", sumDigest(h, "sha256:"))
+	w.WriteHeader(202)
+}
+
+// uploadDigestPath returns where the running sha256 state of the upload
+// session file at p is kept between chunks.
+func uploadDigestPath(p string) string {
+	return p + ".sha256"
+}
+
+// resumeUploadDigest returns a sha256 hash of the first size bytes of the
+// upload session file at p. It resumes from the state saved after the
+// previous chunk, and only reads the file again when that state is missing
+// or stale, such as after a restart truncated the session.
+func resumeUploadDigest(p string, size int64) (hash.Hash, error) {
+	h := sha256.New()
+	if b, err := os.ReadFile(uploadDigestPath(p)); err == nil && len(b) > 8 && int64(binary.BigEndian.Uint64(b)) == size {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(b[8:]); err == nil {
+			return h, nil
+		}
+		h.Reset()
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, err = io.CopyN(h, f, size)
+	return h, err
+}
+
+// saveUploadDigest records the state of h, which has hashed the first size
+// bytes of the upload session file at p, for the next chunk to resume from.
+func saveUploadDigest(p string, size int64, h hash.Hash, modes fileModes) error {
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	b := binary.BigEndian.AppendUint64(nil, uint64(size))
+	return os.WriteFile(uploadDigestPath(p), append(b, state...), modes.file)
+}
+
+// removeUploadFiles deletes the session file at p along with its saved
+// digest state.
+func removeUploadFiles(p string) {
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Unable to remove upload %s: %s", p, err)
+	}
+	if err := os.Remove(uploadDigestPath(p)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Unable to remove upload %s: %s", uploadDigestPath(p), err)
+	}
+}
+
+// writeChunkTooLarge refuses a chunk longer than -max-chunk-size.
+func writeChunkTooLarge(w http.ResponseWriter, max int64) {
+	w.Header().Set("OCI-Chunk-Max-Length", fmt.Sprint(max))
+	writeOciErrorDetail("SIZE_INVALID", "chunk too large", map[string]int64{"max": max}, w, 413)
+}
+
+// checkUploadUUID verifies that a Docker-Upload-UUID echoed by the client
+// names the session of the URL. Otherwise it answers 400 and returns false.
+func checkUploadUUID(w http.ResponseWriter, r *http.Request, id string) bool {
+	if echoed := r.Header.Get("Docker-Upload-UUID"); echoed != "" && echoed != id {
+		writeOciErrorDetail("BLOB_UPLOAD_INVALID", "blob upload invalid", "Docker-Upload-UUID does not match the upload session", w, 400)
+		return false
+	}
+	return true
+}
+
+// checkContentRange verifies that a chunk sent with a Content-Range starts
+// exactly where the bytes received so far end. Otherwise it answers 416 with
+// the current range and returns false.
+func checkContentRange(w http.ResponseWriter, r *http.Request, size int64) bool {
+	cr := r.Header.Get("Content-Range")
+	if cr == "" {
+		return true
+	}
+	var start, end int64
+	if _, err := fmt.Sscanf(cr, "%d-%d", &start, &end); err != nil || start != size {
+		w.Header().Set("Location", r.URL.Path)
+		w.Header().Set("Range", uploadRange(size))
+		writeOciError("BLOB_UPLOAD_INVALID", "chunk out of order", w, 416)
+		return false
+	}
+	return true
+}
+
+// finishUpload appends any final chunk sent with the PUT, verifies the whole
+// blob against the digest query parameter and moves it into the blob store.
+// Like a PATCH, a final chunk may carry a Content-Range. A PUT without a
+// prior POST is accepted as a monolithic upload.
+func (reg *registry) finishUpload(w http.ResponseWriter, r *http.Request, name string) {
+	digest := r.FormValue("digest")
+	if !matches(digestRegex, digest) {
+		writeOciError("DIGEST_INVALID", "provided digest did not match uploaded content", w, 400)
+		return
+	}
+	id := uploadID(r.URL.Path)
+	if id == "" {
+		writeOciError("BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry", w, 404)
+		return
+	}
+	if !checkUploadUUID(w, r, id) {
+		return
+	}
+	if reg.idempotency.replay(w, r, digest, reg.blobStored(name, digest)) {
+		return
+	}
+	expected, err := requestContentDigest(r)
+	if err != nil {
+		writeOciError("DIGEST_INVALID", err.Error(), w, 400)
+		return
+	}
+	p := uploadPath(reg.rootDir, name, id)
+	// A blob that is already stored need not be transferred again; any chunks
+	// received for it so far are dropped.
+	exists, err := blobExists(reg.rootDir, reg.config.layout(), name, digest)
+	if err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	if exists {
+		removeUploadFiles(p)
+		reg.journal.record(name, id, 0, true)
+		reg.uploads.publish(id, uploadEvent{Type: "complete", Digest: digest})
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+		w.Header().Set("Docker-Content-Digest", digest)
+		reg.idempotency.commit(w, r, digest)
+		w.WriteHeader(201)
+		return
+	}
+	if err := makeDirs(path.Dir(p), reg.config.modes()); err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	var offset int64
+	if fi, err := os.Stat(p); err == nil {
+		offset = fi.Size()
+	}
+	if !checkContentRange(w, r, offset) {
+		return
+	}
+	// The final chunk is hashed as it is written. When it is the whole blob,
+	// as in a monolithic upload, that hash verifies the blob without reading
+	// it back.
+	h := algorithmFor(digest)
+	he := h
+	var hashes io.Writer = h
+	if expected != "" && digestAlgorithm(expected) != digestAlgorithm(digest) {
+		he = algorithmFor(expected)
+		hashes = io.MultiWriter(h, he)
+	}
+	timing := timingFrom(r.Context())
+	start := time.Now()
+	size, err := reg.appendUpload(p, id, offset, r.Body, hashes)
+	if err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	timing.since("storage", start)
+	if expected != "" && expected != sumDigest(he, expected) {
+		reg.cancelUploadFile(name, id)
+		writeOciError("DIGEST_INVALID", "Content-Digest did not match uploaded content", w, 400)
+		return
+	}
+	start = time.Now()
+	if (offset == 0 && sumDigest(h, digest) != digest) || (offset > 0 && !validateBlob(p, size, digest)) {
+		reg.cancelUploadFile(name, id)
+		writeOciError("DIGEST_INVALID", "provided digest did not match uploaded content", w, 400)
+		return
+	}
+	timing.since("hash", start)
+	dest := blobPath(reg.rootDir, reg.config.layout(), name, digest)
+	if err := makeDirs(path.Dir(dest), reg.config.modes()); err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	// The session file was created subject to the umask.
+	if err := os.Chmod(p, reg.config.modes().file); err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	if err := os.Rename(p, dest); err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	removeUploadFiles(p)
+	reg.usage.add(size)
+	reg.blobStats.forget(name, digest)
+	reg.journal.record(name, id, size, true)
+	reg.uploads.publish(id, uploadEvent{Type: "complete", Received: size, Digest: digest})
+	reg.repoCommitted(name)
+	reg.mirror.blob(name, digest)
+	reg.notifier.blob(r, "push", name, digest, size)
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+	w.Header().Set("Docker-Content-Digest", digest)
+	reg.idempotency.commit(w, r, digest)
+	w.WriteHeader(201)
+}
+
+func (reg *registry) cancelUpload(w http.ResponseWriter, r *http.Request, name string) {
+	id := uploadID(r.URL.Path)
+	p := uploadPath(reg.rootDir, name, id)
+	if _, err := os.Stat(p); id == "" || errors.Is(err, fs.ErrNotExist) {
+		writeOciError("BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry", w, 404)
+		return
+	}
+	reg.cancelUploadFile(name, id)
+	w.WriteHeader(204)
+}
+
+func (reg *registry) cancelUploadFile(name string, id string) {
+	removeUploadFiles(uploadPath(reg.rootDir, name, id))
+	reg.journal.record(name, id, 0, true)
+	reg.uploads.publish(id, uploadEvent{Type: "canceled"})
+}
+
+// appendUpload copies body onto the end of an upload session file, which
+// already holds offset bytes, and returns the new size. Bytes are also
+// written to h when it is not nil. With -fsync the file is flushed to disk
+// before returning.
+func (reg *registry) appendUpload(p string, id string, offset int64, body io.Reader, h io.Writer) (int64, error) {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, reg.config.modes().file)
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+	progress := &progressWriter{tracker: &reg.uploads, id: id, received: offset}
+	dst := io.MultiWriter(f, progress)
+	if h != nil {
+		dst = io.MultiWriter(f, progress, h)
+	}
+	n, err := io.Copy(dst, body)
+	if err == nil && reg.config.Fsync {
+		err = syncFile(f)
+	}
+	return offset + n, err
+}
+
+// streamUploadEvents follows an upload session as server-sent events, so a
+// UI can show progress during a chunked push. The stream ends when the upload
+// completes or is canceled.
+func (reg *registry) streamUploadEvents(w http.ResponseWriter, r *http.Request, name string) {
+	id := uploadID(r.URL.Path)
+	events, unsubscribe := reg.uploads.subscribe(id)
+	defer unsubscribe()
+	fi, err := os.Stat(uploadPath(reg.rootDir, name, id))
+	if id == "" || errors.Is(err, fs.ErrNotExist) {
+		writeOciError("BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry", w, 404)
+		return
+	}
+	if err != nil {
+		reg.writeServerError(err, w)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		reg.writeServerError(errors.New("streaming unsupported"), w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	ev := uploadEvent{Type: "progress", Received: fi.Size()}
+	for {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			log.Printf("Unable to marshal upload event: %s", err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+			return
+		}
+		flusher.Flush()
+		if ev.Type != "progress" {
+			return
+		}
+		select {
+		case next, ok := <-events:
+			if !ok {
+				return
+			}
+			ev = next
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
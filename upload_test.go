@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func startTestUpload(t *testing.T, reg *registry, name string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("POST", "/v2/"+name+"/blobs/uploads/", nil))
+	if w.Code != 202 {
+		t.Fatalf("want 202, got %d", w.Code)
+	}
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.RequestURI()
+}
+
+func patchTestUpload(t *testing.T, reg *registry, location string, chunk []byte, contentRange string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("PATCH", location, bytes.NewReader(chunk))
+	if contentRange != "" {
+		req.Header.Set("Content-Range", contentRange)
+	}
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	return w
+}
+
+func TestChunkedUpload(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	location := startTestUpload(t, reg, "test/image")
+
+	if w := patchTestUpload(t, reg, location, []byte("hello "), "0-5"); w.Code != 202 || w.Header().Get("Range") != "0-5" {
+		t.Fatalf("first chunk: got %d with range %q", w.Code, w.Header().Get("Range"))
+	}
+	if w := patchTestUpload(t, reg, location, []byte("again"), "0-4"); w.Code != 416 {
+		t.Errorf("out of order chunk: want 416, got %d", w.Code)
+	}
+	if w := patchTestUpload(t, reg, location, []byte("world"), "6-10"); w.Code != 202 {
+		t.Fatalf("second chunk: want 202, got %d", w.Code)
+	}
+
+	content := []byte("hello world")
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", location+"?digest="+getDigest(content), nil))
+	if w.Code != 201 {
+		t.Fatalf("want 201, got %d: %s", w.Code, w.Body.String())
+	}
+	b, err := os.ReadFile(blobPath(reg.rootDir, reg.config.layout(), "test/image", getDigest(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Errorf("want %q, got %q", content, b)
+	}
+}
+
+func TestChunkedUploadFinalChunkInPut(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	location := startTestUpload(t, reg, "test/image")
+	if w := patchTestUpload(t, reg, location, []byte("hello "), "0-5"); w.Code != 202 {
+		t.Fatalf("first chunk: want 202, got %d", w.Code)
+	}
+
+	content := []byte("hello world")
+	put := func(contentRange string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", location+"?digest="+getDigest(content), bytes.NewReader([]byte("world")))
+		req.Header.Set("Content-Range", contentRange)
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, req)
+		return w
+	}
+	if w := put("3-7"); w.Code != 416 || w.Header().Get("Range") != "0-5" {
+		t.Errorf("misplaced final chunk: want 416 with range 0-5, got %d %q", w.Code, w.Header().Get("Range"))
+	}
+	if w := put("6-10"); w.Code != 201 {
+		t.Fatalf("final chunk: want 201, got %d: %s", w.Code, w.Body.String())
+	}
+	b, err := os.ReadFile(blobPath(reg.rootDir, reg.config.layout(), "test/image", getDigest(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Errorf("want %q, got %q", content, b)
+	}
+}
+
+func TestChunkedUploadWrongDigest(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	location := startTestUpload(t, reg, "test/image")
+	patchTestUpload(t, reg, location, []byte("hello"), "")
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", location+"?digest="+getDigest([]byte("other")), nil))
+	if w.Code != 400 {
+		t.Fatalf("want 400, got %d", w.Code)
+	}
+	if _, err := os.Stat(blobPath(reg.rootDir, reg.config.layout(), "test/image", getDigest([]byte("other")))); !os.IsNotExist(err) {
+		t.Error("blob with wrong digest must not be stored")
+	}
+}
+
+func TestUploadProgressEvents(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	location := startTestUpload(t, reg, "test/image")
+
+	resp, err := http.Get(srv.URL + location + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("want an event stream, got %q", ct)
+	}
+	events := make(chan string)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				events <- line
+			}
+		}
+	}()
+	next := func() string {
+		t.Helper()
+		ev := <-events
+		data := <-events
+		return ev + " " + data
+	}
+	if got := next(); got != `event: progress data: {"received":0}` {
+		t.Fatalf("unexpected initial event %q", got)
+	}
+
+	patchTestUpload(t, reg, location, []byte("hello "), "")
+	if got := next(); got != `event: progress data: {"received":6}` {
+		t.Errorf("unexpected progress event %q", got)
+	}
+	patchTestUpload(t, reg, location, []byte("world"), "")
+	if got := next(); got != `event: progress data: {"received":11}` {
+		t.Errorf("unexpected progress event %q", got)
+	}
+	digest := getDigest([]byte("hello world"))
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", location+"?digest="+digest, nil))
+	if got := next(); !strings.HasPrefix(got, "event: complete") || !strings.Contains(got, digest) {
+		t.Errorf("unexpected completion event %q", got)
+	}
+	if _, ok := <-events; ok {
+		t.Error("want the stream to close after completion")
+	}
+	io.Copy(io.Discard, resp.Body)
+}
+
+// unreadBody fails the test if the handler reads the request body.
+type unreadBody struct{ t *testing.T }
+
+func (b unreadBody) Read(p []byte) (int, error) {
+	b.t.Error("request body was read for a blob that is already stored")
+	return 0, io.EOF
+}
+
+func TestUploadExistingBlobSkipsTransfer(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	content := []byte("layer")
+	digest := putTestBlob(t, reg.rootDir, "test/image", content)
+	before, err := os.Stat(blobPath(reg.rootDir, reg.config.layout(), "test/image", digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for method, url := range map[string]string{
+		"POST": "/v2/test/image/blobs/uploads/?digest=" + digest,
+		"PUT":  "/v2/test/image/blobs/uploads/some-id?digest=" + digest,
+	} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest(method, url, unreadBody{t}))
+		if w.Code != 201 {
+			t.Errorf("%s: want 201, got %d: %s", method, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Docker-Content-Digest"); got != digest {
+			t.Errorf("%s: want Docker-Content-Digest %s, got %q", method, digest, got)
+		}
+	}
+	after, err := os.Stat(blobPath(reg.rootDir, reg.config.layout(), "test/image", digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) || !os.SameFile(before, after) {
+		t.Error("stored blob was rewritten")
+	}
+}
+
+func TestStartUploadAbsoluteLocation(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/v2/test/image/blobs/uploads/", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, srv.URL+"/v2/test/image/blobs/uploads/") {
+		t.Fatalf("want an absolute Location on %s, got %q", srv.URL, location)
+	}
+	resp, err = http.Get(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 204 {
+		t.Errorf("want the upload session at Location, got %d", resp.StatusCode)
+	}
+}
+
+func TestStartUploadForwardedLocation(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v2/test/image/blobs/uploads/", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "registry.example.com")
+	// httptest requests come from 192.0.2.1.
+	for _, c := range []struct {
+		config Config
+		want   string
+	}{
+		{Config{}, "http://example.com/v2/test/image/blobs/uploads/"},
+		{Config{TrustedProxies: stringList{"192.0.2.0/24"}}, "https://registry.example.com/v2/test/image/blobs/uploads/"},
+		{Config{TrustedProxies: stringList{"10.0.0.1"}}, "http://example.com/v2/test/image/blobs/uploads/"},
+		{Config{TrustForwarded: true}, "https://registry.example.com/v2/test/image/blobs/uploads/"},
+	} {
+		reg := &registry{rootDir: t.TempDir(), config: c.config}
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, req)
+		if got := w.Header().Get("Location"); !strings.HasPrefix(got, c.want) {
+			t.Errorf("%+v: want Location under %s, got %q", c.config, c.want, got)
+		}
+	}
+}
+
+func TestChunkedTransferEncoding(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	send := func(method string, url string, body []byte) *http.Response {
+		t.Helper()
+		// A reader of unknown length makes the client send the body chunked.
+		req, err := http.NewRequest(method, url, io.MultiReader(bytes.NewReader(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = -1
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	monolithic := []byte("monolithic chunked blob")
+	resp := send("PUT", srv.URL+"/v2/test/image/blobs/uploads/some-id?digest="+getDigest(monolithic), monolithic)
+	if resp.StatusCode != 201 {
+		t.Fatalf("monolithic: want 201, got %d", resp.StatusCode)
+	}
+
+	resp, err := http.Post(srv.URL+"/v2/test/image/blobs/uploads/", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if resp = send("PATCH", location, []byte("hello ")); resp.StatusCode != 202 || resp.Header.Get("Range") != "0-5" {
+		t.Fatalf("chunk: got %d with range %q", resp.StatusCode, resp.Header.Get("Range"))
+	}
+	content := []byte("hello world")
+	if resp = send("PUT", location+"?digest="+getDigest(content), []byte("world")); resp.StatusCode != 201 {
+		t.Fatalf("final chunk: want 201, got %d", resp.StatusCode)
+	}
+
+	for _, b := range [][]byte{monolithic, content} {
+		stored, err := os.ReadFile(blobPath(reg.rootDir, reg.config.layout(), "test/image", getDigest(b)))
+		if err != nil || !bytes.Equal(stored, b) {
+			t.Errorf("want %q stored, got %q (%v)", b, stored, err)
+		}
+	}
+}
+
+func TestMaxChunkSize(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), config: Config{MaxChunkSize: 4}}
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("POST", "/v2/test/image/blobs/uploads/", nil))
+	if got := w.Header().Get("OCI-Chunk-Max-Length"); got != "4" {
+		t.Errorf("want OCI-Chunk-Max-Length 4 advertised, got %q", got)
+	}
+	location := startTestUpload(t, reg, "test/image")
+
+	if w := patchTestUpload(t, reg, location, []byte("toolong"), ""); w.Code != 413 {
+		t.Errorf("oversized chunk: want 413, got %d", w.Code)
+	}
+	// Without a Content-Length the chunk is only found out while it is read.
+	req := httptest.NewRequest("PATCH", location, io.MultiReader(strings.NewReader("toolong")))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	if w.Code != 413 {
+		t.Errorf("oversized chunk without Content-Length: want 413, got %d", w.Code)
+	}
+	if w := patchTestUpload(t, reg, location, []byte("fits"), "0-3"); w.Code != 202 || w.Header().Get("Range") != "0-3" {
+		t.Errorf("chunk within the limit: got %d with range %q", w.Code, w.Header().Get("Range"))
+	}
+}
+
+func TestChunkedUploadRunningDigest(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	location := startTestUpload(t, reg, "test/image")
+	var received []byte
+	for i, chunk := range []string{"hello ", "chunked ", "world"} {
+		w := patchTestUpload(t, reg, location, []byte(chunk), "")
+		if w.Code != 202 {
+			t.Fatalf("chunk %d: want 202, got %d", i, w.Code)
+		}
+		received = append(received, chunk...)
+		if got := w.Header().Get("OCI-Content-Digest"); got != getDigest(received) {
+			t.Errorf("chunk %d: want running digest %s, got %s", i, getDigest(received), got)
+		}
+	}
+
+	// Without its saved state the digest is computed from the file.
+	p := uploadPath(reg.rootDir, "test/image", uploadID(location))
+	if err := os.Remove(uploadDigestPath(p)); err != nil {
+		t.Fatal(err)
+	}
+	w := patchTestUpload(t, reg, location, []byte("!"), "")
+	received = append(received, '!')
+	if got := w.Header().Get("OCI-Content-Digest"); got != getDigest(received) {
+		t.Errorf("without saved state: want running digest %s, got %s", getDigest(received), got)
+	}
+
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("PUT", location+"?digest="+getDigest(received), nil))
+	if w.Code != 201 {
+		t.Fatalf("want 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(uploadDigestPath(p)); !os.IsNotExist(err) {
+		t.Errorf("want the saved digest state removed with the session, got %v", err)
+	}
+}
+
+func TestEmptyBodyUnderDigest(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	digest := getDigest([]byte("layer"))
+	session := startTestUpload(t, reg, "test/image")
+	for _, c := range []struct{ method, url string }{
+		{"PUT", "/v2/test/image/blobs/uploads/some-id?digest=" + digest},
+		{"POST", "/v2/test/image/blobs/uploads/?digest=" + digest},
+		{"PUT", session + "?digest=" + digest},
+	} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest(c.method, c.url, bytes.NewReader(nil)))
+		if w.Code != 400 || !strings.Contains(w.Body.String(), `"DIGEST_INVALID"`) {
+			t.Errorf("%s %s: want 400 DIGEST_INVALID, got %d: %s", c.method, c.url, w.Code, w.Body.String())
+		}
+	}
+	if ok, _ := blobExists(reg.rootDir, reg.config.layout(), "test/image", digest); ok {
+		t.Error("want nothing stored for an empty body")
+	}
+
+	// Blobs are opaque, so whatever Content-Type a client sends is ignored.
+	req := httptest.NewRequest("PUT", "/v2/test/image/blobs/uploads/some-id?digest="+digest, bytes.NewReader([]byte("layer")))
+	req.Header.Set("Content-Type", "application/x-unusual; charset=binary")
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Errorf("unusual Content-Type: want 201, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDockerUploadUUID(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir()}
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("POST", "/v2/test/image/blobs/uploads/", nil))
+	id := w.Header().Get("Docker-Upload-UUID")
+	if w.Code != 202 || id == "" || !strings.HasSuffix(w.Header().Get("Location"), "/blobs/uploads/"+id) {
+		t.Fatalf("want 202 with the session ID in Docker-Upload-UUID, got %d %q", w.Code, id)
+	}
+	location := "/v2/test/image/blobs/uploads/" + id
+
+	req := httptest.NewRequest("PATCH", location, strings.NewReader("hello"))
+	req.Header.Set("Docker-Upload-UUID", id)
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	if w.Code != 202 || w.Header().Get("Docker-Upload-UUID") != id {
+		t.Fatalf("PATCH echoing the ID: want 202, got %d %q", w.Code, w.Header().Get("Docker-Upload-UUID"))
+	}
+	req = httptest.NewRequest("PUT", location+"?digest="+getDigest([]byte("hello")), nil)
+	req.Header.Set("Docker-Upload-UUID", "another-session")
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Errorf("PUT with a mismatched ID: want 400, got %d", w.Code)
+	}
+	req.Header.Set("Docker-Upload-UUID", id)
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Errorf("PUT echoing the ID: want 201, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// storageUsage tracks the bytes stored by the registry against
+// -max-total-storage. The storage root is walked once, after which committed
+// blobs and manifests are added as they are pushed, so that a push does not
+// cost a walk. Bulk removals such as garbage collection or repository
+// eviction mark the figure stale, and the next check walks the root again.
+// Small metadata files written next to manifests are only counted by a walk.
+type storageUsage struct {
+	rootDir string
+	max     int64
+
+	mu     sync.Mutex
+	loaded bool
+	bytes  int64
+}
+
+// full reports whether the stored bytes have reached the limit, so that
+// further pushes must be refused.
+func (u *storageUsage) full() (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.loaded {
+		n, err := walkStorageUsage(u.rootDir)
+		if err != nil {
+			return false, err
+		}
+		u.bytes, u.loaded = n, true
+	}
+	return u.bytes >= u.max, nil
+}
+
+// add accounts for n bytes committed to storage, or removed when n is
+// negative.
+func (u *storageUsage) add(n int64) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.bytes += n
+}
+
+// invalidate has the next check walk the storage root again.
+func (u *storageUsage) invalidate() {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.loaded = false
+}
+
+// walkStorageUsage adds up the files of every repository. Upload sessions
+// in progress and the registry's own bookkeeping at the top of the root are
+// not counted.
+func walkStorageUsage(rootDir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(rootDir, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if de.IsDir() {
+			if de.Name() == "_uploads" {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if filepath.Dir(p) == rootDir && strings.HasPrefix(de.Name(), "_") {
+			return nil
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			total += fi.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// isPush reports whether a request adds content to a repository, and so is
+// refused once -max-total-storage is reached.
+func isPush(method string, endpoint string) bool {
+	if method != "POST" && method != "PUT" && method != "PATCH" {
+		return false
+	}
+	return strings.Contains(endpoint, "/blobs/uploads/") || strings.Contains(endpoint, "/manifests/") || strings.HasPrefix(endpoint, "/_import")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaxTotalStorage(t *testing.T) {
+	rootDir := t.TempDir()
+	reg := &registry{rootDir: rootDir, usage: &storageUsage{rootDir: rootDir, max: 100}}
+	if w := putTestBlobRequest(reg, "test/a", bytes.Repeat([]byte("a"), 60)); w.Code != 201 {
+		t.Fatalf("first push: want 201, got %d", w.Code)
+	}
+	// The cap is only checked before a push, so this one overshoots it.
+	if w := putTestBlobRequest(reg, "test/b", bytes.Repeat([]byte("b"), 60)); w.Code != 201 {
+		t.Fatalf("second push: want 201, got %d", w.Code)
+	}
+	if reg.usage.bytes != 120 {
+		t.Errorf("want 120 bytes tracked, got %d", reg.usage.bytes)
+	}
+
+	for _, c := range []struct{ method, path string }{
+		{"PUT", "/v2/test/c/blobs/uploads/some-id?digest=" + getDigest([]byte("c"))},
+		{"POST", "/v2/test/c/blobs/uploads/"},
+		{"PUT", "/v2/test/a/manifests/v1"},
+	} {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest(c.method, c.path, strings.NewReader("c")))
+		if w.Code != 507 || !strings.Contains(w.Body.String(), `"DENIED"`) {
+			t.Errorf("%s %s: want 507 DENIED, got %d: %s", c.method, c.path, w.Code, w.Body.String())
+		}
+	}
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/v2/test/a/blobs/"+getDigest(bytes.Repeat([]byte("a"), 60)), nil))
+	if w.Code != 200 {
+		t.Errorf("pull: want 200, got %d", w.Code)
+	}
+
+	// Once content is removed behind its back, a walk picks up the change.
+	removeRepo(rootDir, "test/b")
+	reg.usage.invalidate()
+	if w := putTestBlobRequest(reg, "test/c", []byte("c")); w.Code != 201 {
+		t.Errorf("push after freeing space: want 201, got %d", w.Code)
+	}
+}
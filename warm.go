@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+// warmResult is what warming a manifest read.
+type warmResult struct {
+	Manifests int   `json:"manifests"`
+	Blobs     int   `json:"blobs"`
+	Bytes     int64 `json:"bytes"`
+	// Missing lists the referenced blobs and manifests that are not stored.
+	Missing []string `json:"missing"`
+}
+
+// warmHandler serves POST /admin/warm?repo=<name>&ref=<tag or digest>. It
+// reads every blob the manifest refers to, through the manifests of an
+// image index too, so that the first real pull, for example after deploying
+// a mirror, finds them in the page cache and in the blob stat cache.
+type warmHandler struct {
+	reg *registry
+}
+
+func (h *warmHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeOciError("UNSUPPORTED", "warming is started with POST", w, 405)
+		return
+	}
+	name, ref := r.URL.Query().Get("repo"), r.URL.Query().Get("ref")
+	if !matches(nameRegex, name) {
+		writeOciError("NAME_INVALID", "invalid repository name", w, 400)
+		return
+	}
+	if !matches(refRegex, ref) && !matches(digestRegex, ref) {
+		writeOciError("MANIFEST_INVALID", "manifest invalid", w, 400)
+		return
+	}
+	p, err := resolveManifest(h.reg.rootDir, name, ref, h.reg.config.modes())
+	if err != nil {
+		h.reg.writeServerError(err, w)
+		return
+	}
+	if p == "" {
+		h.reg.writeNotFound(w, name, "MANIFEST_UNKNOWN", "manifest unknown to registry")
+		return
+	}
+	body, err := os.ReadFile(p)
+	if err != nil {
+		h.reg.writeServerError(err, w)
+		return
+	}
+	res := warmResult{Missing: make([]string, 0)}
+	if err := h.warm(name, body, &res, make(map[string]bool)); err != nil {
+		h.reg.writeServerError(err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// warm reads the blobs of a manifest and of the manifests it lists, each
+// once as recorded in seen.
+func (h *warmHandler) warm(name string, body []byte, res *warmResult, seen map[string]bool) error {
+	res.Manifests++
+	refs := parseManifestRefs(body)
+	for _, child := range refs.Manifests {
+		d := string(child.Digest)
+		if seen[d] {
+			continue
+		}
+		seen[d] = true
+		b, err := loadStoredManifest(h.reg.rootDir, name, d, h.reg.config.modes())
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			res.Missing = append(res.Missing, d)
+			continue
+		}
+		if err := h.warm(name, b, res, seen); err != nil {
+			return err
+		}
+	}
+	blobs := refs.Layers
+	if refs.Config != nil {
+		blobs = append(blobs, *refs.Config)
+	}
+	for _, desc := range blobs {
+		d := string(desc.Digest)
+		if seen[d] || !matches(digestRegex, d) {
+			continue
+		}
+		seen[d] = true
+		st, err := h.reg.blobStats.stat(h.reg.rootDir, h.reg.config.layout(), name, d)
+		if err != nil {
+			return err
+		}
+		if !st.exists {
+			res.Missing = append(res.Missing, d)
+			continue
+		}
+		n, err := readBlob(blobPath(h.reg.rootDir, h.reg.config.layout(), name, d))
+		if err != nil {
+			return err
+		}
+		res.Blobs++
+		res.Bytes += n
+	}
+	return nil
+}
+
+// readBlob reads a stored blob through and returns its size. The empty JSON
+// blob need not be stored, in which case nothing is read.
+func readBlob(p string) (int64, error) {
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(io.Discard, f)
+}
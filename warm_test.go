@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWarm(t *testing.T) {
+	reg := &registry{rootDir: t.TempDir(), blobStats: newBlobStatCache(time.Minute)}
+	layer := []byte("layer")
+	putTestBlob(t, reg.rootDir, "test/image", emptyJSON)
+	putTestBlob(t, reg.rootDir, "test/image", layer)
+	missing := getDigest([]byte("missing"))
+	image := imageManifest(emptyJSONDigest, getDigest(layer), missing)
+	putTestManifest(t, reg, "test/image", getDigest(image), image)
+	putTestManifest(t, reg, "test/image", "v1", indexManifest(getDigest(image)))
+
+	stats := 0
+	defer func(orig func(string) (os.FileInfo, error)) { statFile = orig }(statFile)
+	statFile = func(p string) (os.FileInfo, error) {
+		stats++
+		return os.Stat(p)
+	}
+
+	h := &warmHandler{reg: reg}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/admin/warm?repo=test/image&ref=v1", nil))
+	if w.Code != 200 {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var res warmResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Manifests != 2 || res.Blobs != 2 || res.Bytes != int64(len(layer)+len(emptyJSON)) || len(res.Missing) != 1 || res.Missing[0] != missing {
+		t.Errorf("unexpected summary %+v", res)
+	}
+
+	stats = 0
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("HEAD", "/v2/test/image/blobs/"+getDigest(layer), nil))
+	if w.Code != 200 || stats != 0 {
+		t.Errorf("want the warmed blob served from the cache, got %d after %d stats", w.Code, stats)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/admin/warm?repo=test/image&ref=v2", nil))
+	if w.Code != 404 {
+		t.Errorf("unknown tag: want 404, got %d", w.Code)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/distribution/distribution/uuid"
+)
+
+// mediaTypeDockerEvents is the Content-Type of Docker Registry notifications.
+const mediaTypeDockerEvents = "application/vnd.docker.distribution.events.v1+json"
+
+// webhookEvent is posted as JSON to every webhook in the simple format when
+// content is pushed, pulled or deleted.
+type webhookEvent struct {
+	// Action is "push", "pull" or "delete".
+	Action string `json:"action"`
+	// Target is "manifest" or "blob".
+	Target     string `json:"target"`
+	Repository string `json:"repository"`
+	// Reference is the tag or digest of a manifest; it is empty for blobs.
+	Reference string    `json:"reference,omitempty"`
+	Digest    string    `json:"digest"`
+	MediaType string    `json:"mediaType"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// The rest is only sent in the docker format.
+	size    int64
+	url     string
+	actor   string
+	request dockerRequest
+}
+
+// dockerEnvelope is the Docker Registry notification format, for tooling
+// that already consumes it.
+type dockerEnvelope struct {
+	Events []dockerEvent `json:"events"`
+}
+
+type dockerEvent struct {
+	ID        string        `json:"id"`
+	Timestamp time.Time     `json:"timestamp"`
+	Action    string        `json:"action"`
+	Target    dockerTarget  `json:"target"`
+	Request   dockerRequest `json:"request"`
+	Actor     dockerActor   `json:"actor"`
+	Source    dockerSource  `json:"source"`
+}
+
+type dockerTarget struct {
+	MediaType  string `json:"mediaType"`
+	Size       int64  `json:"size"`
+	Digest     string `json:"digest"`
+	Length     int64  `json:"length"`
+	Repository string `json:"repository"`
+	URL        string `json:"url"`
+	Tag        string `json:"tag,omitempty"`
+}
+
+type dockerRequest struct {
+	ID        string `json:"id"`
+	Addr      string `json:"addr"`
+	Host      string `json:"host"`
+	Method    string `json:"method"`
+	UserAgent string `json:"useragent"`
+}
+
+type dockerActor struct {
+	Name string `json:"name,omitempty"`
+}
+
+type dockerSource struct {
+	Addr       string `json:"addr"`
+	InstanceID string `json:"instanceID"`
+}
+
+// notifier delivers events to the webhooks set with -webhooks, for example
+// to start CI or send notifications. Events are delivered in the background
+// in the order they happen; failed deliveries are retried with exponential
+// backoff and then logged, and never fail the client's request.
+type notifier struct {
+	endpoints []string
+	// format is "simple" or "docker", as set with -webhook-format.
+	format  string
+	proxies proxyTrust
+	source  dockerSource
+	client  *http.Client
+	events  chan webhookEvent
+	retries int
+	backoff time.Duration
+}
+
+func newNotifier(config Config) *notifier {
+	host, _ := os.Hostname()
+	n := &notifier{
+		endpoints: config.Webhooks,
+		format:    config.WebhookFormat,
+		proxies:   config.proxyTrust(),
+		source:    dockerSource{Addr: host + config.Addr, InstanceID: uuid.Generate().String()},
+		client:    &http.Client{Timeout: time.Duration(config.WebhookTimeout)},
+		events:    make(chan webhookEvent, 1024),
+		retries:   5,
+		backoff:   time.Second,
+	}
+	go n.run()
+	return n
+}
+
+// manifest queues the event for a manifest pushed, pulled or deleted with
+// r. It is a no-op on a nil notifier.
+func (n *notifier) manifest(r *http.Request, action string, name string, ref string, digest string, mediaType string, size int64) {
+	n.enqueue(r, webhookEvent{Action: action, Target: "manifest", Repository: name, Reference: ref, Digest: digest, MediaType: mediaType, size: size})
+}
+
+// blob queues the event for a blob pushed, pulled or deleted with r. It is
+// a no-op on a nil notifier.
+func (n *notifier) blob(r *http.Request, action string, name string, digest string, size int64) {
+	n.enqueue(r, webhookEvent{Action: action, Target: "blob", Repository: name, Digest: digest, MediaType: "application/octet-stream", size: size})
+}
+
+// enqueue completes an event with what it needs from the request, which
+// must not be used once the handler returns, and queues it.
+func (n *notifier) enqueue(r *http.Request, ev webhookEvent) {
+	if n == nil {
+		return
+	}
+	ev.Timestamp = time.Now().UTC()
+	ev.url = absoluteURL(r, fmt.Sprintf("/v2/%s/%ss/%s", ev.Repository, ev.Target, ev.Digest), n.proxies)
+	ev.actor, _, _ = r.BasicAuth()
+	ev.request = dockerRequest{
+		ID:        uuid.Generate().String(),
+		Addr:      r.RemoteAddr,
+		Host:      r.Host,
+		Method:    r.Method,
+		UserAgent: r.UserAgent(),
+	}
+	select {
+	case n.events <- ev:
+	default:
+		log.Printf("Webhook queue full, dropping %s event for %s@%s", ev.Action, ev.Repository, ev.Digest)
+	}
+}
+
+func (n *notifier) run() {
+	for ev := range n.events {
+		body, contentType, err := n.encode(ev)
+		if err != nil {
+			log.Printf("Unable to encode webhook event: %s", err)
+			continue
+		}
+		for _, endpoint := range n.endpoints {
+			err := retry(n.retries, n.backoff, func() error { return n.deliver(endpoint, contentType, body) })
+			if err != nil {
+				log.Printf("Giving up delivering %s event for %s@%s to %s: %s", ev.Action, ev.Repository, ev.Digest, endpoint, err)
+			}
+		}
+	}
+}
+
+// encode returns an event in the configured format with its Content-Type.
+func (n *notifier) encode(ev webhookEvent) ([]byte, string, error) {
+	if n.format != "docker" {
+		b, err := json.Marshal(ev)
+		return b, "application/json", err
+	}
+	target := dockerTarget{
+		MediaType:  ev.MediaType,
+		Size:       ev.size,
+		Digest:     ev.Digest,
+		Length:     ev.size,
+		Repository: ev.Repository,
+		URL:        ev.url,
+	}
+	if ev.Reference != "" && !matches(digestRegex, ev.Reference) {
+		target.Tag = ev.Reference
+	}
+	b, err := json.Marshal(dockerEnvelope{Events: []dockerEvent{{
+		ID:        uuid.Generate().String(),
+		Timestamp: ev.Timestamp,
+		Action:    ev.Action,
+		Target:    target,
+		Request:   ev.request,
+		Actor:     dockerActor{Name: ev.actor},
+		Source:    n.source,
+	}}})
+	return b, mediaTypeDockerEvents, err
+}
+
+func (n *notifier) deliver(endpoint string, contentType string, body []byte) error {
+	resp, err := n.client.Post(endpoint, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s", resp.Status, msg)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestWebhookPushEvent(t *testing.T) {
+	var mu sync.Mutex
+	var events []webhookEvent
+	// Fail the first delivery to check that it is retried.
+	failed := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !failed {
+			failed = true
+			w.WriteHeader(503)
+			return
+		}
+		var ev webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("undecodable event: %s", err)
+		}
+		events = append(events, ev)
+	}))
+	defer srv.Close()
+
+	n := newNotifier(Config{Webhooks: stringList{srv.URL}, WebhookFormat: "simple", WebhookTimeout: Duration(time.Second)})
+	n.backoff = time.Millisecond
+	reg := &registry{rootDir: t.TempDir(), notifier: n}
+	layer := []byte("layer")
+	if w := putTestBlobRequest(reg, "test/image", layer); w.Code != 201 {
+		t.Fatalf("blob push failed with %d", w.Code)
+	}
+	manifest := imageManifest(emptyJSONDigest, getDigest(layer))
+	putTestManifest(t, reg, "test/image", "v1", manifest)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		got := append([]webhookEvent(nil), events...)
+		mu.Unlock()
+		if len(got) == 2 {
+			if got[0].Action != "push" || got[0].Target != "blob" || got[0].Digest != getDigest(layer) {
+				t.Errorf("want a blob push event first, got %+v", got[0])
+			}
+			m := got[1]
+			if m.Action != "push" || m.Target != "manifest" || m.Repository != "test/image" || m.Reference != "v1" ||
+				m.Digest != getDigest(manifest) || m.MediaType == "" {
+				t.Errorf("want the manifest push event, got %+v", m)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want 2 events delivered, got %d", len(got))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookDockerFormat(t *testing.T) {
+	envelopes := make(chan dockerEnvelope, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Content-Type"); got != mediaTypeDockerEvents {
+			t.Errorf("want Content-Type %s, got %s", mediaTypeDockerEvents, got)
+		}
+		var env dockerEnvelope
+		if err := json.NewDecoder(r.Body).Decode(&env); err != nil {
+			t.Errorf("undecodable envelope: %s", err)
+		}
+		envelopes <- env
+	}))
+	defer srv.Close()
+
+	reg := &registry{rootDir: t.TempDir()}
+	reg.notifier = newNotifier(Config{Webhooks: stringList{srv.URL}, WebhookFormat: "docker", WebhookTimeout: Duration(time.Second)})
+	manifest := imageManifest(emptyJSONDigest)
+	req := httptest.NewRequest("PUT", "/v2/test/image/manifests/v1", bytes.NewReader(manifest))
+	req.Header.Set("Content-Type", v1.MediaTypeImageManifest)
+	req.Header.Set("User-Agent", "test-client")
+	req.SetBasicAuth("alice", "secret")
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Fatalf("push failed with %d: %s", w.Code, w.Body.String())
+	}
+	getTestManifest(reg, "test/image", "v1")
+
+	for _, action := range []string{"push", "pull"} {
+		select {
+		case env := <-envelopes:
+			if len(env.Events) != 1 {
+				t.Fatalf("%s: want one event in the envelope, got %d", action, len(env.Events))
+			}
+			ev := env.Events[0]
+			if ev.ID == "" || ev.Action != action || ev.Source.InstanceID == "" {
+				t.Errorf("%s: want an identified %s event, got %+v", action, action, ev)
+			}
+			if ev.Target.Repository != "test/image" || ev.Target.Tag != "v1" || ev.Target.Digest != getDigest(manifest) ||
+				ev.Target.Size != int64(len(manifest)) || ev.Target.MediaType != v1.MediaTypeImageManifest ||
+				!strings.HasSuffix(ev.Target.URL, "/v2/test/image/manifests/"+getDigest(manifest)) {
+				t.Errorf("%s: unexpected target %+v", action, ev.Target)
+			}
+			if action == "push" && (ev.Actor.Name != "alice" || ev.Request.Method != "PUT" || ev.Request.UserAgent != "test-client") {
+				t.Errorf("push: want the actor and request recorded, got %+v %+v", ev.Actor, ev.Request)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s event never delivered", action)
+		}
+	}
+}